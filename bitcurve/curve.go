@@ -1,5 +1,7 @@
 package bitcurve
 
+import "math/big"
+
 var (
 	group = NewGroup()
 	ctx = NewCtx()
@@ -11,6 +13,18 @@ var (
 	Gy = Hex2Bn("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8")
 )
 
+var (
+	order, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	halfOrder = new(big.Int).Rsh(order, 1)
+)
+
+// Initialized returns true if OpenSSL has set up the curve group and the context
+func Initialized() bool {
+	var noGroup Group
+	var noCtx Ctx
+	return group != noGroup && ctx != noCtx
+}
+
 // the resulting point should be release with FreePoint
 // return nil on error
 func UnmarshallCompressedPoint(bytes []byte) *Point {
@@ -26,6 +40,61 @@ func PointGetCoordinates(p Point) (x,y Bignum) {
 	return
 }
 
+// GenerateKey creates a new random key pair. The key should later be released with FreeKey
+func GenerateKey() (Key, bool) {
+	key := NewKey()
+	KeySetGroup(key, group)
+	if !KeyGenerate(key) {
+		FreeKey(key)
+		return key, false
+	}
+	return key, true
+}
+
+// KeyFromPrivate creates the key pair of the 32-byte big-endian private key.
+// The key should later be released with FreeKey
+func KeyFromPrivate(private []byte) (Key, bool) {
+	key := NewKey()
+	KeySetGroup(key, group)
+	d := Bin2Bn(private)
+	defer FreeBn(d)
+	pubkey := PointMul(group, d, PointNil, BnNil, ctx)
+	defer FreePoint(pubkey)
+	KeySetPublic(key, pubkey)
+	if !KeySetPrivate(key, d) || !KeyCheck(key) {
+		FreeKey(key)
+		return key, false
+	}
+	return key, true
+}
+
+// PrivateKeyBytes returns the private key as 32 big-endian bytes
+func PrivateKeyBytes(key Key) []byte {
+	return Bn2binPad(KeyGetPrivate(key), 32)
+}
+
+// PublicKey returns the public key of the key pair, it belongs to the key
+func PublicKey(key Key) Point {
+	return KeyGetPublic(key)
+}
+
+// SignHash signs the hash with the private key, r and s are 32 big-endian bytes each
+func SignHash(hash []byte, key Key) (r []byte, s []byte, ok bool) {
+	var noSig Sig
+	sig := Sign(hash, key)
+	if sig == noSig {
+		return nil, nil, false
+	}
+	defer FreeSig(sig)
+	rBn, sBn := SigGet(sig)
+	// low s, as libsecp256k1 and most other verifiers require
+	sInt := new(big.Int).SetBytes(Bn2binPad(sBn, 32))
+	if sInt.Cmp(halfOrder) > 0 {
+		sInt.Sub(order, sInt)
+	}
+	return Bn2binPad(rBn, 32), sInt.FillBytes(make([]byte, 32)), true
+}
+
 func VerifySig(hash []byte, sig Sig, pubkey Point) bool {
 	key := NewKey()
 	KeySetGroup(key, group)
@@ -0,0 +1,113 @@
+package bitcurve
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// ECIES seals a message to a public key. A fresh ephemeral key pair is generated, the shared point is
+// the ephemeral private key times the recipient public key, and the AES-256-GCM key is
+// HKDF-SHA256(ephemeral public key || shared point, no salt, EciesInfo), both points compressed.
+// The sealed message is the ephemeral public key (33 bytes), the nonce (12 bytes) and the ciphertext
+// followed by the 16-byte tag.
+
+// EciesOverhead is how much longer the sealed message is than the plaintext
+const EciesOverhead = 33 + 12 + 16
+
+var EciesInfo = []byte("bitcurve ecies v1")
+
+// ECDH returns the compressed point private * pubkey, the private key being 32 big-endian bytes
+func ECDH(private []byte, pubkey Point) ([]byte, bool) {
+	d := Bin2Bn(private)
+	defer FreeBn(d)
+	shared := PointMul(group, BnNil, pubkey, d, ctx)
+	defer FreePoint(shared)
+	bytes := MarshallCompressedPoint(shared)
+	// the point at infinity marshals to a single zero byte
+	if bytes[0] != 2 && bytes[0] != 3 {
+		return nil, false
+	}
+	return bytes, true
+}
+
+func eciesKey(ephemeral []byte, shared []byte) ([]byte, bool) {
+	key, err := hkdf.Key(sha256.New, append(append([]byte{}, ephemeral...), shared...), nil, string(EciesInfo), 32)
+	return key, err == nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, bool) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, false
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, err == nil
+}
+
+// Seal encrypts the plaintext to the public key, aad is authenticated but not encrypted and may be nil
+func Seal(pubkey Point, plaintext []byte, aad []byte) ([]byte, bool) {
+	ephemeral, ok := GenerateKey()
+	if !ok {
+		return nil, false
+	}
+	defer FreeKey(ephemeral)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, false
+	}
+	return sealWith(PrivateKeyBytes(ephemeral), nonce, pubkey, plaintext, aad)
+}
+
+// sealWith is Seal with the given ephemeral private key and nonce, for the test vectors
+func sealWith(ephemeralPrivate []byte, nonce []byte, pubkey Point, plaintext []byte, aad []byte) ([]byte, bool) {
+	ephemeral, ok := KeyFromPrivate(ephemeralPrivate)
+	if !ok {
+		return nil, false
+	}
+	defer FreeKey(ephemeral)
+	ephemeralPubkey := MarshallCompressedPoint(PublicKey(ephemeral))
+	shared, ok := ECDH(ephemeralPrivate, pubkey)
+	if !ok {
+		return nil, false
+	}
+	key, ok := eciesKey(ephemeralPubkey, shared)
+	if !ok {
+		return nil, false
+	}
+	aead, ok := newGCM(key)
+	if !ok {
+		return nil, false
+	}
+	sealed := append(append([]byte{}, ephemeralPubkey...), nonce...)
+	return aead.Seal(sealed, nonce, plaintext, aad), true
+}
+
+// Open decrypts the message sealed to the public key of the key pair, ok is false if it has been
+// tampered with, sealed to another key or with another aad
+func Open(key Key, sealed []byte, aad []byte) ([]byte, bool) {
+	if len(sealed) < EciesOverhead {
+		return nil, false
+	}
+	ephemeral := UnmarshallCompressedPoint(sealed[:33])
+	if ephemeral == nil {
+		return nil, false
+	}
+	defer FreePoint(*ephemeral)
+	shared, ok := ECDH(PrivateKeyBytes(key), *ephemeral)
+	if !ok {
+		return nil, false
+	}
+	aesKey, ok := eciesKey(sealed[:33], shared)
+	if !ok {
+		return nil, false
+	}
+	aead, ok := newGCM(aesKey)
+	if !ok {
+		return nil, false
+	}
+	plaintext, err := aead.Open(nil, sealed[33:45], sealed[45:], aad)
+	return plaintext, err == nil
+}
@@ -67,6 +67,13 @@ func FreeBn(bn Bignum) {
 	C.BN_free(bn)
 }
 
+// big-endian bytes of the bignum, left-padded with zeros to size
+func Bn2binPad(bn Bignum, size int) []byte {
+	bytes := make([]byte, size)
+	C.BN_bn2binpad(bn, (*C.uchar)(unsafe.Pointer(&bytes[0])), C.int(size))
+	return bytes
+}
+
 // the point should later be released with FreePoint
 func NewPoint(group Group) Point {
 	return C.EC_POINT_new(group)
@@ -135,6 +142,11 @@ func Verify(digest []byte, sig Sig, key Key) bool {
 	return C.ECDSA_do_verify((*C.uchar)(unsafe.Pointer(&digest[0])), C.int(len(digest)), sig, key) == 1
 }
 
+// the signature should later be released with FreeSig, it is nil on error
+func Sign(digest []byte, key Key) Sig {
+	return C.ECDSA_do_sign((*C.uchar)(unsafe.Pointer(&digest[0])), C.int(len(digest)), key)
+}
+
 func NewKey() Key {
 	return C.EC_KEY_new()
 }
@@ -150,3 +162,28 @@ func KeySetPublic(key Key, pubkey Point) {
 func KeySetGroup(key Key, group Group) {
 	C.EC_KEY_set_group(key, group)
 }
+
+// generates a random private key and its public key, the group should be set
+func KeyGenerate(key Key) bool {
+	return C.EC_KEY_generate_key(key) == 1
+}
+
+// the private key is copied
+func KeySetPrivate(key Key, private Bignum) bool {
+	return C.EC_KEY_set_private_key(key, private) == 1
+}
+
+// the result belongs to the key and should not be freed
+func KeyGetPrivate(key Key) Bignum {
+	return C.EC_KEY_get0_private_key(key)
+}
+
+// the result belongs to the key and should not be freed
+func KeyGetPublic(key Key) Point {
+	return C.EC_KEY_get0_public_key(key)
+}
+
+// checks that the public key is on the curve and matches the private key
+func KeyCheck(key Key) bool {
+	return C.EC_KEY_check_key(key) == 1
+}
@@ -40,8 +40,14 @@ var (
 	EC_KEY_set_public_key = libcrypto.NewProc("EC_KEY_set_public_key")
 	EC_KEY_set_group = libcrypto.NewProc("EC_KEY_set_group")
 	EC_KEY_can_sign = libcrypto.NewProc("EC_KEY_can_sign")
+	EC_KEY_generate_key = libcrypto.NewProc("EC_KEY_generate_key")
+	EC_KEY_set_private_key = libcrypto.NewProc("EC_KEY_set_private_key")
+	EC_KEY_get0_private_key = libcrypto.NewProc("EC_KEY_get0_private_key")
+	EC_KEY_get0_public_key = libcrypto.NewProc("EC_KEY_get0_public_key")
+	EC_KEY_check_key = libcrypto.NewProc("EC_KEY_check_key")
 	ECDSA_SIG_new = libcrypto.NewProc("ECDSA_SIG_new")
 	ECDSA_do_verify = libcrypto.NewProc("ECDSA_do_verify")
+	ECDSA_do_sign = libcrypto.NewProc("ECDSA_do_sign")
 	ECDSA_SIG_set0 = libcrypto.NewProc("ECDSA_SIG_set0")
 	ECDSA_SIG_get0 = libcrypto.NewProc("ECDSA_SIG_get0")
 	ECDSA_SIG_free = libcrypto.NewProc("ECDSA_SIG_free")
@@ -174,6 +180,13 @@ func FreeBn(bn Bignum) {
 	BN_free.Call(bn)
 }
 
+// big-endian bytes of the bignum, left-padded with zeros to size
+func Bn2binPad(bn Bignum, size int) []byte {
+	bytes := make([]byte, size)
+	BN_bn2binpad.Call(bn, uintptr(unsafe.Pointer(&bytes[0])), uintptr(size))
+	return bytes
+}
+
 // the point should later be released with FreePoint
 func NewPoint(group Group) Point {
 	ret, _, _ := EC_POINT_new.Call(group)
@@ -251,6 +264,12 @@ func Verify(digest []byte, sig Sig, key Key) bool {
 	return ret == 1
 }
 
+// the signature should later be released with FreeSig, it is 0 on error
+func Sign(digest []byte, key Key) Sig {
+	ret, _, _ := ECDSA_do_sign.Call(uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)), key)
+	return ret
+}
+
 func NewKey() Key {
 	ret, _, _ := EC_KEY_new.Call()
 	return ret
@@ -268,6 +287,36 @@ func KeySetGroup(key Key, group Group) {
 	EC_KEY_set_group.Call(key, group)
 }
 
+// generates a random private key and its public key, the group should be set
+func KeyGenerate(key Key) bool {
+	ret, _, _ := EC_KEY_generate_key.Call(key)
+	return ret == 1
+}
+
+// the private key is copied
+func KeySetPrivate(key Key, private Bignum) bool {
+	ret, _, _ := EC_KEY_set_private_key.Call(key, private)
+	return ret == 1
+}
+
+// the result belongs to the key and should not be freed
+func KeyGetPrivate(key Key) Bignum {
+	ret, _, _ := EC_KEY_get0_private_key.Call(key)
+	return ret
+}
+
+// the result belongs to the key and should not be freed
+func KeyGetPublic(key Key) Point {
+	ret, _, _ := EC_KEY_get0_public_key.Call(key)
+	return ret
+}
+
+// checks that the public key is on the curve and matches the private key
+func KeyCheck(key Key) bool {
+	ret, _, _ := EC_KEY_check_key.Call(key)
+	return ret == 1
+}
+
 func KeyCanSign(key Key) bool {
 	ret, _, _ := EC_KEY_can_sign.Call(key)
 	return ret != 0
@@ -66,6 +66,87 @@ func RunTests() {
 	} else {
 		fmt.Println("OK")
 	}
+
+	// the key of private key 1 is the generator, and its signatures should verify
+	private := make([]byte, 32)
+	private[31] = 1
+	signer, ok := KeyFromPrivate(private)
+	if !ok {
+		fmt.Println("Cannot load the private key")
+		return
+	}
+	fmt.Printf("pubkey of 1 = %s\n", hex.EncodeToString(MarshallCompressedPoint(PublicKey(signer))))
+	rBytes, sBytes, ok := SignHash(msg, signer)
+	signed := NewSig()
+	SigSet(signed, Bin2Bn(rBytes), Bin2Bn(sBytes))
+	if !ok || !VerifySig(msg, signed, PublicKey(signer)) {
+		fmt.Println("Wrong signature of private key 1")
+	} else {
+		fmt.Println("OK")
+	}
+	FreeSig(signed)
+	FreeKey(signer)
+
+	generated, ok := GenerateKey()
+	if !ok {
+		fmt.Println("Cannot generate a key")
+		return
+	}
+	loaded, ok := KeyFromPrivate(PrivateKeyBytes(generated))
+	if !ok || hex.EncodeToString(MarshallCompressedPoint(PublicKey(loaded))) != hex.EncodeToString(MarshallCompressedPoint(PublicKey(generated))) {
+		fmt.Println("Generated key does not round trip")
+	} else {
+		fmt.Println("OK")
+	}
+	FreeKey(loaded)
+	FreeKey(generated)
+
+	// ECIES vectors, computed independently with another secp256k1 implementation and the Go AES-GCM
+	recipient, _ := KeyFromPrivate(fromHex("e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35"))
+	vectors := []struct{ ephemeral, nonce, plaintext, aad, shared, sealed string }{
+		{
+			"4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318", "000102030405060708090a0b", "", "",
+			"036d41db804777dd2aec432b045a7fe1c78740357cc8376a620d8d819080219a2c",
+			"024e3b81af9c2234cad09d679ce6035ed1392347ce64ce405f5dcd36228a25de6e000102030405060708090a0b1c9e43656bbb874feefd732877e18da2",
+		},
+		{
+			"b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291", "0c0d0e0f1011121314151617", "68656c6c6f", "6b76",
+			"03c12094f58672136b50a1a252f151f1fe12e699454b8d8fef461ba2e355e2d218",
+			"03ca634cae0d49acb401d8a4c6b6fe8c55b70d115bf400769cc1400f3258cd31380c0d0e0f10111213141516178050854444c256261bdaf534594ba829ef80c945fd",
+		},
+	}
+	for i, v := range vectors {
+		shared, ok := ECDH(fromHex(v.ephemeral), PublicKey(recipient))
+		if !ok || hex.EncodeToString(shared) != v.shared {
+			fmt.Printf("Wrong ECDH of vector %d\n", i)
+			continue
+		}
+		sealed, ok := sealWith(fromHex(v.ephemeral), fromHex(v.nonce), PublicKey(recipient), fromHex(v.plaintext), fromHex(v.aad))
+		if !ok || hex.EncodeToString(sealed) != v.sealed {
+			fmt.Printf("Wrong ECIES of vector %d\n", i)
+			continue
+		}
+		opened, ok := Open(recipient, sealed, fromHex(v.aad))
+		if !ok || hex.EncodeToString(opened) != v.plaintext {
+			fmt.Printf("Cannot open vector %d\n", i)
+			continue
+		}
+		sealed[len(sealed)-1] ^= 1
+		if _, ok := Open(recipient, sealed, fromHex(v.aad)); ok {
+			fmt.Printf("Tampered vector %d opens\n", i)
+			continue
+		}
+		fmt.Println("OK")
+	}
+	sealed, ok := Seal(PublicKey(recipient), []byte("value"), []byte("key"))
+	if opened, opens := Open(recipient, sealed, []byte("key")); !ok || !opens || string(opened) != "value" {
+		fmt.Println("ECIES does not round trip")
+	} else if _, opens := Open(recipient, sealed, []byte("other key")); opens {
+		fmt.Println("ECIES opens with another aad")
+	} else {
+		fmt.Println("OK")
+	}
+	FreeKey(recipient)
 	/*
 	P, _  := new(big.Int).SetString("0xFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F", 0)
 	N, _  := new(big.Int).SetString("0xFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 0)
@@ -83,3 +164,8 @@ func RunTests() {
 	fmt.Printf("2 * G = (%s, %s)\n", x.Text(16), y.Text(16))
 	*/
 }
+
+func fromHex(s string) []byte {
+	bytes, _ := hex.DecodeString(s)
+	return bytes
+}
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/ndv/kv/bitcurve"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Client makes the signed requests of one namespace to a kv server over HTTP.
+// The client does no proof of work, so the servers requiring it reject its writes with pow_required.
+type Client struct {
+	url     string
+	http    *http.Client
+	key     bitcurve.Key
+	pubkey  []byte // compressed
+	encrypt bool
+	names   *nameCipher // nil unless the key names are encrypted
+}
+
+type Config struct {
+	URL         string // the server, like http://localhost:8546
+	PrivateKey  []byte // 32 bytes, big-endian
+	Encrypt     bool   // seal the values to the own pubkey, so that the server only stores ciphertexts
+	EncryptKeys bool   // with Encrypt, also encrypt the key names deterministically
+	HTTPClient  *http.Client
+}
+
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+type WrongPrivateKeyError struct{}
+
+func (e *WrongPrivateKeyError) Error() string {
+	return "The private key should be 32 bytes and less than the curve order"
+}
+
+type TooLongError struct{}
+
+func (e *TooLongError) Error() string {
+	return "Keys and values should be shorter than 65536 bytes, after the encryption if it is enabled"
+}
+
+type SigningError struct{}
+
+func (e *SigningError) Error() string {
+	return "Cannot sign the request"
+}
+
+// APIError is an error response of the server
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return strconv.Itoa(e.Status) + " " + e.Code + ": " + e.Message
+}
+
+// New creates the client of the namespace of the private key. It should be closed with Close
+func New(config Config) (*Client, error) {
+	if len(config.PrivateKey) != 32 {
+		return nil, &WrongPrivateKeyError{}
+	}
+	key, ok := bitcurve.KeyFromPrivate(config.PrivateKey)
+	if !ok {
+		return nil, &WrongPrivateKeyError{}
+	}
+	c := &Client{
+		url:     config.URL,
+		http:    config.HTTPClient,
+		key:     key,
+		pubkey:  bitcurve.MarshallCompressedPoint(bitcurve.PublicKey(key)),
+		encrypt: config.Encrypt,
+	}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	if config.Encrypt && config.EncryptKeys {
+		c.names = newNameCipher(config.PrivateKey)
+	}
+	return c, nil
+}
+
+func (c *Client) Close() {
+	bitcurve.FreeKey(c.key)
+}
+
+// Pubkey returns the compressed public key of the namespace
+func (c *Client) Pubkey() []byte {
+	return c.pubkey
+}
+
+func writeUint16(i int) []byte {
+	return binary.LittleEndian.AppendUint16(nil, uint16(i))
+}
+
+// header signs sha256 of the message: r, s and the compressed pubkey
+func (c *Client) header(message []byte) ([]byte, error) {
+	hash := sha256.Sum256(message)
+	r, s, ok := bitcurve.SignHash(hash[:], c.key)
+	if !ok {
+		return nil, &SigningError{}
+	}
+	return append(append(append([]byte{}, r...), s...), c.pubkey...), nil
+}
+
+// post sends the signed request and returns the body of a successful response
+func (c *Client) post(path string, query url.Values, message []byte, payload []byte) ([]byte, error) {
+	header, err := c.header(message)
+	if err != nil {
+		return nil, err
+	}
+	target := c.url + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(append(header, payload...)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var response struct {
+			Error *APIError `json:"error"`
+		}
+		if json.Unmarshal(body, &response) != nil || response.Error == nil {
+			response.Error = &APIError{Code: "unknown", Message: http.StatusText(resp.StatusCode)}
+		}
+		response.Error.Status = resp.StatusCode
+		return nil, response.Error
+	}
+	return body, nil
+}
+
+// Put writes the value of the key and returns its version
+func (c *Client) Put(key []byte, value []byte) (uint64, error) {
+	key, value, err := c.seal(key, value)
+	if err != nil {
+		return 0, err
+	}
+	if len(key) > 0xFFFF || len(value) > 0xFFFF {
+		return 0, &TooLongError{}
+	}
+	payload := append(append(writeUint16(len(key)), key...), writeUint16(len(value))...)
+	payload = append(payload, value...)
+	body, err := c.post("/put", nil, payload, payload)
+	if err != nil {
+		return 0, err
+	}
+	var response struct {
+		Receipt struct {
+			Version uint64 `json:"version"`
+		} `json:"receipt"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, err
+	}
+	return response.Receipt.Version, nil
+}
+
+// Get returns the value of the key, found is false if there is no such key
+func (c *Client) Get(key []byte) (value []byte, found bool, err error) {
+	storedKey := c.storedKey(key)
+	if len(storedKey) > 0xFFFF {
+		return nil, false, &TooLongError{}
+	}
+	payload := append(writeUint16(len(storedKey)), storedKey...)
+	body, err := c.post("/get", url.Values{"encoding": {"hex"}}, append([]byte("get"), payload...), payload)
+	if apiErr, ok := err.(*APIError); ok && apiErr.Status == http.StatusNotFound && apiErr.Code == "not_found" {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var entry jsonEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return nil, false, err
+	}
+	if value, err = hex.DecodeString(entry.Value); err != nil {
+		return nil, false, err
+	}
+	value, err = c.open(key, value)
+	return value, err == nil, err
+}
+
+type jsonEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// GetAll returns all the entries of the namespace. With the encrypted key names they are not in the key order
+func (c *Client) GetAll() ([]Entry, error) {
+	body, err := c.post("/getAll", url.Values{"encoding": {"hex"}}, []byte("getAll"), nil)
+	if err != nil {
+		return nil, err
+	}
+	var entries []jsonEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, err
+	}
+	result := make([]Entry, len(entries))
+	for i, entry := range entries {
+		key, err := hex.DecodeString(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := hex.DecodeString(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		if c.names != nil {
+			if key, err = c.names.decrypt(key); err != nil {
+				return nil, err
+			}
+		}
+		if value, err = c.open(key, value); err != nil {
+			return nil, err
+		}
+		result[i] = Entry{Key: key, Value: value}
+	}
+	return result, nil
+}
+
+// Clear deletes all the keys of the namespace
+func (c *Client) Clear() error {
+	_, err := c.post("/clear", nil, []byte("clear"), nil)
+	return err
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ndv/kv/bitcurve"
+)
+
+// In the encrypted mode the values are sealed with ECIES to the own pubkey of the namespace, with
+// "kv value" and the plain key name as the associated data, so that the server can neither read a value
+// nor move it to another key unnoticed.
+//
+// The encrypted key names are deterministic, so that a key can be read and overwritten by its name:
+// the 12-byte nonce is HMAC-SHA256 of the name, truncated, and the name is encrypted with AES-256-GCM
+// under this nonce. The HMAC and the AES keys are HKDF-SHA256 of the private key with the info
+// "kv key names", 64 bytes, the HMAC key first. The server still sees which writes hit the same key
+// and the lengths of the names.
+
+var valueInfo = []byte("kv value")
+
+type DecryptionError struct {
+	Key []byte
+}
+
+func (e *DecryptionError) Error() string {
+	return "Cannot decrypt the entry of the key " + hex.EncodeToString(e.Key)
+}
+
+type EncryptionError struct{}
+
+func (e *EncryptionError) Error() string {
+	return "Cannot encrypt the value"
+}
+
+type nameCipher struct {
+	mac  []byte
+	aead cipher.AEAD
+}
+
+func newNameCipher(private []byte) *nameCipher {
+	keys, err := hkdf.Key(sha256.New, private, nil, "kv key names", 64)
+	if err != nil {
+		panic(err) // only fails for too long keys
+	}
+	block, err := aes.NewCipher(keys[32:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &nameCipher{mac: keys[:32], aead: aead}
+}
+
+func (n *nameCipher) nonce(name []byte) []byte {
+	mac := hmac.New(sha256.New, n.mac)
+	mac.Write(name)
+	return mac.Sum(nil)[:12]
+}
+
+func (n *nameCipher) encrypt(name []byte) []byte {
+	nonce := n.nonce(name)
+	return n.aead.Seal(nonce, nonce, name, nil)
+}
+
+func (n *nameCipher) decrypt(encrypted []byte) ([]byte, error) {
+	if len(encrypted) < 12 {
+		return nil, &DecryptionError{encrypted}
+	}
+	name, err := n.aead.Open(nil, encrypted[:12], encrypted[12:], nil)
+	if err != nil || !bytes.Equal(n.nonce(name), encrypted[:12]) {
+		return nil, &DecryptionError{encrypted}
+	}
+	return name, nil
+}
+
+// storedKey is the key name as it is stored on the server
+func (c *Client) storedKey(key []byte) []byte {
+	if c.names == nil {
+		return key
+	}
+	return c.names.encrypt(key)
+}
+
+// seal returns the key and the value as they are stored on the server
+func (c *Client) seal(key []byte, value []byte) ([]byte, []byte, error) {
+	if !c.encrypt {
+		return key, value, nil
+	}
+	sealed, ok := bitcurve.Seal(bitcurve.PublicKey(c.key), value, append(append([]byte{}, valueInfo...), key...))
+	if !ok {
+		return nil, nil, &EncryptionError{}
+	}
+	return c.storedKey(key), sealed, nil
+}
+
+// open decrypts the value stored on the server for the plain key name
+func (c *Client) open(key []byte, value []byte) ([]byte, error) {
+	if !c.encrypt {
+		return value, nil
+	}
+	opened, ok := bitcurve.Open(c.key, value, append(append([]byte{}, valueInfo...), key...))
+	if !ok {
+		return nil, &DecryptionError{key}
+	}
+	return opened, nil
+}
@@ -0,0 +1,4 @@
+// Package kvpb contains the gRPC API of the server, generated from kv.proto
+package kvpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kv.proto
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditLogHead is the size and the Merkle root of the audit log, signed by the server
+type AuditLogHead struct {
+	Size uint64
+	Hash []byte // the root
+	Time time.Time
+	R, S []byte
+}
+
+// message is the signed form of the head: "audit", uint64 size, hash, uint64 unix time in nanoseconds,
+// the integers little-endian
+func (h *AuditLogHead) message() []byte {
+	message := binary.LittleEndian.AppendUint64([]byte("audit"), h.Size)
+	message = append(message, h.Hash...)
+	return binary.LittleEndian.AppendUint64(message, uint64(h.Time.UnixNano()))
+}
+
+type auditHeadJSON struct {
+	Size         uint64 `json:"size"`
+	Hash         string `json:"hash"`
+	Timestamp    int64  `json:"timestamp"` // unix time in nanoseconds
+	ServerPubkey string `json:"server_pubkey"`
+	R            string `json:"r"`
+	S            string `json:"s"`
+}
+
+type auditEntryJSON struct {
+	Index       uint64 `json:"index"`
+	Timestamp   int64  `json:"timestamp"` // unix time in nanoseconds
+	Op          string `json:"op"`
+	Pubkey      string `json:"pubkey"`
+	RequestHash string `json:"request_hash"`
+	Hash        string `json:"hash"` // the leaf hash
+}
+
+type auditEntriesResponse struct {
+	Entries []auditEntryJSON `json:"entries"`
+	Next    uint64           `json:"next"`
+	More    bool             `json:"more"`
+}
+
+type auditConsistencyResponse struct {
+	First      uint64   `json:"first"`
+	Second     uint64   `json:"second"`
+	FirstHash  string   `json:"first_hash"`
+	SecondHash string   `json:"second_hash"`
+	Proof      []string `json:"proof"` // the RFC 6962 consistency proof
+}
+
+// auditEnabled rejects the requests with 404 if the audit log is disabled, and returns its size otherwise
+func auditEnabled(w http.ResponseWriter, req *http.Request) (size uint64, hash []byte, ok bool) {
+	size, hash, ok = db.AuditHead()
+	if !ok {
+		writeError(w, req, NewAPIError(http.StatusNotFound, ErrNotFound, "The audit log is not enabled on this server"))
+	}
+	return size, hash, ok
+}
+
+func parseUintParam(w http.ResponseWriter, req *http.Request, name string, def uint64) (uint64, bool) {
+	s := req.URL.Query().Get(name)
+	if s == "" {
+		return def, true
+	}
+	value, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong "+name+" value").WithDetail(name, s))
+		return 0, false
+	}
+	return value, true
+}
+
+// handleAuditHead returns the size and the Merkle root of the audit log signed by the server
+func handleAuditHead(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+	size, hash, ok := auditEnabled(w, req)
+	if !ok {
+		return
+	}
+	head := &AuditLogHead{Size: size, Hash: hash, Time: time.Now()}
+	var err error
+	if head.R, head.S, err = identity.Sign(head.message()); err != nil {
+		writeError(w, req, NewAPIError(http.StatusInternalServerError, ErrInternal, err.Error()).
+			WithDetail("stage", "signing the head"))
+		return
+	}
+	writeJSON(w, http.StatusOK, auditHeadJSON{
+		Size:         head.Size,
+		Hash:         hex.EncodeToString(head.Hash),
+		Timestamp:    head.Time.UnixNano(),
+		ServerPubkey: hex.EncodeToString(identity.Pubkey),
+		R:            hex.EncodeToString(head.R),
+		S:            hex.EncodeToString(head.S),
+	})
+}
+
+// handleAudit returns the audit log entries from ?start=, up to ?limit=, only those of ?pubkey= (hex) if given
+func handleAudit(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+	if _, _, ok := auditEnabled(w, req); !ok {
+		return
+	}
+	start, ok := parseUintParam(w, req, "start", 0)
+	if !ok {
+		return
+	}
+	limit, ok := parseUintParam(w, req, "limit", defaultAuditLimit)
+	if !ok {
+		return
+	}
+	if limit == 0 || limit > maxAuditLimit {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong limit value").
+			WithDetail("limit", limit).WithDetail("max", maxAuditLimit))
+		return
+	}
+	var pubkey []byte
+	if s := req.URL.Query().Get("pubkey"); s != "" {
+		var err error
+		if pubkey, err = hex.DecodeString(s); err != nil || len(pubkey) != 33 {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "The pubkey should be 33 bytes in hex").
+				WithDetail("pubkey", s))
+			return
+		}
+	}
+
+	entries, next, more, err := db.AuditEntries(start, int(limit), pubkey)
+	if databaseError(err, w, req, "reading the audit log") {
+		return
+	}
+	response := auditEntriesResponse{Entries: make([]auditEntryJSON, len(entries)), Next: next, More: more}
+	for i, entry := range entries {
+		response.Entries[i] = auditEntryJSON{
+			Index:       entry.Index,
+			Timestamp:   entry.Time.UnixNano(),
+			Op:          entry.Op,
+			Pubkey:      hex.EncodeToString(entry.Pubkey),
+			RequestHash: hex.EncodeToString(entry.RequestHash),
+			Hash:        hex.EncodeToString(entry.Hash),
+		}
+	}
+	requestLogger(req).Info("Audit log", "start", start, "count", len(entries))
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleAuditConsistency proves that the audit log of size ?second= (the current size by default)
+// extends the log of size ?first=
+func handleAuditConsistency(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+	size, _, ok := auditEnabled(w, req)
+	if !ok {
+		return
+	}
+	first, ok := parseUintParam(w, req, "first", 0)
+	if !ok {
+		return
+	}
+	second, ok := parseUintParam(w, req, "second", size)
+	if !ok {
+		return
+	}
+	if first > second || second > size {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong range").
+			WithDetail("first", first).WithDetail("second", second).WithDetail("size", size))
+		return
+	}
+
+	firstHash, secondHash, proof, err := db.AuditConsistency(first, second)
+	if databaseError(err, w, req, "reading the audit log") {
+		return
+	}
+	response := auditConsistencyResponse{
+		First:      first,
+		Second:     second,
+		FirstHash:  hex.EncodeToString(firstHash),
+		SecondHash: hex.EncodeToString(secondHash),
+		Proof:      make([]string, len(proof)),
+	}
+	for i, hash := range proof {
+		response.Proof[i] = hex.EncodeToString(hash)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
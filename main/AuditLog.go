@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"strconv"
+	"time"
+)
+
+// The audit log keyspace: 'l' + uint64 big endian index holds the entry. 'a' + pubkey + uint64 big endian index
+// is empty, it indexes the entries by pubkey. 'n' + uint8 level + uint64 big endian position holds the root of
+// the complete subtree of the entries from position << level to (position + 1) << level, the leaf hashes at level 0.
+//
+// An entry is uint64 index, uint64 unix time in nanoseconds, uint8 operation size, operation, compressed pubkey
+// and the request hash, sha256 of r, s, the compressed pubkey and the signed message, the integers little-endian
+// like in the requests. Only the hash is kept, so that the log can be public without giving away the values
+// and the signatures of the requests. The entries are the leaves of an RFC 6962 Merkle tree, the leaf hash
+// being sha256(0x00, entry) and the hash of an inner node sha256(0x01, left, right).
+const (
+	auditLogPrefix    = 'l'
+	auditPubkeyPrefix = 'a'
+	auditNodePrefix   = 'n'
+)
+
+// The operations of the audit log entries
+const (
+	OpPut     = "put"
+	OpBatch   = "batch"
+	OpClear   = "clear"
+	OpRestore = "restore"
+)
+
+// SignedRequest is an accepted request as its signature was verified
+type SignedRequest struct {
+	Op      string
+	Header  []byte // r, s and the compressed pubkey
+	Message []byte
+}
+
+// signed returns the request to add to the audit log for the verified message
+func (ctx *CryptoContext) signed(op string, message []byte) *SignedRequest {
+	return &SignedRequest{Op: op, Header: ctx.header, Message: message}
+}
+
+type AuditEntry struct {
+	Index       uint64
+	Time        time.Time
+	Op          string
+	Pubkey      []byte
+	RequestHash []byte // sha256 of r, s, the pubkey and the signed message
+	Hash        []byte // the leaf hash
+}
+
+type CorruptedAuditEntryError struct {
+	index uint64
+}
+
+func (e *CorruptedAuditEntryError) Error() string {
+	return "Corrupted audit log entry " + strconv.FormatUint(e.index, 10)
+}
+
+func auditLogKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{auditLogPrefix}, index)
+}
+
+func auditPubkeyKey(pubkey []byte, index uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{auditPubkeyPrefix}, pubkey...), index)
+}
+
+func auditNodeKey(level int, position uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{auditNodePrefix, byte(level)}, position)
+}
+
+func encodeAuditEntry(index uint64, now time.Time, signed *SignedRequest) []byte {
+	h := sha256.New()
+	h.Write(signed.Header)
+	h.Write(signed.Message)
+	entry := binary.LittleEndian.AppendUint64(nil, index)
+	entry = binary.LittleEndian.AppendUint64(entry, uint64(now.UnixNano()))
+	entry = append(append(entry, byte(len(signed.Op))), signed.Op...)
+	entry = append(entry, signed.Header[64:]...)
+	return h.Sum(entry)
+}
+
+func decodeAuditEntry(index uint64, entry []byte) (*AuditEntry, error) {
+	if len(entry) < 8+8+1 {
+		return nil, &CorruptedAuditEntryError{index}
+	}
+	opSize := int(entry[16])
+	if len(entry) != 17+opSize+33+32 || binary.LittleEndian.Uint64(entry) != index {
+		return nil, &CorruptedAuditEntryError{index}
+	}
+	rest := entry[17+opSize:]
+	return &AuditEntry{
+		Index:       index,
+		Time:        time.Unix(0, int64(binary.LittleEndian.Uint64(entry[8:]))),
+		Op:          string(entry[17 : 17+opSize]),
+		Pubkey:      append([]byte{}, rest[:33]...),
+		RequestHash: append([]byte{}, rest[33:]...),
+		Hash:        auditLeafHash(entry),
+	}, nil
+}
+
+func auditLeafHash(entry []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(entry)
+	return h.Sum(nil)
+}
+
+// auditTree reads the complete subtrees making the entries from start to end, the largest first
+func auditTree(reader leveldb.Reader, start uint64, end uint64) (*rootBuilder, error) {
+	return storedTree(reader, auditNodeKey, start, end)
+}
+
+// auditHead is the size of the log and the roots of its complete subtrees
+type auditHead struct {
+	tree *rootBuilder
+}
+
+// EnableAuditLog turns on the audit log, continuing the chain already in the database
+func (db *Database) EnableAuditLog() error {
+	db.replication.lock.Lock()
+	defer db.replication.lock.Unlock()
+	return db.loadAuditHead()
+}
+
+// loadAuditHead reads the head of the audit log from the database, the caller holds the replication lock
+func (db *Database) loadAuditHead() error {
+	var size uint64
+	iterator := db.db.NewIterator(util.BytesPrefix([]byte{auditLogPrefix}), nil)
+	if iterator.Last() {
+		size = binary.BigEndian.Uint64(iterator.Key()[1:]) + 1
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+	tree, err := auditTree(db.db, 0, size)
+	if err != nil {
+		return err
+	}
+	db.audit.Store(&auditHead{tree: tree})
+	return nil
+}
+
+// appendAuditLog adds the entry of the request made at now and the subtrees it completes to the batch and returns
+// the head after it, nil if there is no entry to add. The caller holds the replication lock and sets db.audit
+// to the new head once the batch is written.
+func (db *Database) appendAuditLog(batch *leveldb.Batch, signed *SignedRequest, now time.Time) *auditHead {
+	head := db.audit.Load()
+	if head == nil || signed == nil {
+		return nil
+	}
+	index := head.tree.size
+	entry := encodeAuditEntry(index, now, signed)
+	batch.Put(auditLogKey(index), entry)
+	batch.Put(auditPubkeyKey(signed.Header[64:], index), nil)
+	tree := head.tree.clone()
+	for level, hash := range tree.add(auditLeafHash(entry)) {
+		batch.Put(auditNodeKey(level, index>>level), hash)
+	}
+	return &auditHead{tree: tree}
+}
+
+// AuditHead returns the size of the audit log and its Merkle root, ok is false if the log is disabled
+func (db *Database) AuditHead() (size uint64, root []byte, ok bool) {
+	head := db.audit.Load()
+	if head == nil {
+		return 0, nil, false
+	}
+	return head.tree.size, head.tree.root(), true
+}
+
+// AuditEntries returns up to limit entries starting from the index start, only those of the pubkey if it is not nil.
+// next is the index to continue from.
+func (db *Database) AuditEntries(start uint64, limit int, pubkey []byte) (entries []*AuditEntry, next uint64, more bool, err error) {
+	snapshot, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, start, false, err
+	}
+	defer snapshot.Release()
+
+	prefix := []byte{auditLogPrefix}
+	if pubkey != nil {
+		prefix = append([]byte{auditPubkeyPrefix}, pubkey...)
+	}
+	iterator := snapshot.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iterator.Release()
+	next = start
+	for ok := iterator.Seek(binary.BigEndian.AppendUint64(append([]byte{}, prefix...), start)); ok; ok = iterator.Next() {
+		if len(entries) >= limit {
+			return entries, next, true, nil
+		}
+		index := binary.BigEndian.Uint64(iterator.Key()[len(prefix):])
+		value := iterator.Value()
+		if pubkey != nil {
+			if value, err = snapshot.Get(auditLogKey(index), nil); err != nil {
+				return nil, start, false, err
+			}
+		}
+		entry, err := decodeAuditEntry(index, value)
+		if err != nil {
+			return nil, start, false, err
+		}
+		entries = append(entries, entry)
+		next = index + 1
+	}
+	return entries, next, false, iterator.Error()
+}
+
+// AuditConsistency returns the roots of the log at the sizes first and second and the RFC 6962 proof
+// that the log of size second extends the log of size first
+func (db *Database) AuditConsistency(first uint64, second uint64) (firstRoot []byte, secondRoot []byte, proof [][]byte, err error) {
+	snapshot, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer snapshot.Release()
+
+	subtree := func(start uint64, end uint64) ([]byte, error) {
+		tree, err := auditTree(snapshot, start, end)
+		if err != nil {
+			return nil, err
+		}
+		return tree.root(), nil
+	}
+	if firstRoot, err = subtree(0, first); err != nil {
+		return nil, nil, nil, err
+	}
+	if secondRoot, err = subtree(0, second); err != nil {
+		return nil, nil, nil, err
+	}
+	proof, err = consistencyProof(first, second, subtree)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return firstRoot, secondRoot, proof, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// verifyConsistency checks the consistency proof between the roots as in RFC 9162, section 2.1.4.2
+func verifyConsistency(first uint64, second uint64, firstRoot []byte, secondRoot []byte, proof [][]byte) bool {
+	if first == second || first == 0 {
+		return len(proof) == 0 && (first == 0 || bytes.Equal(firstRoot, secondRoot))
+	}
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return false
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn, sn = fn>>1, sn>>1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr, sr = nodeHash(c, fr), nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn, sn = fn>>1, sn>>1
+	}
+	return bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot) && sn == 0
+}
+
+func getJSON(t *testing.T, url string, response interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: status %d", url, resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("wrong hex %q", s)
+	}
+	return data
+}
+
+func TestAuditLog(t *testing.T) {
+	server := newTestServer(t, func(config *Config) { config.Audit.Enabled = true })
+	key := newTestKey(t, 1)
+	var bodies [][]byte
+	const count = 21
+	for i := 0; i < count; i++ {
+		body := key.putRequest(t, fmt.Sprint(i), "value")
+		if status, response := post(t, server.URL+"/put", body, nil); status != http.StatusOK {
+			t.Fatalf("put: %d %s", status, response)
+		}
+		bodies = append(bodies, body)
+	}
+
+	admin := newAdminServer(t, server)
+	var entries auditEntriesResponse
+	getJSON(t, admin.URL+"/audit?limit=1000", &entries)
+	if len(entries.Entries) != count {
+		t.Fatalf("%d entries, expected %d", len(entries.Entries), count)
+	}
+	var leaves [][]byte
+	for i, entry := range entries.Entries {
+		// the body of a put is the header followed by the signed message
+		hash := sha256.Sum256(bodies[i])
+		if entry.Op != OpPut || entry.Pubkey != hex.EncodeToString(key.pubkey) || entry.RequestHash != hex.EncodeToString(hash[:]) {
+			t.Errorf("wrong entry %+v", entry)
+		}
+		leaves = append(leaves, decodeHex(t, entry.Hash))
+	}
+	var head auditHeadJSON
+	getJSON(t, admin.URL+"/audit/head", &head)
+	if head.Size != count || head.Hash != hex.EncodeToString(merkleRoot(leaves)) {
+		t.Errorf("wrong head %+v", head)
+	}
+
+	for first := uint64(0); first <= count; first++ {
+		for second := first; second <= count; second++ {
+			var response auditConsistencyResponse
+			getJSON(t, fmt.Sprintf("%s/audit/consistency?first=%d&second=%d", admin.URL, first, second), &response)
+			firstRoot, secondRoot := decodeHex(t, response.FirstHash), decodeHex(t, response.SecondHash)
+			if !bytes.Equal(firstRoot, merkleRoot(leaves[:first])) || !bytes.Equal(secondRoot, merkleRoot(leaves[:second])) {
+				t.Fatalf("wrong roots from %d to %d", first, second)
+			}
+			proof := make([][]byte, len(response.Proof))
+			for i, hash := range response.Proof {
+				proof[i] = decodeHex(t, hash)
+			}
+			if !verifyConsistency(first, second, firstRoot, secondRoot, proof) {
+				t.Errorf("wrong proof from %d to %d", first, second)
+			}
+			other := append([][]byte{}, leaves[:second]...)
+			if second > 0 {
+				other[second-1] = leaves[0]
+			}
+			if 0 < first && first < second && verifyConsistency(first, second, firstRoot, merkleRoot(other), proof) {
+				t.Errorf("the proof from %d to %d holds for a changed log", first, second)
+			}
+		}
+	}
+
+	// the head survives a restart
+	db.audit.Store(nil)
+	if err := db.EnableAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	size, root, _ := db.AuditHead()
+	if size != count || !bytes.Equal(root, merkleRoot(leaves)) {
+		t.Errorf("wrong head after loading: %d", size)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// CBOR (RFC 8949) major types used by the responses
+const (
+	cborUint       = 0 << 5
+	cborBytes      = 2 << 5
+	cborText       = 3 << 5
+	cborArray      = 4 << 5
+	cborMap        = 5 << 5
+	cborIndefinite = 31
+	cborBreak      = 0xFF
+)
+
+func writeCBORHead(w *bufio.Writer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		w.WriteByte(major | byte(n))
+	case n <= 0xFF:
+		w.Write([]byte{major | 24, byte(n)})
+	case n <= 0xFFFF:
+		w.Write([]byte{major | 25, byte(n >> 8), byte(n)})
+	case n <= 0xFFFFFFFF:
+		w.Write([]byte{major | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	default:
+		w.WriteByte(major | 27)
+		for shift := 56; shift >= 0; shift -= 8 {
+			w.WriteByte(byte(n >> shift))
+		}
+	}
+}
+
+func writeCBORText(w *bufio.Writer, s string) {
+	writeCBORHead(w, cborText, uint64(len(s)))
+	w.WriteString(s)
+}
+
+func writeCBORBytes(w *bufio.Writer, b []byte) {
+	writeCBORHead(w, cborBytes, uint64(len(b)))
+	w.Write(b)
+}
+
+// cborEntryWriter streams an indefinite-length array of maps {"key": bytes, "value": bytes, "size": uint}
+type cborEntryWriter struct {
+	w *bufio.Writer
+}
+
+func newCBOREntryWriter(w io.Writer) *cborEntryWriter {
+	return &cborEntryWriter{w: bufio.NewWriter(w)}
+}
+
+func (c *cborEntryWriter) begin() error {
+	return c.w.WriteByte(cborArray | cborIndefinite)
+}
+
+func (c *cborEntryWriter) entry(key []byte, value []byte) error {
+	writeCBORHead(c.w, cborMap, 3)
+	writeCBORText(c.w, "key")
+	writeCBORBytes(c.w, key)
+	writeCBORText(c.w, "value")
+	writeCBORBytes(c.w, value)
+	writeCBORText(c.w, "size")
+	writeCBORHead(c.w, cborUint, uint64(len(value)))
+	return nil
+}
+
+func (c *cborEntryWriter) end() error {
+	c.w.WriteByte(cborBreak)
+	return c.w.Flush()
+}
+
+// fail can't signal anything inside the array, so the array is left unterminated
+func (c *cborEntryWriter) fail(err *APIError) error {
+	return c.w.Flush()
+}
+
+// writeCBORError writes the error model as {"error": {"code": text, "message": text}}
+func writeCBORError(w io.Writer, err *APIError) error {
+	b := bufio.NewWriter(w)
+	writeCBORHead(b, cborMap, 1)
+	writeCBORText(b, "error")
+	writeCBORHead(b, cborMap, 2)
+	writeCBORText(b, "code")
+	writeCBORText(b, err.Code)
+	writeCBORText(b, "message")
+	writeCBORText(b, err.Message)
+	return b.Flush()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+	EventClear  = "clear"
+)
+
+// ChangeEvent is one mutation of a namespace. Clear events have no key.
+type ChangeEvent struct {
+	Seq    uint64 // the sequence number of the change log of the pubkey
+	Type   string
+	Key    []byte
+	Value  []byte
+	pubkey string // the compressed pubkey bytes
+}
+
+// ChangeFeed keeps the recent mutations in memory and wakes up the watchers when new ones arrive.
+// The events keep the sequence numbers of the change logs, the change log has the ones no longer kept here.
+type ChangeFeed struct {
+	lock    sync.Mutex
+	events  []ChangeEvent // ring buffer of the last events
+	start   int           // index of the oldest event in the ring buffer
+	count   int
+	changed chan struct{} // closed and replaced on every publish
+}
+
+func NewChangeFeed(capacity int) *ChangeFeed {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &ChangeFeed{
+		events:  make([]ChangeEvent, capacity),
+		changed: make(chan struct{}),
+	}
+}
+
+// publish adds the events of one pubkey, numbered by its change log, and wakes up the watchers.
+// The caller holds the replication lock of the database while it writes the batch of the events,
+// so the events are published in the commit order.
+func (f *ChangeFeed) publish(pubkey []byte, events ...ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, event := range events {
+		event.pubkey = string(pubkey)
+		if f.count < len(f.events) {
+			f.events[(f.start+f.count)%len(f.events)] = event
+			f.count++
+		} else {
+			f.events[f.start] = event
+			f.start = (f.start + 1) % len(f.events)
+		}
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Since returns the events of the pubkey after the sequence number, filtered by the key prefix,
+// the sequence number to continue from and a channel closed on the next publish. last is the last
+// sequence number of the pubkey in the database, ok is false if the event after since is not kept anymore,
+// or not published yet, while the database has it: the events are then read from the change log.
+func (f *ChangeFeed) Since(pubkey []byte, since uint64, last uint64, prefix []byte) (events []ChangeEvent, next uint64, changed <-chan struct{}, ok bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	next, ok = since, last <= since
+	for i := 0; i < f.count; i++ {
+		event := f.events[(f.start+i)%len(f.events)]
+		if event.Seq <= since || event.pubkey != string(pubkey) {
+			continue
+		}
+		ok = ok || event.Seq == since+1
+		next = max(next, event.Seq)
+		if event.Type != EventClear && !bytes.HasPrefix(event.Key, prefix) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, next, f.changed, ok
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/ndv/kv/bitcurve"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"log/slog"
+	"time"
+)
+
+// The change log keyspaces, outside of the data keys which start with 2 or 3:
+// 's' + pubkey holds the last sequence number of the pubkey as uint64 big endian,
+// 'c' + pubkey + uint64 big endian sequence number holds a log entry:
+// uint64 big endian unix time in nanoseconds, the entry type and the key.
+const (
+	seqPrefix       = 's'
+	changeLogPrefix = 'c'
+)
+
+// the entry types stored in the log
+var changeTypes = map[string]byte{EventPut: 'p', EventDelete: 'd', EventClear: 'x'}
+
+func seqKey(pubkey []byte) []byte {
+	return append([]byte{seqPrefix}, pubkey...)
+}
+
+func changeLogKey(pubkey []byte, seq uint64) []byte {
+	key := append([]byte{changeLogPrefix}, pubkey...)
+	return binary.BigEndian.AppendUint64(key, seq)
+}
+
+func encodeChange(event ChangeEvent, now time.Time) []byte {
+	value := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	value = append(value, changeTypes[event.Type])
+	return append(value, event.Key...)
+}
+
+func decodeChange(value []byte) (event ChangeEvent, timestamp time.Time, err error) {
+	if len(value) < 9 {
+		return event, timestamp, &CorruptedChangeError{}
+	}
+	timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+	for name, code := range changeTypes {
+		if code == value[8] {
+			event.Type = name
+		}
+	}
+	if event.Type == "" {
+		return event, timestamp, &CorruptedChangeError{}
+	}
+	event.Key = value[9:]
+	return event, timestamp, nil
+}
+
+type CorruptedChangeError struct{}
+
+func (e *CorruptedChangeError) Error() string {
+	return "Corrupted change log entry"
+}
+
+type ChangesCompactedError struct {
+	Oldest uint64 // the first sequence number still in the log
+}
+
+func (e *ChangesCompactedError) Error() string {
+	return fmt.Sprintf("The changes before %d are not kept anymore", e.Oldest)
+}
+
+// lastSeq returns the last sequence number of the pubkey, 0 if it has made no changes
+func lastSeq(reader leveldb.Reader, pubkey []byte) (uint64, error) {
+	value, err := reader.Get(seqKey(pubkey), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// LastSeq returns the last sequence number of the pubkey, 0 if it has made no changes
+func (db *Database) LastSeq(pubkey []byte) (uint64, error) {
+	return lastSeq(db.db, pubkey)
+}
+
+// logChanges assigns the sequence numbers to the events and adds them to the change log in the batch.
+// It returns the sequence number of the first event. The caller holds the write lock of the pubkey.
+func (db *Database) logChanges(batch *leveldb.Batch, pubkey []byte, events []ChangeEvent) (uint64, error) {
+	seq, err := lastSeq(db.db, pubkey)
+	if err != nil {
+		return 0, err
+	}
+	first := seq + 1
+	now := time.Now()
+	for _, event := range events {
+		seq++
+		batch.Put(changeLogKey(pubkey, seq), encodeChange(event, now))
+	}
+	batch.Put(seqKey(pubkey), binary.BigEndian.AppendUint64(nil, seq))
+	return first, nil
+}
+
+// Changes returns up to limit changes of the pubkey after the sequence number, read from one snapshot.
+// A key changed several times is returned once, at its last change, with the current value;
+// a clear drops the changes before it. next is the sequence number to continue from,
+// more tells if there are changes after it.
+// It returns ChangesCompactedError if some of the changes after since are not kept anymore.
+func (db *Database) Changes(pubkey bitcurve.Point, since uint64, limit int) (events []ChangeEvent, next uint64, more bool, err error) {
+	prefix := bitcurve.MarshallCompressedPoint(pubkey)
+	snapshot, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, since, false, err
+	}
+	defer snapshot.Release()
+
+	last, err := lastSeq(snapshot, prefix)
+	if err != nil {
+		return nil, since, false, err
+	}
+	iterator := snapshot.NewIterator(&util.Range{
+		Start: changeLogKey(prefix, since+1),
+		Limit: util.BytesPrefix(append([]byte{changeLogPrefix}, prefix...)).Limit,
+	}, nil)
+	defer iterator.Release()
+
+	// the entries are consecutive, so a gap at the start means they were compacted
+	first := last + 1
+	if iterator.First() {
+		first = binary.BigEndian.Uint64(iterator.Key()[1+33:])
+	}
+	if since < last && first > since+1 {
+		return nil, since, false, &ChangesCompactedError{Oldest: first}
+	}
+
+	next = since
+	latest := make(map[string]int) // the index of the last change of each key in events
+	count := 0
+	for ok := first <= last; ok; ok = iterator.Next() {
+		if count == limit {
+			more = true
+			break
+		}
+		count++
+		event, _, err := decodeChange(iterator.Value())
+		if err != nil {
+			return nil, since, false, err
+		}
+		event.Seq = binary.BigEndian.Uint64(iterator.Key()[1+33:])
+		event.Key = append([]byte{}, event.Key...)
+		next = event.Seq
+		if event.Type == EventClear {
+			events = append(events[:0], event)
+			latest = make(map[string]int)
+			continue
+		}
+		if i, found := latest[string(event.Key)]; found {
+			events[i].Type = "" // superseded
+		}
+		latest[string(event.Key)] = len(events)
+		events = append(events, event)
+	}
+	if err = iterator.Error(); err != nil {
+		return nil, since, false, err
+	}
+
+	result := events[:0]
+	for _, event := range events {
+		switch event.Type {
+		case "":
+			continue
+		case EventPut:
+			event.Value, err = snapshot.Get(append(append([]byte{}, prefix...), event.Key...), nil)
+			if err == leveldb.ErrNotFound {
+				// deleted by a later change, which is past the limit
+				event.Type, event.Value, err = EventDelete, nil, nil
+			}
+			if err != nil {
+				return nil, since, false, err
+			}
+		}
+		result = append(result, event)
+	}
+	return result, next, more, nil
+}
+
+// CompactChangeLog removes the log entries older than the retention,
+// and the ones more than maxEntries behind the last entry of their pubkey
+func (db *Database) CompactChangeLog(retention time.Duration, maxEntries int) (removed int, err error) {
+	iterator := db.db.NewIterator(util.BytesPrefix([]byte{changeLogPrefix}), nil)
+	defer iterator.Release()
+
+	cutoff := time.Now().Add(-retention)
+	for iterator.Next() {
+		key := iterator.Key()
+		if len(key) != 1+33+8 {
+			continue
+		}
+		n, err := db.compactPubkeyChangeLog(append([]byte{}, key[1:1+33]...), cutoff, retention, maxEntries)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+		// go to the next pubkey
+		iterator.Seek(util.BytesPrefix(key[:1+33]).Limit)
+		iterator.Prev()
+	}
+	return removed, iterator.Error()
+}
+
+// compactPubkeyChangeLog compacts the log of one pubkey under its write lock, so that the last sequence number
+// does not change while the entries are chosen
+func (db *Database) compactPubkeyChangeLog(pubkey []byte, cutoff time.Time, retention time.Duration, maxEntries int) (removed int, err error) {
+	defer db.lockPubkey(pubkey)()
+	last, err := lastSeq(db.db, pubkey)
+	if err != nil {
+		return 0, err
+	}
+	iterator := db.db.NewIterator(util.BytesPrefix(append([]byte{changeLogPrefix}, pubkey...)), nil)
+	defer iterator.Release()
+
+	batch := new(leveldb.Batch)
+	for iterator.Next() {
+		key := iterator.Key()
+		if len(key) != 1+33+8 {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(key[1+33:])
+		_, timestamp, err := decodeChange(iterator.Value())
+		expired := err == nil && retention > 0 && timestamp.Before(cutoff)
+		tooMany := maxEntries > 0 && seq+uint64(maxEntries) <= last
+		if !expired && !tooMany {
+			break // the entries after this one are newer
+		}
+		batch.Delete(append([]byte{}, key...))
+		removed++
+		if batch.Len() >= 1000 {
+			if err := db.write(batch, nil, nil); err != nil {
+				return removed, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iterator.Error(); err != nil || batch.Len() == 0 {
+		return removed, err
+	}
+	return removed, db.write(batch, nil, nil)
+}
+
+// compactChangeLogEvery runs CompactChangeLog periodically until the database is closed
+func (db *Database) compactChangeLogEvery(config ChangeLogConfig) {
+	ticker := time.NewTicker(config.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.quit:
+			return
+		case <-ticker.C:
+		}
+		if !db.leading() {
+			continue // the leader of the cluster or of the replication does it for all the nodes
+		}
+		start := time.Now()
+		removed, err := db.CompactChangeLog(config.Retention, config.MaxEntries)
+		if err != nil {
+			slog.Error("Change log compaction failed", "removed", removed, "error", err)
+			continue
+		}
+		slog.Info("Change log compacted", "removed", removed, "duration", time.Since(start).String())
+	}
+}
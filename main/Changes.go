@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 10000
+)
+
+type changesResponse struct {
+	Events []watchEvent `json:"events"`
+	Next   uint64       `json:"next"` // the since value for the next request
+	More   bool         `json:"more"` // true if there are more changes after next
+}
+
+// handleChanges returns the changes of the namespace after ?since=, for the incremental sync.
+// The sequence numbers are per pubkey and start from 1, so since=0 returns all the changes while none of them
+// has been compacted, and 410 with the oldest sequence number still in the log afterwards, like any older since.
+func handleChanges(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
+	body := bufio.NewReader(req.Body)
+
+	ctx, err := readRequestHeader(body)
+	if httpError(err, w, req, "reading the header") {
+		return
+	}
+
+	query := req.URL.Query()
+	var since uint64
+	if s := query.Get("since"); s != "" {
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong since value").WithDetail("since", s))
+			return
+		}
+	}
+	limit := defaultChangesLimit
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxChangesLimit {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong limit value").
+				WithDetail("limit", s).WithDetail("max", maxChangesLimit))
+			return
+		}
+	}
+	encoding := query.Get("encoding")
+	if encoding == "" {
+		encoding = EncodingHex
+	}
+	if !validEncoding(encoding) {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Unknown encoding").
+			WithDetail("encoding", encoding))
+		return
+	}
+
+	if !ctx.checkSignature([]byte("changes"), w, req) || !ctx.checkPubkeyRateLimit(w, req) {
+		return
+	}
+
+	events, next, more, err := db.Changes(ctx.pubkey, since, limit)
+	var compacted *ChangesCompactedError
+	if errors.As(err, &compacted) {
+		writeError(w, req, NewAPIError(http.StatusGone, ErrSequenceExpired, "The changes after this sequence number are not kept anymore").
+			WithDetail("since", since).WithDetail("oldest", compacted.Oldest))
+		return
+	}
+	if databaseError(err, w, req, "reading the change log") {
+		return
+	}
+	requestLogger(req).Info("Changes", pubkeyAttr(ctx.pubkey), "since", since, "count", len(events), "more", more)
+	writeJSON(w, http.StatusOK, changesResponse{Events: encodeEvents(events, encoding), Next: next, More: more})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestChanges checks that a key changed several times is returned once at its last change,
+// that a clear drops the changes before it, and the paging with limit
+func TestChanges(t *testing.T) {
+	server := newTestServer(t, nil)
+	key := newTestKey(t, 1)
+	putTestKeys(t, key, "a", "b", "a")
+	if _, err := db.Batch(key.point(), []BatchOp{{Key: []byte("b"), Delete: true}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	putTestKeys(t, key, "c")
+
+	tests := []struct {
+		query    string
+		next     uint64
+		more     bool
+		expected []watchEvent
+	}{
+		{
+			query: "since=0",
+			next:  5,
+			expected: []watchEvent{
+				{Seq: 3, Type: EventPut, Key: "a"},
+				{Seq: 4, Type: EventDelete, Key: "b"},
+				{Seq: 5, Type: EventPut, Key: "c"},
+			},
+		},
+		{
+			query:    "since=3",
+			next:     5,
+			expected: []watchEvent{{Seq: 4, Type: EventDelete, Key: "b"}, {Seq: 5, Type: EventPut, Key: "c"}},
+		},
+		{
+			// with the current state of the keys, b is deleted since
+			query:    "since=0&limit=2",
+			next:     2,
+			more:     true,
+			expected: []watchEvent{{Seq: 1, Type: EventPut, Key: "a"}, {Seq: 2, Type: EventDelete, Key: "b"}},
+		},
+		{
+			query:    "since=2&limit=2",
+			next:     4,
+			more:     true,
+			expected: []watchEvent{{Seq: 3, Type: EventPut, Key: "a"}, {Seq: 4, Type: EventDelete, Key: "b"}},
+		},
+		{
+			query: "since=5",
+			next:  5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			var response changesResponse
+			if status, apiErr := postSigned(t, server.URL+"/changes?"+test.query, key, "changes", &response); status != http.StatusOK {
+				t.Fatalf("changes: %d %v", status, apiErr)
+			}
+			checkEvents(t, response.Events, test.expected...)
+			if response.Next != test.next || response.More != test.more {
+				t.Errorf("next %d more %v, expected %d %v", response.Next, response.More, test.next, test.more)
+			}
+		})
+	}
+
+	if _, err := db.Clear(key.point(), nil); err != nil {
+		t.Fatal(err)
+	}
+	putTestKeys(t, key, "d")
+	var response changesResponse
+	if status, apiErr := postSigned(t, server.URL+"/changes?since=0", key, "changes", &response); status != http.StatusOK {
+		t.Fatalf("changes: %d %v", status, apiErr)
+	}
+	checkEvents(t, response.Events, watchEvent{Seq: 6, Type: EventClear}, watchEvent{Seq: 7, Type: EventPut, Key: "d"})
+}
+
+// TestChangesCompacted checks the 410 of the changes after a sequence number no longer in the log,
+// since=0 included
+func TestChangesCompacted(t *testing.T) {
+	server := newTestServer(t, nil)
+	key := newTestKey(t, 1)
+	for i := 0; i < 5; i++ {
+		putTestKeys(t, key, fmt.Sprint(i))
+	}
+	if removed, err := db.CompactChangeLog(0, 2); err != nil || removed != 3 {
+		t.Fatalf("removed %d %v, expected 3", removed, err)
+	}
+	for _, since := range []uint64{0, 1, 2} {
+		var response changesResponse
+		status, apiErr := postSigned(t, fmt.Sprintf("%s/changes?since=%d", server.URL, since), key, "changes", &response)
+		if status != http.StatusGone || apiErr.Code != ErrSequenceExpired || apiErr.Details["oldest"] != float64(4) {
+			t.Errorf("since=%d: %d %+v, expected 410 with the oldest sequence number 4", since, status, apiErr)
+		}
+	}
+	var response changesResponse
+	if status, apiErr := postSigned(t, server.URL+"/changes?since=3", key, "changes", &response); status != http.StatusOK {
+		t.Fatalf("changes: %d %v", status, apiErr)
+	}
+	checkEvents(t, response.Events, watchEvent{Seq: 4, Type: EventPut, Key: "3"}, watchEvent{Seq: 5, Type: EventPut, Key: "4"})
+}
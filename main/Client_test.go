@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ndv/kv/client"
+	"sort"
+	"testing"
+)
+
+// newTestClient returns the client of the namespace of newTestKey(t, private) on the server
+func newTestClient(t *testing.T, url string, private byte, encrypt bool, encryptKeys bool) *client.Client {
+	t.Helper()
+	d := make([]byte, 32)
+	d[31] = private
+	c, err := client.New(client.Config{URL: url, PrivateKey: d, Encrypt: encrypt, EncryptKeys: encryptKeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// storedKeys returns the data keys and values of the pubkey as the server has them
+func storedKeys(t *testing.T, key *testKey) map[string]string {
+	t.Helper()
+	view, err := db.View(key.pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Release()
+	keys := make(map[string]string)
+	err = view.ForEach(func(key []byte, value []byte) error {
+		keys[string(key)] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// TestClient checks the round trip of the client operations in the plain and the encrypted modes
+func TestClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		encrypt     bool
+		encryptKeys bool
+	}{
+		{name: "plain"},
+		{name: "encrypted values", encrypt: true},
+		{name: "encrypted values and keys", encrypt: true, encryptKeys: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, nil)
+			key := newTestKey(t, 1)
+			c := newTestClient(t, server.URL, 1, test.encrypt, test.encryptKeys)
+
+			for i, entry := range [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}} {
+				version, err := c.Put([]byte(entry[0]), []byte(entry[1]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if version != uint64(i+1) {
+					t.Errorf("put %d: version %d, expected %d", i, version, i+1)
+				}
+			}
+			value, found, err := c.Get([]byte("a"))
+			if err != nil || !found || string(value) != "3" {
+				t.Errorf("get a: %q %v %v, expected 3", value, found, err)
+			}
+			if _, found, err = c.Get([]byte("missing")); err != nil || found {
+				t.Errorf("get missing: found %v %v", found, err)
+			}
+			entries, err := c.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(entries, func(i, j int) bool { return string(entries[i].Key) < string(entries[j].Key) })
+			if len(entries) != 2 || string(entries[0].Key) != "a" || string(entries[0].Value) != "3" ||
+				string(entries[1].Key) != "b" || string(entries[1].Value) != "2" {
+				t.Errorf("entries %q, expected a=3 and b=2", entries)
+			}
+
+			stored := storedKeys(t, key)
+			for name, value := range stored {
+				if plain := name == "a" || name == "b"; plain == test.encryptKeys {
+					t.Errorf("stored key %q with the encrypted names %v", name, test.encryptKeys)
+				}
+				if plain := value == "2" || value == "3"; plain == test.encrypt {
+					t.Errorf("stored value %q with the encrypted values %v", value, test.encrypt)
+				}
+			}
+
+			if err = c.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			if entries, err = c.GetAll(); err != nil || len(entries) != 0 {
+				t.Errorf("entries %q %v after the clear", entries, err)
+			}
+		})
+	}
+}
+
+// TestClientKeyNames checks that the encrypted key names are the same for every client of the namespace,
+// so that a key is read and overwritten by its name, and differ between the namespaces
+func TestClientKeyNames(t *testing.T) {
+	server := newTestServer(t, nil)
+	first := newTestClient(t, server.URL, 1, true, true)
+	second := newTestClient(t, server.URL, 1, true, true)
+	if _, err := first.Put([]byte("name"), []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Put([]byte("name"), []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := first.Get([]byte("name")); err != nil || !found || string(value) != "second" {
+		t.Errorf("get: %q %v %v, expected the value of the second client", value, found, err)
+	}
+	stored := storedKeys(t, newTestKey(t, 1))
+	if len(stored) != 1 {
+		t.Fatalf("stored keys %q, expected one", stored)
+	}
+
+	other := newTestClient(t, server.URL, 2, true, true)
+	if _, err := other.Put([]byte("name"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	for name := range storedKeys(t, newTestKey(t, 2)) {
+		if _, found := stored[name]; found {
+			t.Errorf("the same encrypted name %x in another namespace", name)
+		}
+	}
+}
+
+// TestClientValueBinding checks that a value moved by the server to another key does not decrypt
+func TestClientValueBinding(t *testing.T) {
+	for _, encryptKeys := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted names %v", encryptKeys), func(t *testing.T) {
+			server := newTestServer(t, nil)
+			key := newTestKey(t, 1)
+			c := newTestClient(t, server.URL, 1, true, encryptKeys)
+			// the stored names of a and b, whether encrypted or not
+			put := func(name string, value string) string {
+				before := storedKeys(t, key)
+				if _, err := c.Put([]byte(name), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+				for stored := range storedKeys(t, key) {
+					if _, found := before[stored]; !found {
+						return stored
+					}
+				}
+				t.Fatalf("no new key for %s", name)
+				return ""
+			}
+			a, b := put("a", "secret"), put("b", "other")
+
+			stored := storedKeys(t, key)
+			if _, err := db.Put(key.point(), []byte(b), []byte(stored[a]), nil); err != nil {
+				t.Fatal(err)
+			}
+			var decryptionErr *client.DecryptionError
+			if value, _, err := c.Get([]byte("b")); !errors.As(err, &decryptionErr) {
+				t.Errorf("the value of a moved to b: %q %v, expected a decryption error", value, err)
+			}
+			if value, found, err := c.Get([]byte("a")); err != nil || !found || string(value) != "secret" {
+				t.Errorf("get a: %q %v %v", value, found, err)
+			}
+			if _, err := c.GetAll(); !errors.As(err, &decryptionErr) {
+				t.Errorf("get all with the moved value: %v, expected a decryption error", err)
+			}
+		})
+	}
+}
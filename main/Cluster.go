@@ -0,0 +1,759 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// In the clustered mode the writes are committed through Raft before they reach leveldb. The leader builds
+// the batch of a write as usual, with its change log and history entries, and proposes it together with the
+// change events and the signed request; every node, the leader too, writes the committed batches in the log order
+// with the audit log entries of the requests. So the replication sequence numbers and the audit log are the same
+// on all the nodes.
+// The Raft ID of a node is its own HTTP URL, where the other nodes forward the writes while it is the leader.
+var clusterAppliedKey = []byte("\x00cluster-applied") // the Raft index of the last command written to leveldb
+
+// ForwardedHeader is set on the requests forwarded to the leader, so that they are not forwarded again
+const ForwardedHeader = "X-Kv-Forwarded"
+
+// cluster is set when the server is a node of a Raft cluster
+var cluster *Cluster
+
+// Cluster is the Raft node of the server, it is also the Raft state machine writing to the database
+type Cluster struct {
+	raft    *raft.Raft
+	db      *Database
+	config  ClusterConfig
+	client  *http.Client
+	applied uint64                           // only used by the Raft goroutine applying the commands
+	ready   atomic.Bool                      // the node is the leader and has applied the commands of the previous leaders
+	proxies sync.Map                         // the leader URL to its *httputil.ReverseProxy
+	store   io.Closer                        // the Raft log, nil if it is not on disk
+	failed  atomic.Pointer[ApplyFailedError] // set when a committed command cannot be written
+	stop    chan struct{}                    // closed when a command cannot be written, watchLeadership then stops the Raft node
+}
+
+type WrongNodeURLError struct {
+	url string
+}
+
+func (e *WrongNodeURLError) Error() string {
+	return "Wrong node URL " + e.url + ", expected http:// or https://"
+}
+
+type NotLeaderError struct {
+	leader string // the URL of the leader, empty if unknown
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.leader == "" {
+		return "The cluster has no leader"
+	}
+	return "This node is not the leader of the cluster, the leader is " + e.leader
+}
+
+type CorruptedClusterCommandError struct{}
+
+func (e *CorruptedClusterCommandError) Error() string {
+	return "Corrupted cluster command"
+}
+
+// ApplyFailedError stops the node: the commands after the one it could not write would build on a state
+// the other nodes don't have
+type ApplyFailedError struct {
+	index uint64
+	err   error
+}
+
+func (e *ApplyFailedError) Error() string {
+	return "Cannot write the committed command " + strconv.FormatUint(e.index, 10) + ", the cluster node is stopped: " + e.err.Error()
+}
+
+func (e *ApplyFailedError) Unwrap() error {
+	return e.err
+}
+
+type InterruptedSnapshotError struct{}
+
+func (e *InterruptedSnapshotError) Error() string {
+	return "Loading a snapshot has been interrupted and there is no snapshot to load again"
+}
+
+func checkNodeURL(node string) error {
+	u, err := url.Parse(node)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &WrongNodeURLError{node}
+	}
+	return nil
+}
+
+type MissingRaftTLSError struct{}
+
+func (e *MissingRaftTLSError) Error() string {
+	return "cluster.raft_cert, cluster.raft_key and cluster.raft_ca are required, the nodes only talk to each other over mutual TLS"
+}
+
+// NewCluster starts the Raft node with the log in leveldb and the snapshots in files under config.Dir,
+// talking to the other nodes over mutual TLS
+func NewCluster(db *Database, config ClusterConfig, logOutput io.Writer, logLevel string) (*Cluster, error) {
+	if err := checkNodeURL(config.NodeURL); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	stream, err := newRaftStreamLayer(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := raft.NewNetworkTransport(stream, 3, 10*time.Second, logOutput)
+	snapshots, err := raft.NewFileSnapshotStore(config.Dir, config.SnapshotsRetained, logOutput)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	store, err := NewRaftStore(filepath.Join(config.Dir, "log"))
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	c, err := newCluster(db, config, store, store, snapshots, transport, logOutput, logLevel)
+	if err != nil {
+		transport.Close()
+		store.Close()
+		return nil, err
+	}
+	c.store = store
+	return c, nil
+}
+
+// raftStreamLayer carries the Raft transport over TLS. Both ends present their certificate of the cluster CA
+// and accept only the certificates of this CA, so only the nodes take part in the cluster and see its log.
+type raftStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	config    *tls.Config
+}
+
+func newRaftStreamLayer(config ClusterConfig) (*raftStreamLayer, error) {
+	if config.RaftCert == "" || config.RaftKey == "" || config.RaftCA == "" {
+		return nil, &MissingRaftTLSError{}
+	}
+	reloader, err := NewCertificateReloader(config.RaftCert, config.RaftKey)
+	if err != nil {
+		return nil, err
+	}
+	reloader.ReloadOnSignal()
+	pool, err := loadCertPool(config.RaftCA)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.GetCertificate(nil)
+		},
+		RootCAs:    pool,
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", config.RaftAddress)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", config.RaftAddress, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &raftStreamLayer{Listener: listener, advertise: advertise, config: tlsConfig}, nil
+}
+
+// Dial connects to another node, checking its certificate for the host of its Raft address
+func (l *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), l.config)
+}
+
+// Addr is the address the other nodes connect to
+func (l *raftStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+// newCluster starts the Raft node with the given stores and transport, the in-memory ones of the raft
+// package run a whole cluster in one process
+func newCluster(db *Database, config ClusterConfig, logs raft.LogStore, stable raft.StableStore,
+	snapshots raft.SnapshotStore, transport raft.Transport, logOutput io.Writer, logLevel string) (*Cluster, error) {
+	httpTransport, err := newAdminTransport(config.ClientCert, config.ClientKey, config.CA)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{db: db, config: config, client: &http.Client{Transport: httpTransport}, stop: make(chan struct{})}
+	if err := c.restoreOnStart(snapshots); err != nil {
+		return nil, err
+	}
+	clusterApplied.Set(float64(c.applied))
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(config.NodeURL)
+	conf.SnapshotInterval = config.SnapshotInterval
+	conf.SnapshotThreshold = uint64(config.SnapshotThreshold)
+	// leveldb keeps the state across restarts, restoreOnStart only loads a snapshot when it is behind
+	conf.NoSnapshotRestoreOnStart = true
+	conf.LogOutput = logOutput
+	conf.LogLevel = logLevel
+
+	if config.Bootstrap {
+		existing, err := raft.HasExistingState(logs, stable, snapshots)
+		if err != nil {
+			return nil, err
+		}
+		if !existing {
+			err = raft.BootstrapCluster(conf, logs, stable, snapshots, transport, raft.Configuration{
+				Servers: []raft.Server{{ID: conf.LocalID, Address: transport.LocalAddr()}},
+			})
+			if err != nil {
+				return nil, err
+			}
+			slog.Info("Cluster bootstrapped", "node", config.NodeURL)
+		}
+	}
+	c.raft, err = raft.NewRaft(conf, c, logs, stable, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	// the background writers of the database may already run
+	db.cluster.Store(c)
+	go c.watchLeadership(db.quit)
+	if config.Join != "" {
+		go c.join(db.quit)
+	}
+	return c, nil
+}
+
+// restoreOnStart loads the last snapshot if leveldb is behind it, or loading a snapshot has been interrupted
+func (c *Cluster) restoreOnStart(snapshots raft.SnapshotStore) error {
+	applied, err := readClusterApplied(c.db.db)
+	if err != nil {
+		return err
+	}
+	pending, err := c.db.snapshotPending()
+	if err != nil {
+		return err
+	}
+	list, err := snapshots.List()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 || (list[0].Index <= applied && !pending) {
+		if pending {
+			return &InterruptedSnapshotError{}
+		}
+		c.applied = applied
+		return nil
+	}
+	meta, r, err := snapshots.Open(list[0].ID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := c.db.LoadSnapshot(r); err != nil {
+		return err
+	}
+	// the entries between the last command and the snapshot index, like the leader elections, change nothing
+	if err := c.db.db.Put(clusterAppliedKey, binary.BigEndian.AppendUint64(nil, meta.Index), nil); err != nil {
+		return err
+	}
+	c.applied = meta.Index
+	slog.Info("Snapshot loaded", "index", meta.Index, "term", meta.Term)
+	return nil
+}
+
+func readClusterApplied(reader leveldb.Reader) (uint64, error) {
+	value, err := reader.Get(clusterAppliedKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, &CorruptedClusterCommandError{}
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// Shutdown stops the Raft node, before the database is closed
+func (c *Cluster) Shutdown() error {
+	err := c.raft.Shutdown().Error()
+	if c.store != nil {
+		if closeErr := c.store.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// encodeClusterCommand encodes the batch, the change events of the pubkey and the signed request made at now
+// as uint32 batch size, the batch, uint8 pubkey size, the pubkey, uint64 unix time in nanoseconds, uint8 operation
+// size and the operation of the request, followed by r, s, the compressed pubkey, uint32 message size and
+// the message if there is an operation, then the events, each as uint64 sequence number, the entry type
+// of the change log, uint32 key size, key, uint32 value size and value, the integers little-endian
+func encodeClusterCommand(batch *leveldb.Batch, pubkey []byte, signed *SignedRequest, now time.Time, events []ChangeEvent) []byte {
+	data := batch.Dump()
+	command := binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+	command = append(command, data...)
+	command = append(command, byte(len(pubkey)))
+	command = append(command, pubkey...)
+	command = binary.LittleEndian.AppendUint64(command, uint64(now.UnixNano()))
+	if signed == nil {
+		command = append(command, 0)
+	} else {
+		command = append(append(command, byte(len(signed.Op))), signed.Op...)
+		command = append(command, signed.Header...)
+		command = binary.LittleEndian.AppendUint32(command, uint32(len(signed.Message)))
+		command = append(command, signed.Message...)
+	}
+	for _, event := range events {
+		command = binary.LittleEndian.AppendUint64(command, event.Seq)
+		command = append(command, changeTypes[event.Type])
+		command = binary.LittleEndian.AppendUint32(command, uint32(len(event.Key)))
+		command = append(command, event.Key...)
+		command = binary.LittleEndian.AppendUint32(command, uint32(len(event.Value)))
+		command = append(command, event.Value...)
+	}
+	return command
+}
+
+// clusterCommand is a decoded command, signed is nil if it adds no audit log entry
+type clusterCommand struct {
+	batch  *leveldb.Batch
+	pubkey []byte
+	signed *SignedRequest
+	time   time.Time
+	events []ChangeEvent
+}
+
+func decodeClusterCommand(command []byte) (*clusterCommand, error) {
+	var err error
+	corrupted := &CorruptedClusterCommandError{}
+	next := func(size int) []byte {
+		if err != nil || size < 0 || len(command) < size {
+			err = corrupted
+			return nil
+		}
+		bytes := command[:size]
+		command = command[size:]
+		return bytes
+	}
+	nextSize := func() int {
+		if bytes := next(4); bytes != nil {
+			return int(binary.LittleEndian.Uint32(bytes))
+		}
+		return -1
+	}
+	nextByte := func() int {
+		if bytes := next(1); bytes != nil {
+			return int(bytes[0])
+		}
+		return -1
+	}
+	decoded := &clusterCommand{batch: new(leveldb.Batch)}
+	data := next(nextSize())
+	// the batch grows in place when it is written, and the command may be shared with the Raft transport
+	if err != nil || decoded.batch.Load(append([]byte{}, data...)) != nil {
+		return nil, corrupted
+	}
+	decoded.pubkey = next(nextByte())
+	if timestamp := next(8); timestamp != nil {
+		decoded.time = time.Unix(0, int64(binary.LittleEndian.Uint64(timestamp)))
+	}
+	if op := next(nextByte()); len(op) > 0 {
+		decoded.signed = &SignedRequest{Op: string(op), Header: next(32 + 32 + 33)}
+		decoded.signed.Message = next(nextSize())
+	}
+	for err == nil && len(command) > 0 {
+		var event ChangeEvent
+		if seq := next(8); seq != nil {
+			event.Seq = binary.LittleEndian.Uint64(seq)
+		}
+		code := nextByte()
+		for name, c := range changeTypes {
+			if int(c) == code {
+				event.Type = name
+			}
+		}
+		event.Key = next(nextSize())
+		event.Value = next(nextSize())
+		if event.Type == "" {
+			err = corrupted
+		}
+		decoded.events = append(decoded.events, event)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// propose commits the batch through Raft and waits until this node has written it. It holds no lock of the
+// database: the batches are ordered by their Raft log index, and the audit log entries are made when they are
+// written in that order. The caller holds the write lock of the pubkey, so that its next batch builds on this one.
+func (c *Cluster) propose(batch *leveldb.Batch, pubkey []byte, signed *SignedRequest, now time.Time, events []ChangeEvent) error {
+	if !c.ready.Load() {
+		return c.notLeader()
+	}
+	future := c.raft.Apply(encodeClusterCommand(batch, pubkey, signed, now, events), c.config.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return c.raftError(err)
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (c *Cluster) notLeader() *NotLeaderError {
+	_, leader := c.raft.LeaderWithID()
+	return &NotLeaderError{string(leader)}
+}
+
+// raftError replaces the errors of the Raft calls made on a node which is not the leader with NotLeaderError.
+// After ErrLeadershipLost the command may still be committed by the next leader.
+func (c *Cluster) raftError(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+		return c.notLeader()
+	}
+	return err
+}
+
+// Apply writes a committed batch, it is called by Raft for every command in the log order.
+// A batch which cannot be written stops the node, skipping it would make the node diverge from the others.
+func (c *Cluster) Apply(log *raft.Log) interface{} {
+	if failed := c.failed.Load(); failed != nil {
+		return failed
+	}
+	if log.Index <= c.applied {
+		return nil // written before the restart
+	}
+	command, err := decodeClusterCommand(log.Data)
+	if err == nil {
+		err = c.db.applyCommitted(command, log.Index)
+	}
+	if err != nil {
+		clusterErrors.Inc()
+		failed := &ApplyFailedError{log.Index, err}
+		slog.Error("Cannot apply the committed batch, stopping the cluster node", "index", log.Index, "error", err)
+		c.ready.Store(false)
+		clusterLeader.Set(0)
+		c.failed.Store(failed)
+		// Shutdown waits for this goroutine, so it is called by another one
+		close(c.stop)
+		return failed
+	}
+	c.applied = log.Index
+	clusterApplied.Set(float64(log.Index))
+	return nil
+}
+
+// applyCommitted writes the batch committed at the Raft index with its audit log entry, and publishes its events.
+// The leader only proposes a signed request with the audit log enabled, so the nodes having it disabled start it
+// from the log in the database, to keep the same keys as the leader.
+func (db *Database) applyCommitted(command *clusterCommand, index uint64) error {
+	command.batch.Put(clusterAppliedKey, binary.BigEndian.AppendUint64(nil, index))
+	if command.signed != nil && db.audit.Load() == nil {
+		if err := db.EnableAuditLog(); err != nil {
+			return err
+		}
+	}
+	return db.writeBatch(command.batch, command.pubkey, command.signed, command.time, command.events)
+}
+
+// Snapshot captures the database at the last applied command, Raft writes it to the snapshot store later
+func (c *Cluster) Snapshot() (raft.FSMSnapshot, error) {
+	if failed := c.failed.Load(); failed != nil {
+		return nil, failed // Raft counts the failed command as applied
+	}
+	snapshot, err := c.db.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &clusterSnapshot{snapshot}, nil
+}
+
+// Restore replaces the database with a snapshot of the leader
+func (c *Cluster) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	if _, err := c.db.LoadSnapshot(r); err != nil {
+		return err
+	}
+	applied, err := readClusterApplied(c.db.db)
+	if err != nil {
+		return err
+	}
+	c.applied = applied
+	clusterApplied.Set(float64(applied))
+	slog.Info("Snapshot of the leader loaded", "applied", applied)
+	return nil
+}
+
+// clusterSnapshot is a leveldb snapshot written in the format of WriteSnapshot
+type clusterSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+func (s *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	out := bufio.NewWriterSize(sink, 64*1024)
+	err := writeSnapshot(s.snapshot, out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *clusterSnapshot) Release() {
+	s.snapshot.Release()
+}
+
+// watchLeadership accepts the writes once this node becomes the leader and has applied the whole log,
+// so that the batches it builds start from the state of the previous leader
+func (c *Cluster) watchLeadership(quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-c.stop:
+			if err := c.raft.Shutdown().Error(); err != nil {
+				slog.Error("Cannot stop the Raft node", "error", err)
+			}
+			return
+		case leader := <-c.raft.LeaderCh():
+			if c.failed.Load() != nil {
+				continue
+			}
+			c.ready.Store(false)
+			clusterLeader.Set(0)
+			for leader && c.raft.State() == raft.Leader {
+				err := c.raft.Barrier(c.config.ApplyTimeout).Error()
+				if err == nil {
+					c.ready.Store(true)
+					clusterLeader.Set(1)
+					slog.Info("This node is the leader of the cluster", "node", c.config.NodeURL)
+					break
+				}
+				slog.Warn("Cannot apply the log as the new leader", "error", err)
+			}
+		}
+	}
+}
+
+// leading returns true if this server may write, that is it does not follow another one,
+// and it is not clustered or is the ready leader
+func (db *Database) leading() bool {
+	if db.following.Load() {
+		return false
+	}
+	c := db.cluster.Load()
+	return c == nil || c.ready.Load()
+}
+
+// Failed returns the error which stopped the node, nil while it runs
+func (c *Cluster) Failed() error {
+	if failed := c.failed.Load(); failed != nil {
+		return failed
+	}
+	return nil
+}
+
+// join asks the node at the Join URL to add this one to the cluster, until it succeeds or quit is closed
+func (c *Cluster) join(quit <-chan struct{}) {
+	backoff := time.Second
+	for {
+		if c.member() {
+			return
+		}
+		err := c.requestJoin()
+		if err == nil {
+			slog.Info("Joined the cluster", "through", c.config.Join)
+			return
+		}
+		slog.Warn("Cannot join the cluster", "through", c.config.Join, "error", err, "retry_in", backoff.String())
+		select {
+		case <-quit:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// member returns true if this node is in the cluster configuration it knows
+func (c *Cluster) member() bool {
+	future := c.raft.GetConfiguration()
+	if future.Error() != nil {
+		return false
+	}
+	for _, server := range future.Configuration().Servers {
+		if string(server.ID) == c.config.NodeURL {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cluster) requestJoin() error {
+	target, err := url.Parse(c.config.Join)
+	if err != nil {
+		return err
+	}
+	target = target.JoinPath("/cluster/join")
+	target.RawQuery = url.Values{"id": {c.config.NodeURL}, "address": {c.config.RaftAddress}}.Encode()
+	resp, err := c.client.Post(target.String(), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &LeaderError{resp.StatusCode}
+	}
+	return nil
+}
+
+// leaderOnly runs the handler on the leader and forwards the request to the leader on the other nodes
+func (c *Cluster) leaderOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if c.ready.Load() {
+			handler(w, req)
+			return
+		}
+		notLeader := c.notLeader()
+		if notLeader.leader == "" || notLeader.leader == c.config.NodeURL || req.Header.Get(ForwardedHeader) != "" {
+			writeError(w, req, noLeaderError(notLeader))
+			return
+		}
+		requestLogger(req).Debug("Forwarding to the leader", "leader", notLeader.leader)
+		req.Header.Set(ForwardedHeader, c.config.NodeURL)
+		c.proxy(notLeader.leader).ServeHTTP(w, req)
+	}
+}
+
+func (c *Cluster) proxy(leader string) *httputil.ReverseProxy {
+	if proxy, ok := c.proxies.Load(leader); ok {
+		return proxy.(*httputil.ReverseProxy)
+	}
+	target, _ := url.Parse(leader) // checked by checkNodeURL on the leader
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = c.client.Transport
+	forwardClientIP(proxy)
+	actual, _ := c.proxies.LoadOrStore(leader, proxy)
+	return actual.(*httputil.ReverseProxy)
+}
+
+func noLeaderError(err *NotLeaderError) *APIError {
+	apiErr := NewAPIError(http.StatusServiceUnavailable, ErrNoLeader, err.Error())
+	if err.leader != "" {
+		apiErr = apiErr.WithDetail("leader", err.leader)
+	}
+	return apiErr
+}
+
+type clusterServerJSON struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+}
+
+type clusterStatusJSON struct {
+	ID           string              `json:"id"`
+	State        string              `json:"state"`
+	Leader       string              `json:"leader"`
+	LastIndex    uint64              `json:"last_index"`
+	AppliedIndex uint64              `json:"applied_index"`
+	Servers      []clusterServerJSON `json:"servers"`
+}
+
+// handleCluster returns the Raft state of this node and the cluster configuration
+func handleCluster(w http.ResponseWriter, req *http.Request) {
+	future := cluster.raft.GetConfiguration()
+	if databaseError(future.Error(), w, req, "reading the cluster configuration") {
+		return
+	}
+	_, leader := cluster.raft.LeaderWithID()
+	status := clusterStatusJSON{
+		ID:           cluster.config.NodeURL,
+		State:        cluster.raft.State().String(),
+		Leader:       string(leader),
+		LastIndex:    cluster.raft.LastIndex(),
+		AppliedIndex: cluster.raft.AppliedIndex(),
+		Servers:      []clusterServerJSON{},
+	}
+	for _, server := range future.Configuration().Servers {
+		status.Servers = append(status.Servers, clusterServerJSON{
+			ID:       string(server.ID),
+			Address:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+		})
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleClusterJoin adds the node ?id= with the Raft ?address= to the cluster, as a voter unless ?voter=false
+func handleClusterJoin(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	id, address := query.Get("id"), query.Get("address")
+	if err := checkNodeURL(id); err != nil {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, err.Error()))
+		return
+	}
+	if address == "" {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "The Raft address of the node is required"))
+		return
+	}
+	voter := query.Get("voter") != "false"
+	var future raft.IndexFuture
+	if voter {
+		future = cluster.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(address), 0, cluster.config.ApplyTimeout)
+	} else {
+		future = cluster.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(address), 0, cluster.config.ApplyTimeout)
+	}
+	if databaseError(cluster.raftError(future.Error()), w, req, "adding the node") {
+		return
+	}
+	requestLogger(req).Info("Node added to the cluster", "node", id, "address", address, "voter", voter)
+	handleCluster(w, req)
+}
+
+// handleClusterRemove removes the node ?id= from the cluster
+func handleClusterRemove(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "The node ID is required"))
+		return
+	}
+	future := cluster.raft.RemoveServer(raft.ServerID(id), 0, cluster.config.ApplyTimeout)
+	if databaseError(cluster.raftError(future.Error()), w, req, "removing the node") {
+		return
+	}
+	requestLogger(req).Info("Node removed from the cluster", "node", id)
+	handleCluster(w, req)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNode is a node of a cluster running in the test process, over the in-memory Raft transport
+type testNode struct {
+	url       string
+	config    DatabaseConfig
+	db        *Database
+	cluster   *Cluster
+	transport *raft.InmemTransport
+	logs      *raft.InmemStore // kept across the restarts, like the Raft log on disk
+	snapshots *raft.InmemSnapshotStore
+	mux       *http.ServeMux
+}
+
+type testCluster struct {
+	t     *testing.T
+	nodes []*testNode
+}
+
+// newTestCluster starts the nodes, the first one bootstraps the cluster and adds the others
+func newTestCluster(t *testing.T, size int) *testCluster {
+	tc := &testCluster{t: t}
+	for i := 0; i < size; i++ {
+		node := &testNode{
+			config:    testConfig(t).Database,
+			logs:      raft.NewInmemStore(),
+			snapshots: raft.NewInmemSnapshotStore(),
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			node.mux.ServeHTTP(w, req)
+		}))
+		t.Cleanup(server.Close)
+		node.url = server.URL
+		tc.nodes = append(tc.nodes, node)
+	}
+	for i, node := range tc.nodes {
+		tc.start(node, i == 0)
+		t.Cleanup(func() { tc.stop(node) })
+	}
+	leader := tc.leader()
+	for _, node := range tc.nodes[1:] {
+		err := leader.cluster.raft.AddVoter(raft.ServerID(node.url), node.transport.LocalAddr(), 0, 5*time.Second).Error()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tc
+}
+
+// start opens the database of the node and starts its Raft node, connected to the running ones
+func (tc *testCluster) start(node *testNode, bootstrap bool) {
+	tc.t.Helper()
+	var err error
+	node.db, err = NewDatabase(node.config)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	_, node.transport = raft.NewInmemTransport(raft.ServerAddress(node.url))
+	for _, other := range tc.nodes {
+		if other != node && other.cluster != nil {
+			node.transport.Connect(other.transport.LocalAddr(), other.transport)
+			other.transport.Connect(node.transport.LocalAddr(), node.transport)
+		}
+	}
+	config := ClusterConfig{
+		NodeURL:           node.url,
+		Bootstrap:         bootstrap,
+		ApplyTimeout:      5 * time.Second,
+		SnapshotInterval:  time.Minute,
+		SnapshotThreshold: 8192,
+	}
+	node.cluster, err = newCluster(node.db, config, node.logs, node.logs, node.snapshots, node.transport, io.Discard, "error")
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	node.mux = http.NewServeMux()
+	handleSigned(node.mux, "/put", node.cluster.leaderOnly(handlePut))
+}
+
+func (tc *testCluster) stop(node *testNode) {
+	if node.cluster == nil {
+		return
+	}
+	if err := node.cluster.Shutdown(); err != nil {
+		tc.t.Error(err)
+	}
+	node.db.Close()
+	node.cluster = nil
+}
+
+// leader waits for a node to become the ready leader
+func (tc *testCluster) leader() *testNode {
+	tc.t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		for _, node := range tc.nodes {
+			if node.cluster != nil && node.cluster.ready.Load() {
+				return node
+			}
+		}
+	}
+	tc.t.Fatal("The cluster has no leader")
+	return nil
+}
+
+// waitApplied waits until the running nodes have written the batches up to the replication sequence number
+func (tc *testCluster) waitApplied(seq uint64) {
+	tc.t.Helper()
+	for _, node := range tc.nodes {
+		if node.cluster == nil {
+			continue
+		}
+		for deadline := time.Now().Add(5 * time.Second); node.db.Replication().Last() < seq; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				tc.t.Fatalf("%s has written %d batches, expected %d", node.url, node.db.Replication().Last(), seq)
+			}
+		}
+	}
+}
+
+func (tc *testCluster) checkValue(key *testKey, name string, expected string) {
+	tc.t.Helper()
+	for _, node := range tc.nodes {
+		value, found, err := node.db.Get(key.point(), []byte(name))
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		if !found || string(value) != expected {
+			tc.t.Errorf("%s: %s is %q, expected %q", node.url, name, value, expected)
+		}
+	}
+}
+
+// TestCluster writes through the leader and through a follower forwarding to it, then restarts a follower
+// which catches up with the writes made while it was down without writing the earlier ones again
+func TestCluster(t *testing.T) {
+	newTestServer(t, nil) // the globals of the handlers
+	serverDB := db
+	t.Cleanup(func() { db = serverDB })
+	tc := newTestCluster(t, 3)
+	leader := tc.leader()
+	db = leader.db
+	key := newTestKey(t, 1)
+
+	// the writes of several pubkeys wait for Raft at the same time, the audit log follows the log order
+	if err := leader.db.EnableAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	var wait sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wait.Add(1)
+		go func(writer *testKey, name string) {
+			defer wait.Done()
+			signed := &SignedRequest{Op: OpPut, Header: append(make([]byte, 64), writer.pubkey...), Message: []byte("put")}
+			if _, err := leader.db.Put(writer.point(), []byte(name), []byte("value"), signed); err != nil {
+				t.Error(err)
+			}
+		}(newTestKey(t, byte(i+1)), "key"+strconv.Itoa(i))
+	}
+	wait.Wait()
+	seq := leader.db.Replication().Last()
+	tc.waitApplied(seq)
+	tc.checkValue(key, "key0", "value")
+	size, root, _ := leader.db.AuditHead()
+	for _, node := range tc.nodes {
+		if nodeSize, nodeRoot, ok := node.db.AuditHead(); !ok || nodeSize != 5 || !bytes.Equal(nodeRoot, root) {
+			t.Errorf("%s has the audit log of %d entries %x, the leader %d %x", node.url, nodeSize, nodeRoot, size, root)
+		}
+	}
+
+	var followers []*testNode
+	for _, node := range tc.nodes {
+		if node != leader {
+			followers = append(followers, node)
+			if _, err := node.db.Put(key.point(), []byte("key"), []byte("value"), nil); err == nil {
+				t.Errorf("%s accepted a write as a follower", node.url)
+			}
+		}
+	}
+	status, body := post(t, followers[0].url+"/put", key.putRequest(t, "forwarded", "value"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("put through a follower: %d %s", status, body)
+	}
+	seq++
+	tc.waitApplied(seq)
+	tc.checkValue(key, "forwarded", "value")
+
+	restarted := followers[1]
+	tc.stop(restarted)
+	for i := 0; i < 3; i++ {
+		if _, err := leader.db.Put(key.point(), []byte("key0"), []byte("while down "+strconv.Itoa(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq += 3
+	tc.start(restarted, false)
+	tc.waitApplied(seq)
+	tc.checkValue(key, "key0", "while down 2")
+	tc.checkValue(key, "forwarded", "value")
+	if last := restarted.db.Replication().Last(); last != seq {
+		t.Errorf("the restarted node has written %d batches, expected %d", last, seq)
+	}
+	if restarted.cluster.Failed() != nil {
+		t.Error(restarted.cluster.Failed())
+	}
+}
+
+// TestClusterApplyFailed checks that a batch which cannot be written stops the node instead of being skipped
+func TestClusterApplyFailed(t *testing.T) {
+	database := newTestDatabase(t)
+	c := &Cluster{db: database, stop: make(chan struct{})}
+	key := newTestKey(t, 1)
+	command := func(name string) []byte {
+		batch := new(leveldb.Batch)
+		batch.Put(append(append([]byte{}, key.pubkey...), name...), []byte("value"))
+		return encodeClusterCommand(batch, key.pubkey, nil, time.Now(), nil)
+	}
+
+	database.db.Close()
+	if _, failed := c.Apply(&raft.Log{Index: 1, Data: command("first")}).(*ApplyFailedError); !failed {
+		t.Fatal("the batch was written to a closed database")
+	}
+	select {
+	case <-c.stop:
+	default:
+		t.Error("the node was not stopped")
+	}
+	if c.Failed() == nil {
+		t.Error("the node is not failed")
+	}
+	// the next batches are not even tried
+	if failed, _ := c.Apply(&raft.Log{Index: 2, Data: command("second")}).(*ApplyFailedError); failed == nil || failed.index != 1 {
+		t.Errorf("the batch after the failed one: %v", failed)
+	}
+	if c.applied != 0 {
+		t.Errorf("applied %d, expected 0", c.applied)
+	}
+}
+
+// TestRaftTLS checks that the Raft transport only connects the nodes with a certificate of the cluster CA
+func TestRaftTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "cluster CA", 1, nil, false)
+	ca.write(t, filepath.Join(dir, "ca.pem"), "")
+	layer := func(name string, cert *testCert) *raftStreamLayer {
+		t.Helper()
+		config := ClusterConfig{
+			RaftAddress: "127.0.0.1:0",
+			RaftCert:    filepath.Join(dir, name+".pem"),
+			RaftKey:     filepath.Join(dir, name+".key"),
+			RaftCA:      filepath.Join(dir, "ca.pem"),
+		}
+		cert.write(t, config.RaftCert, config.RaftKey)
+		l, err := newRaftStreamLayer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	first := layer("first", newTestCert(t, "first", 2, ca, false))
+	second := layer("second", newTestCert(t, "second", 3, ca, false))
+	stranger := layer("stranger", newTestCert(t, "stranger", 4, newTestCert(t, "other CA", 5, nil, false), false))
+	go func() {
+		for {
+			conn, err := first.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	echo := func(from *raftStreamLayer) error {
+		conn, err := from.Dial(raft.ServerAddress(first.Listener.Addr().String()), time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	if err := echo(second); err != nil {
+		t.Errorf("a node of the cluster: %v", err)
+	}
+	if err := echo(stranger); err == nil {
+		t.Error("a node with a certificate of another CA was accepted")
+	}
+	if _, err := newRaftStreamLayer(ClusterConfig{RaftAddress: "127.0.0.1:0"}); err == nil {
+		t.Error("the transport started without the certificates")
+	}
+}
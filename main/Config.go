@@ -0,0 +1,452 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds all server settings. They are taken from the defaults, then the YAML config file,
+// then the KV_* environment variables, and finally from the command line flags.
+type Config struct {
+	Listen          string            `yaml:"listen"`
+	AdminListen     string            `yaml:"admin_listen"` // serves the admin endpoints without a client certificate, empty to disable
+	ShutdownTimeout time.Duration     `yaml:"shutdown_timeout"`
+	ShutdownDelay   time.Duration     `yaml:"shutdown_delay"` // how long /readyz fails before the listener is closed
+	HTTP            HTTPConfig        `yaml:"http"`
+	GRPC            GRPCConfig        `yaml:"grpc"`
+	Database        DatabaseConfig    `yaml:"database"`
+	ChangeLog       ChangeLogConfig   `yaml:"changelog"`
+	History         HistoryConfig     `yaml:"history"`
+	Trash           TrashConfig       `yaml:"trash"`
+	Identity        IdentityConfig    `yaml:"identity"`
+	Audit           AuditConfig       `yaml:"audit"`
+	Replication     ReplicationConfig `yaml:"replication"`
+	Cluster         ClusterConfig     `yaml:"cluster"`
+	Sharding        ShardingConfig    `yaml:"sharding"`
+	Limits          LimitsConfig      `yaml:"limits"`
+	Watch           WatchConfig       `yaml:"watch"`
+	Logging         LoggingConfig     `yaml:"logging"`
+	TLS             TLSConfig         `yaml:"tls"`
+}
+
+type HTTPConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+}
+
+type GRPCConfig struct {
+	Listen string `yaml:"listen"` // empty to disable the gRPC API
+}
+
+type DatabaseConfig struct {
+	Path                   string        `yaml:"path"`
+	OpenFilesCacheCapacity int           `yaml:"open_files_cache_capacity"`
+	BlockCacheMiB          int           `yaml:"block_cache_mib"`
+	WriteBufferMiB         int           `yaml:"write_buffer_mib"`
+	BloomFilterBits        int           `yaml:"bloom_filter_bits"`
+	DisableSeeksCompaction bool          `yaml:"disable_seeks_compaction"`
+	ChangeFeedSize         int           `yaml:"change_feed_size"`        // the number of recent changes kept in memory for /watch
+	ReplicationBufferSize  int           `yaml:"replication_buffer_size"` // the number of recent batches kept in memory for the followers
+	PubkeyCountInterval    time.Duration `yaml:"pubkey_count_interval"`   // how often kv_pubkeys is counted, 0 to disable
+}
+
+// ChangeLogConfig is the compaction policy of the change log used by /changes.
+// The entries older than Retention, or more than MaxEntries behind the last one of their pubkey are removed.
+type ChangeLogConfig struct {
+	Retention       time.Duration `yaml:"retention"`        // 0 to keep the entries regardless of their age
+	MaxEntries      int           `yaml:"max_entries"`      // per pubkey, 0 for no limit
+	CompactInterval time.Duration `yaml:"compact_interval"` // 0 to disable the compaction
+}
+
+// HistoryConfig is the retention policy of the value history. A version is kept while it is one of
+// the last Versions versions of its key, or newer than MaxAge. The history is disabled if both are 0.
+type HistoryConfig struct {
+	Versions      int           `yaml:"versions"`
+	MaxAge        time.Duration `yaml:"max_age"`
+	PurgeInterval time.Duration `yaml:"purge_interval"` // 0 to disable the purge
+}
+
+// TrashConfig is the soft delete of /clear: the cleared keys are kept in the trash for Retention
+// and can be restored with /restore. The trash is disabled if Retention is 0.
+type TrashConfig struct {
+	Retention     time.Duration `yaml:"retention"`
+	PurgeInterval time.Duration `yaml:"purge_interval"` // 0 to disable the purge
+}
+
+type IdentityConfig struct {
+	KeyFile string `yaml:"key_file"` // the private key of the server in hex, generated if the file does not exist
+}
+
+// AuditConfig is the Merkle tree log of all the accepted signed writes. The entries hold the hashes of the
+// requests, and the endpoints reading it are admin-only unless Public.
+type AuditConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Public  bool `yaml:"public"`
+}
+
+// ReplicationConfig makes the server a follower of the leader at Follow. The follower applies the batches
+// of the leader and serves the reads; the writes are forwarded to the leader, or rejected unless ForwardWrites.
+type ReplicationConfig struct {
+	Follow        string        `yaml:"follow"`         // the URL of the leader, empty for a leader
+	PollTimeout   time.Duration `yaml:"poll_timeout"`   // how long a request for new batches waits on the leader
+	ForwardWrites bool          `yaml:"forward_writes"` // forward the HTTP writes to the leader instead of rejecting them
+	ClientCert    string        `yaml:"client_cert"`    // the client certificate for the admin endpoints of the leader
+	ClientKey     string        `yaml:"client_key"`
+	CA            string        `yaml:"ca"` // the CA certificates of the leader, the system ones if empty
+}
+
+// ClusterConfig makes the server a node of a Raft cluster, enabled by NodeURL. The writes are committed by
+// a majority of the nodes before they are applied, the other nodes forward the HTTP writes to the leader.
+// A new cluster is started by one node with Bootstrap, the others join it through any of its nodes.
+type ClusterConfig struct {
+	NodeURL           string        `yaml:"node_url"`     // the HTTP URL of this node for the other nodes, also its Raft ID
+	RaftAddress       string        `yaml:"raft_address"` // host:port of the Raft transport, reachable by the other nodes
+	Dir               string        `yaml:"dir"`          // the Raft log and snapshots
+	Bootstrap         bool          `yaml:"bootstrap"`    // start a new cluster of this node, ignored once it has a log
+	Join              string        `yaml:"join"`         // the URL of a node to join the cluster through
+	ApplyTimeout      time.Duration `yaml:"apply_timeout"`
+	SnapshotInterval  time.Duration `yaml:"snapshot_interval"`  // how often to check if a snapshot is due
+	SnapshotThreshold int           `yaml:"snapshot_threshold"` // the number of log entries between the snapshots
+	SnapshotsRetained int           `yaml:"snapshots_retained"`
+	ClientCert        string        `yaml:"client_cert"` // the client certificate for the admin endpoints of the other nodes
+	ClientKey         string        `yaml:"client_key"`
+	CA                string        `yaml:"ca"`        // the CA certificates of the other nodes, the system ones if empty
+	RaftCert          string        `yaml:"raft_cert"` // the certificate of this node for the Raft transport, required
+	RaftKey           string        `yaml:"raft_key"`
+	RaftCA            string        `yaml:"raft_ca"` // the cluster CA, the only one signing the certificates of the nodes
+}
+
+// ShardingConfig splits the pubkeys among the shards by consistent hashing, enabled by Shards. A shard serves
+// the signed requests of its own pubkeys and forwards the others to their shard, a router forwards them all.
+type ShardingConfig struct {
+	Shards        string        `yaml:"shards"`         // comma-separated URLs of all the shards, the same list everywhere
+	Self          string        `yaml:"self"`           // the URL of this shard in Shards
+	Router        bool          `yaml:"router"`         // only forward the requests to the shards, without a database
+	VirtualNodes  int           `yaml:"virtual_nodes"`  // the points of every shard on the hash ring
+	ImportTimeout time.Duration `yaml:"import_timeout"` // the longest a request sending the keys of a pubkey may take
+	ClientCert    string        `yaml:"client_cert"`    // the client certificate for the admin endpoints of the other shards
+	ClientKey     string        `yaml:"client_key"`
+	CA            string        `yaml:"ca"` // the CA certificates of the other shards, the system ones if empty
+}
+
+type WatchConfig struct {
+	MaxTimeout time.Duration `yaml:"max_timeout"` // the longest a /watch request may wait for changes
+}
+
+type LimitsConfig struct {
+	IPRate        float64 `yaml:"ip_rate"`
+	IPBurst       int     `yaml:"ip_burst"`
+	PubkeyRate    float64 `yaml:"pubkey_rate"`
+	PubkeyBurst   int     `yaml:"pubkey_burst"`
+	Pow           string  `yaml:"pow"`
+	PowDifficulty int     `yaml:"pow_difficulty"`
+	MaxBodyBytes  int64   `yaml:"max_body_bytes"`
+}
+
+type LoggingConfig struct {
+	File     string `yaml:"file"`      // empty for stderr
+	Level    string `yaml:"level"`     // debug, info, warn or error
+	Format   string `yaml:"format"`    // json or text
+	Pubkeys  string `yaml:"pubkeys"`   // full, hash or redact
+	Keys     string `yaml:"keys"`      // full, hash or redact
+	HashSalt string `yaml:"hash_salt"` // HMAC key for the hashed pubkeys and key names
+}
+
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+const envPrefix = "KV"
+
+func DefaultConfig() Config {
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = "."
+	}
+	return Config{
+		Listen:          ":8546",
+		ShutdownTimeout: 30 * time.Second,
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			MaxHeaderBytes:    16 * 1024,
+		},
+		Database: DatabaseConfig{
+			Path:                   home + "/.kv/database",
+			OpenFilesCacheCapacity: 256,
+			BlockCacheMiB:          256 / 2,
+			WriteBufferMiB:         256 / 4, // Two of these are used internally
+			BloomFilterBits:        10,
+			DisableSeeksCompaction: true,
+			ChangeFeedSize:         10000,
+			ReplicationBufferSize:  10000,
+			PubkeyCountInterval:    5 * time.Minute,
+		},
+		Limits: LimitsConfig{
+			IPRate:        20,
+			IPBurst:       40,
+			PubkeyRate:    5,
+			PubkeyBurst:   20,
+			Pow:           PowOff,
+			PowDifficulty: 20,
+			MaxBodyBytes:  256 * 1024,
+		},
+		ChangeLog: ChangeLogConfig{
+			Retention:       30 * 24 * time.Hour,
+			CompactInterval: time.Hour,
+		},
+		History: HistoryConfig{
+			PurgeInterval: time.Hour,
+		},
+		Trash: TrashConfig{
+			PurgeInterval: time.Hour,
+		},
+		Identity: IdentityConfig{
+			KeyFile: home + "/.kv/identity.key",
+		},
+		Replication: ReplicationConfig{
+			PollTimeout:   30 * time.Second,
+			ForwardWrites: true,
+		},
+		Cluster: ClusterConfig{
+			RaftAddress:       "127.0.0.1:8548",
+			Dir:               home + "/.kv/raft",
+			ApplyTimeout:      10 * time.Second,
+			SnapshotInterval:  2 * time.Minute,
+			SnapshotThreshold: 8192,
+			SnapshotsRetained: 2,
+		},
+		Sharding: ShardingConfig{
+			VirtualNodes:  128,
+			ImportTimeout: time.Minute,
+		},
+		Watch: WatchConfig{
+			MaxTimeout: 55 * time.Second,
+		},
+		Logging: LoggingConfig{
+			Level:   "info",
+			Format:  "json",
+			Pubkeys: LogHash,
+			Keys:    LogHash,
+		},
+	}
+}
+
+// LoadFile overrides the settings present in the YAML file
+func (c *Config) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadConfig defines the command line flags on the flag set and parses the arguments, then takes the
+// settings from the defaults, the config file of -config, the environment and the flags, in this order
+func LoadConfig(flags *flag.FlagSet, args []string) (Config, bool, error) {
+	config := DefaultConfig()
+
+	configPath := flags.String("config", "", "YAML config file")
+	printSettings := flags.Bool("print-config", false, "Print the effective settings and exit")
+	portNumber := flags.Int("port", 0, "Port number, overrides the listen address")
+	flags.StringVar(&config.Listen, "listen", config.Listen, "Listen address")
+	flags.StringVar(&config.AdminListen, "admin-listen", config.AdminListen, "Listen address of the admin endpoints, served without a client certificate")
+	flags.StringVar(&config.Database.Path, "database", config.Database.Path, "Database path")
+	flags.Float64Var(&config.Limits.IPRate, "ip-rate", config.Limits.IPRate, "Requests per second allowed from one client IP, 0 to disable")
+	flags.IntVar(&config.Limits.IPBurst, "ip-burst", config.Limits.IPBurst, "Burst size for the per-IP rate limit")
+	flags.Float64Var(&config.Limits.PubkeyRate, "pubkey-rate", config.Limits.PubkeyRate, "Signed requests per second allowed for one pubkey, 0 to disable")
+	flags.IntVar(&config.Limits.PubkeyBurst, "pubkey-burst", config.Limits.PubkeyBurst, "Burst size for the per-pubkey rate limit")
+	flags.StringVar(&config.Limits.Pow, "pow", config.Limits.Pow, "Require proof of work for writes: off, new (first write from a pubkey) or all")
+	flags.IntVar(&config.Limits.PowDifficulty, "pow-difficulty", config.Limits.PowDifficulty, "Proof of work difficulty in leading zero bits")
+	flags.StringVar(&config.TLS.Cert, "tls-cert", config.TLS.Cert, "TLS certificate file, reloaded on SIGHUP")
+	flags.StringVar(&config.TLS.Key, "tls-key", config.TLS.Key, "TLS private key file, reloaded on SIGHUP")
+	flags.StringVar(&config.TLS.ClientCA, "tls-client-ca", config.TLS.ClientCA, "CA certificates to verify client certificates for the admin endpoints")
+	flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "How long to wait for in-flight requests on shutdown")
+	flags.DurationVar(&config.ShutdownDelay, "shutdown-delay", config.ShutdownDelay, "How long to report not ready before shutting down")
+	flags.StringVar(&config.Logging.File, "log-file", config.Logging.File, "Log file, stderr if empty")
+	flags.StringVar(&config.Logging.Level, "log-level", config.Logging.Level, "Log level: debug, info, warn or error")
+	flags.StringVar(&config.Replication.Follow, "follow", config.Replication.Follow, "Follow the leader at this URL, like http://leader:8546")
+	flags.StringVar(&config.Cluster.Join, "join", config.Cluster.Join, "Join the Raft cluster through the node at this URL")
+	flags.BoolVar(&config.Sharding.Router, "router", config.Sharding.Router, "Only route the signed requests to the shards, without a database")
+	if err := flags.Parse(args); err != nil {
+		return config, false, err
+	}
+
+	// the flags take precedence over the config file and the environment, so remember them and apply again
+	explicit := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	if *configPath != "" {
+		if err := config.LoadFile(*configPath); err != nil {
+			return config, false, err
+		}
+	}
+	if err := config.LoadEnv(); err != nil {
+		return config, false, err
+	}
+	for name, value := range explicit {
+		flags.Set(name, value)
+	}
+	if *portNumber != 0 {
+		config.Listen = fmt.Sprintf(":%d", *portNumber)
+	}
+	return config, *printSettings, nil
+}
+
+type EnvError struct {
+	name  string
+	value string
+	err   error
+}
+
+func (e *EnvError) Error() string {
+	return fmt.Sprintf("Wrong value %q of %s: %s", e.value, e.name, e.err.Error())
+}
+
+// LoadEnv overrides the settings from the environment. The variable names are derived from
+// the YAML keys, for example database.block_cache_mib is set by KV_DATABASE_BLOCK_CACHE_MIB.
+func (c *Config) LoadEnv() error {
+	return loadEnv(reflect.ValueOf(c).Elem(), envPrefix)
+}
+
+func loadEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := prefix + "_" + strings.ToUpper(strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0])
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := loadEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return &EnvError{name, value, err}
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err == nil {
+			field.SetInt(int64(d))
+		}
+		return err
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+type SameAddressError struct {
+	first  string
+	second string
+	addr   string
+}
+
+func (e *SameAddressError) Error() string {
+	return fmt.Sprintf("%s and %s both listen on %s", e.first, e.second, e.addr)
+}
+
+// Validate checks the settings that only make sense together
+func (c *Config) Validate() error {
+	listeners := [][2]string{{"listen", c.Listen}, {"admin_listen", c.AdminListen}, {"grpc.listen", c.GRPC.Listen}}
+	if c.Cluster.NodeURL != "" {
+		listeners = append(listeners, [2]string{"cluster.raft_address", c.Cluster.RaftAddress})
+		if c.Cluster.RaftCert == "" || c.Cluster.RaftKey == "" || c.Cluster.RaftCA == "" {
+			return &MissingRaftTLSError{}
+		}
+	}
+	for i, first := range listeners {
+		for _, second := range listeners[i+1:] {
+			if first[1] != "" && second[1] != "" && sameListenAddress(first[1], second[1]) {
+				return &SameAddressError{first[0], second[0], second[1]}
+			}
+		}
+	}
+	return nil
+}
+
+// sameListenAddress tells if two host:port addresses take the same port, an empty or unspecified host
+// listens on all the interfaces
+func sameListenAddress(a string, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	if portA != portB {
+		return false
+	}
+	all := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || (ip != nil && ip.IsUnspecified())
+	}
+	return hostA == hostB || all(hostA) || all(hostB)
+}
+
+// Print writes the settings in the config file format, without the secrets
+func (c *Config) Print(w io.Writer) error {
+	printed := *c
+	if printed.Logging.HashSalt != "" {
+		printed.Logging.HashSalt = "REDACTED"
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(&printed)
+}
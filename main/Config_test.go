@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads the settings from the YAML text, the environment variables and the arguments
+func loadTestConfig(t *testing.T, file string, env map[string]string, args ...string) (Config, error) {
+	t.Helper()
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	flags := flag.NewFlagSet("kv", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	config, _, err := LoadConfig(flags, args)
+	return config, err
+}
+
+// TestConfigPrecedence checks that the file overrides the defaults, the environment the file
+// and the flags everything, even when they are given the default value
+func TestConfigPrecedence(t *testing.T) {
+	file := `
+listen: ":1000"
+limits:
+  ip_rate: 1
+  ip_burst: 2
+  pubkey_burst: 3
+logging:
+  level: debug
+`
+	env := map[string]string{"KV_LISTEN": ":2000", "KV_LIMITS_IP_BURST": "4", "KV_LIMITS_PUBKEY_BURST": "5"}
+	config, err := loadTestConfig(t, file, env, "-listen", ":3000", "-pubkey-burst", "20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultConfig()
+	tests := []struct {
+		setting  string
+		value    any
+		expected any
+	}{
+		{"listen, from the flag", config.Listen, ":3000"},
+		{"limits.pubkey_burst, from the flag with the default value", config.Limits.PubkeyBurst, 20},
+		{"limits.ip_burst, from the environment", config.Limits.IPBurst, 4},
+		{"limits.ip_rate, from the file", config.Limits.IPRate, 1.0},
+		{"logging.level, from the file", config.Logging.Level, "debug"},
+		{"limits.pubkey_rate, the default", config.Limits.PubkeyRate, defaults.Limits.PubkeyRate},
+		{"database.path, the default", config.Database.Path, defaults.Database.Path},
+	}
+	for _, test := range tests {
+		if test.value != test.expected {
+			t.Errorf("%s: %v, expected %v", test.setting, test.value, test.expected)
+		}
+	}
+
+	config, err = loadTestConfig(t, "", nil, "-listen", ":3000", "-port", "4000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":4000" {
+		t.Errorf("listen %q with -port, expected :4000", config.Listen)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+	}{
+		{name: "unknown key", file: "listen: \":1000\"\nlisten_address: \":2000\"\n"},
+		{name: "unknown nested key", file: "limits:\n  ip_rates: 1\n"},
+		{name: "wrong type", file: "limits:\n  ip_burst: many\n"},
+		{name: "wrong environment value", env: map[string]string{"KV_LIMITS_IP_RATE": "fast"}},
+		{name: "wrong environment duration", env: map[string]string{"KV_SHUTDOWN_TIMEOUT": "30"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := loadTestConfig(t, test.file, test.env); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+	var envErr *EnvError
+	if _, err := loadTestConfig(t, "", map[string]string{"KV_LIMITS_IP_RATE": "fast"}); !errors.As(err, &envErr) ||
+		envErr.name != "KV_LIMITS_IP_RATE" {
+		t.Errorf("error %v, expected the wrong KV_LIMITS_IP_RATE", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(config *Config)
+		err       error
+	}{
+		{
+			name:      "defaults",
+			configure: func(config *Config) {},
+		},
+		{
+			name:      "grpc on the listen port",
+			configure: func(config *Config) { config.Listen, config.GRPC.Listen = ":8546", "127.0.0.1:8546" },
+			err:       &SameAddressError{},
+		},
+		{
+			name:      "admin on the listen port",
+			configure: func(config *Config) { config.Listen, config.AdminListen = "0.0.0.0:8546", "127.0.0.1:8546" },
+			err:       &SameAddressError{},
+		},
+		{
+			name:      "same port on other interfaces",
+			configure: func(config *Config) { config.Listen, config.AdminListen = "192.0.2.1:8546", "127.0.0.1:8546" },
+		},
+		{
+			name: "raft on the grpc port",
+			configure: func(config *Config) {
+				config.GRPC.Listen, config.Cluster.NodeURL, config.Cluster.RaftAddress = ":8547", "http://node1:8546", "127.0.0.1:8547"
+				config.Cluster.RaftCert, config.Cluster.RaftKey, config.Cluster.RaftCA = "cert.pem", "key.pem", "ca.pem"
+			},
+			err: &SameAddressError{},
+		},
+		{
+			name: "raft without tls",
+			configure: func(config *Config) {
+				config.Cluster.NodeURL, config.Cluster.RaftCert, config.Cluster.RaftKey = "http://node1:8546", "cert.pem", "key.pem"
+			},
+			err: &MissingRaftTLSError{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			test.configure(&config)
+			err := config.Validate()
+			switch expected := test.err.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("error %v", err)
+				}
+			case *SameAddressError:
+				if !errors.As(err, &expected) {
+					t.Errorf("error %v, expected the same address", err)
+				}
+			case *MissingRaftTLSError:
+				if !errors.As(err, &expected) {
+					t.Errorf("error %v, expected the missing Raft TLS", err)
+				}
+			}
+		})
+	}
+}
+
+// TestConfigPrint checks that the printed settings can be loaded again, without the hash salt
+func TestConfigPrint(t *testing.T) {
+	config := DefaultConfig()
+	config.Logging.HashSalt = "secret salt"
+	config.Limits.IPBurst = 7
+	var printed bytes.Buffer
+	if err := config.Print(&printed); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(printed.String(), "secret salt") || !strings.Contains(printed.String(), "REDACTED") {
+		t.Errorf("the salt is not redacted:\n%s", printed.String())
+	}
+	if config.Logging.HashSalt != "secret salt" {
+		t.Error("Print changed the salt of the config")
+	}
+	loaded, err := loadTestConfig(t, printed.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Limits.IPBurst != 7 {
+		t.Errorf("ip_burst %d loaded again, expected 7", loaded.Limits.IPBurst)
+	}
+}
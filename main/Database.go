@@ -1,86 +1,319 @@
 package main
 
 import (
+	"bytes"
 	"github.com/ndv/kv/bitcurve"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// the data keys start with a 33-byte compressed pubkey, so their first byte is either 2 or 3
+var dataRange = &util.Range{Start: []byte{2}, Limit: []byte{4}}
+
+// the keys starting with 0 are reserved for the server itself
+var readyCheckKey = []byte("\x00ready")
+
 type Database struct {
-	db       *leveldb.DB
-	quitLock sync.Mutex      // Mutex protecting the quit channel access
+	db          *leveldb.DB
+	path        string
+	quitLock    sync.Mutex      // Mutex protecting the quit channel access
+	pubkeyLocks [256]sync.Mutex // Serialize the writes of a pubkey, so that each one builds on the previous one
+	quit        chan struct{}
+	feed        *ChangeFeed
+	history     HistoryConfig
+	trash       TrashConfig
+	audit       atomic.Pointer[auditHead] // nil if the audit log is disabled
+	replication *ReplicationLog
+	cluster     atomic.Pointer[Cluster] // nil unless the server is a node of a Raft cluster
+	shards      atomic.Pointer[Shards]  // nil unless the server is a shard
+	following   atomic.Bool             // the server is a replication follower, writing only the batches of its leader
+	pubkeys     atomic.Int64            // the last count of the pubkeys for the metrics, -1 before the first one
+	checkLock   sync.Mutex              // protects the last result of Check
+	checked     time.Time
+	checkErr    error
 }
 
-func NewDatabase(path string) (*Database, error) {
-	db, err := leveldb.OpenFile(path, &opt.Options{
-		OpenFilesCacheCapacity: 256,
-		BlockCacheCapacity:     256 / 2 * opt.MiB,
-		WriteBuffer:            256 / 4 * opt.MiB, // Two of these are used internally
-		Filter:                 filter.NewBloomFilter(10),
-		DisableSeeksCompaction: true,
+func NewDatabase(config DatabaseConfig) (*Database, error) {
+	db, err := leveldb.OpenFile(config.Path, &opt.Options{
+		OpenFilesCacheCapacity: config.OpenFilesCacheCapacity,
+		BlockCacheCapacity:     config.BlockCacheMiB * opt.MiB,
+		WriteBuffer:            config.WriteBufferMiB * opt.MiB, // Two of these are used internally
+		Filter:                 filter.NewBloomFilter(config.BloomFilterBits),
+		DisableSeeksCompaction: config.DisableSeeksCompaction,
 	})
 	if _, corrupted := err.(*errors.ErrCorrupted); corrupted {
-		db, err = leveldb.RecoverFile(path, nil)
+		db, err = leveldb.RecoverFile(config.Path, nil)
+	}
+	if err != nil {
+		return nil, err
 	}
+	seq, err := readReplicationSeq(db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	if err = indexAllLeaves(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	replicationSequence.Set(float64(seq))
 	// Assemble the wrapper with all the registered metrics
-	return &Database{db: db}, nil
+	database := &Database{
+		db:          db,
+		path:        config.Path,
+		quit:        make(chan struct{}),
+		feed:        NewChangeFeed(config.ChangeFeedSize),
+		replication: NewReplicationLog(seq, config.ReplicationBufferSize),
+	}
+	database.pubkeys.Store(-1)
+	if config.PubkeyCountInterval > 0 {
+		go database.countPubkeysEvery(config.PubkeyCountInterval)
+	}
+	return database, nil
+}
+
+// StartCompaction starts the periodic compaction of the change log, if enabled
+func (db *Database) StartCompaction(config ChangeLogConfig) {
+	if config.CompactInterval > 0 && (config.Retention > 0 || config.MaxEntries > 0) {
+		go db.compactChangeLogEvery(config)
+	}
 }
 
 func (db *Database) Close() error {
 	db.quitLock.Lock()
 	defer db.quitLock.Unlock()
+	select {
+	case <-db.quit:
+	default:
+		close(db.quit)
+	}
 	return db.db.Close()
 }
 
-func (db *Database) Put(pubkey bitcurve.Point, key []byte, value []byte) error {
-	key = append(bitcurve.MarshallCompressedPoint(pubkey), key...)
-	return db.db.Put(key, value, nil)
+// commit writes the batch together with the change log entries of the events and the audit log entry
+// of the signed request, if not nil, and publishes the events. It returns the sequence number of the first event.
+func (db *Database) commit(batch *leveldb.Batch, pubkey []byte, signed *SignedRequest, events ...ChangeEvent) (uint64, error) {
+	unlock, err := db.lockWrite(pubkey)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	return db.commitLocked(batch, pubkey, signed, events...)
+}
+
+// commitLocked is commit for the callers already holding the write lock of the pubkey
+func (db *Database) commitLocked(batch *leveldb.Batch, pubkey []byte, signed *SignedRequest, events ...ChangeEvent) (uint64, error) {
+	first, err := db.logChanges(batch, pubkey, events)
+	if err != nil {
+		return 0, err
+	}
+	for i := range events {
+		events[i].Seq = first + uint64(i)
+	}
+	if err := db.recordHistory(batch, pubkey, first, events); err != nil {
+		return 0, err
+	}
+	if err := db.storeRoot(batch, pubkey, first+uint64(len(events))-1); err != nil {
+		return 0, err
+	}
+	if err := db.write(batch, pubkey, signed, events...); err != nil {
+		return 0, err
+	}
+	return first, nil
 }
 
-type Pair struct {
-	key, value []byte
+// the result of a check is reused for this long, so that the probes cannot make unbounded writes
+const checkCacheTime = 5 * time.Second
+
+// Check makes a test write and read to make sure the database is usable, at most once every checkCacheTime
+func (db *Database) Check() error {
+	db.checkLock.Lock()
+	defer db.checkLock.Unlock()
+	if time.Since(db.checked) < checkCacheTime {
+		return db.checkErr
+	}
+	db.checkErr = db.check()
+	db.checked = time.Now()
+	return db.checkErr
+}
+
+func (db *Database) check() error {
+	value := []byte(time.Now().String())
+	err := db.db.Put(readyCheckKey, value, nil)
+	if err != nil {
+		return err
+	}
+	read, err := db.db.Get(readyCheckKey, nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, value) {
+		return &CheckFailedError{}
+	}
+	return nil
+}
+
+type CheckFailedError struct{}
+
+func (e *CheckFailedError) Error() string {
+	return "Read a different value than written"
+}
+
+// Put writes the value and returns its version, the sequence number of the change
+func (db *Database) Put(pubkey bitcurve.Point, key []byte, value []byte, signed *SignedRequest) (uint64, error) {
+	prefix := bitcurve.MarshallCompressedPoint(pubkey)
+	batch := new(leveldb.Batch)
+	batch.Put(append(append([]byte{}, prefix...), key...), value)
+	return db.commit(batch, prefix, signed, ChangeEvent{Type: EventPut, Key: key, Value: value})
 }
 
-func copyBytes(bytes []byte) []byte {
-	new := make([]byte, len(bytes))
-	copy(new, bytes)
-	return new
+// Feed returns the feed of the changes made through this database
+func (db *Database) Feed() *ChangeFeed {
+	return db.feed
 }
 
-func (db *Database) GetAll(pubkey bitcurve.Point) ([]Pair, error) {
+// HasPubkey returns true if there is at least one key stored for the pubkey
+func (db *Database) HasPubkey(pubkey bitcurve.Point) (bool, error) {
 	prefix := bitcurve.MarshallCompressedPoint(pubkey)
 	iterator := db.db.NewIterator(util.BytesPrefix(prefix), nil)
 	defer iterator.Release()
-	var result = make([]Pair, 0)
-	for iterator.Next() {
-		result = append(result, Pair{copyBytes(iterator.Key()[33:]), copyBytes(iterator.Value())})
+	found := iterator.First()
+	return found, iterator.Error()
+}
+
+// CountPubkeys returns the number of distinct pubkeys having at least one stored key.
+// It seeks over the keys of every pubkey, so it costs one seek per pubkey.
+func (db *Database) CountPubkeys() (int, error) {
+	iterator := db.db.NewIterator(dataRange, nil)
+	defer iterator.Release()
+	count := 0
+	for ok := iterator.First(); ok && len(iterator.Key()) >= 33; ok = iterator.Seek(util.BytesPrefix(iterator.Key()[:33]).Limit) {
+		count++
+	}
+	return count, iterator.Error()
+}
+
+// countPubkeysEvery counts the pubkeys for the metrics in the background, as a count costs a seek per pubkey
+func (db *Database) countPubkeysEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		count, err := db.CountPubkeys()
+		if err != nil {
+			slog.Error("Cannot count the pubkeys", "error", err)
+		} else {
+			db.pubkeys.Store(int64(count))
+			slog.Debug("Pubkeys counted", "pubkeys", count, "duration", time.Since(start).String())
+		}
+		select {
+		case <-db.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (db *Database) Stats(stats *leveldb.DBStats) error {
+	return db.db.Stats(stats)
+}
+
+// Get returns the value of the key, found is false if there is no such key
+func (db *Database) Get(pubkey bitcurve.Point, key []byte) (value []byte, found bool, err error) {
+	key = append(bitcurve.MarshallCompressedPoint(pubkey), key...)
+	value, err = db.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+type BatchOp struct {
+	Delete bool
+	Key    []byte
+	Value  []byte // ignored for Delete
+}
+
+// Batch applies all the operations atomically and returns the sequence number of the last one
+func (db *Database) Batch(pubkey bitcurve.Point, ops []BatchOp, signed *SignedRequest) (uint64, error) {
+	prefix := bitcurve.MarshallCompressedPoint(pubkey)
+	batch := new(leveldb.Batch)
+	events := make([]ChangeEvent, len(ops))
+	for i, op := range ops {
+		key := append(append([]byte{}, prefix...), op.Key...)
+		if op.Delete {
+			batch.Delete(key)
+			events[i] = ChangeEvent{Type: EventDelete, Key: op.Key}
+		} else {
+			batch.Put(key, op.Value)
+			events[i] = ChangeEvent{Type: EventPut, Key: op.Key, Value: op.Value}
+		}
+	}
+	first, err := db.commit(batch, prefix, signed, events...)
+	if err != nil {
+		return 0, err
 	}
-	return result, nil
+	return first + uint64(len(events)) - 1, nil
 }
 
-func (db *Database) Clear(pubkey bitcurve.Point) error {
+// ForEach calls fn for every key of the pubkey in the key order, stopping at the first error.
+// The key and value slices are only valid until fn returns.
+func (db *Database) ForEach(pubkey bitcurve.Point, fn func(key []byte, value []byte) error) error {
 	prefix := bitcurve.MarshallCompressedPoint(pubkey)
 	iterator := db.db.NewIterator(util.BytesPrefix(prefix), nil)
 	defer iterator.Release()
-	if !iterator.First() {
-		return nil
+	for iterator.Next() {
+		if err := fn(iterator.Key()[33:], iterator.Value()); err != nil {
+			return err
+		}
 	}
-	err := db.db.Delete(iterator.Key(), nil)
+	return iterator.Error()
+}
+
+// Clear deletes all the keys of the pubkey atomically, moving them to the trash if it is enabled.
+// The write lock of the pubkey is held from the iteration to the write, so that a concurrent put either goes
+// before the clear or after it. A clear of no keys is only added to the audit log.
+// It returns the sequence number of the clear, or the current one if there was nothing to clear.
+func (db *Database) Clear(pubkey bitcurve.Point, signed *SignedRequest) (uint64, error) {
+	prefix := bitcurve.MarshallCompressedPoint(pubkey)
+	unlock, err := db.lockWrite(prefix)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer unlock()
+
+	iterator := db.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iterator.Release()
+	batch := new(leveldb.Batch)
+	generation := trashGenerationPrefix(prefix, uint64(time.Now().UnixNano()))
 	for iterator.Next() {
-		err = db.db.Delete(iterator.Key(), nil)
+		batch.Delete(iterator.Key())
+		if db.trash.enabled() {
+			batch.Put(append(append([]byte{}, generation...), iterator.Key()[33:]...), iterator.Value())
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		return 0, err
+	}
+	if batch.Len() == 0 {
+		seq, err := lastSeq(db.db, prefix)
 		if err != nil {
-			return err
+			return 0, err
+		}
+		if signed == nil || db.audit.Load() == nil {
+			return seq, nil
 		}
+		if err := db.write(batch, prefix, signed); err != nil {
+			return 0, err
+		}
+		return seq, nil
 	}
-	return nil
+	return db.commitLocked(batch, prefix, signed, ChangeEvent{Type: EventClear})
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestClearRace clears a pubkey while another goroutine writes two of its keys in one batch, and checks
+// that every clear moved both keys or none to the trash, with the same value, and that the change log
+// numbers the changes without gaps
+func TestClearRace(t *testing.T) {
+	newTestServer(t, func(config *Config) { config.Trash.Retention = time.Hour })
+	key := newTestKey(t, 1)
+	const writes, clears = 300, 50
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			value := []byte(fmt.Sprint(i))
+			ops := []BatchOp{{Key: []byte("a"), Value: value}, {Key: []byte("b"), Value: value}}
+			if _, err := db.Batch(key.point(), ops, nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < clears; i++ {
+			if _, err := db.Clear(key.point(), nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// the trash values of every generation, by key
+	generations := make(map[uint64]map[string]string)
+	iterator := db.db.NewIterator(util.BytesPrefix(trashPubkeyPrefix(key.pubkey)), nil)
+	for iterator.Next() {
+		generation := binary.BigEndian.Uint64(iterator.Key()[1+33:])
+		if generations[generation] == nil {
+			generations[generation] = make(map[string]string)
+		}
+		generations[generation][string(iterator.Key()[1+33+8:])] = string(iterator.Value())
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		t.Fatal(err)
+	}
+	for generation, keys := range generations {
+		if len(keys) != 2 || keys["a"] != keys["b"] {
+			t.Errorf("generation %d has %v, expected a and b with the same value", generation, keys)
+		}
+	}
+
+	a, foundA, err := db.Get(key.point(), []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, foundB, err := db.Get(key.point(), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundA != foundB || string(a) != string(b) {
+		t.Errorf("a=%q (%v) and b=%q (%v) after the clears", a, foundA, b, foundB)
+	}
+
+	last, err := lastSeq(db.db, key.pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, clearEntries := uint64(0), 0
+	iterator = db.db.NewIterator(util.BytesPrefix(append([]byte{changeLogPrefix}, key.pubkey...)), nil)
+	for iterator.Next() {
+		seq++
+		if entry := binary.BigEndian.Uint64(iterator.Key()[1+33:]); entry != seq {
+			t.Fatalf("change %d has the sequence number %d", seq, entry)
+		}
+		event, _, err := decodeChange(iterator.Value())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Type == EventClear {
+			clearEntries++
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if seq != last || last != writes*2+uint64(clearEntries) || clearEntries != len(generations) {
+		t.Errorf("%d changes up to %d with %d clears for %d trash generations, expected %d puts", seq, last,
+			clearEntries, len(generations), writes*2)
+	}
+	size := uint64(0)
+	if foundA {
+		size = 2
+	}
+	checkRoot(t, db, key, size)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The response formats of the endpoints returning entries, selected by the Accept header
+const (
+	FormatJSON   = "application/json"
+	FormatCBOR   = "application/cbor"
+	FormatBinary = "application/x-kv-binary"
+)
+
+// EntryWriter streams a list of key/value entries in one of the response formats
+type EntryWriter interface {
+	begin() error
+	entry(key []byte, value []byte) error
+	end() error
+	// fail reports an error after some entries have been written, if the format allows that
+	fail(err *APIError) error
+}
+
+func newEntryWriter(w io.Writer, format string, encoding string) EntryWriter {
+	switch format {
+	case FormatCBOR:
+		return newCBOREntryWriter(w)
+	case FormatBinary:
+		return newBinaryEntryWriter(w)
+	}
+	return newJSONEntryWriter(w, encoding)
+}
+
+// negotiateFormat picks the response format from the Accept header, JSON if there is no preference.
+// It returns an empty string if none of the accepted types is supported.
+func negotiateFormat(req *http.Request) string {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return FormatJSON
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		var format string
+		switch mediaType {
+		case FormatJSON, FormatCBOR, FormatBinary:
+			format = mediaType
+		case "*/*", "application/*":
+			format = FormatJSON
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// The binary format uses the same little-endian length-prefix framing as the requests:
+//
+//	entry: 0x01, uint16 key size, key, uint32 value size, value
+//	end:   0x00
+//	error: 0xFF, uint16 code size, code, uint16 message size, message
+const (
+	binaryEnd   = 0x00
+	binaryEntry = 0x01
+	binaryError = 0xFF
+)
+
+type binaryEntryWriter struct {
+	w *bufio.Writer
+}
+
+func newBinaryEntryWriter(w io.Writer) *binaryEntryWriter {
+	return &binaryEntryWriter{w: bufio.NewWriter(w)}
+}
+
+func (b *binaryEntryWriter) begin() error {
+	return nil
+}
+
+func (b *binaryEntryWriter) entry(key []byte, value []byte) error {
+	b.w.WriteByte(binaryEntry)
+	b.w.Write(writeUint16(uint16(len(key))))
+	b.w.Write(key)
+	b.w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(value))))
+	_, err := b.w.Write(value)
+	return err
+}
+
+func (b *binaryEntryWriter) end() error {
+	b.w.WriteByte(binaryEnd)
+	return b.w.Flush()
+}
+
+func (b *binaryEntryWriter) fail(err *APIError) error {
+	b.w.WriteByte(binaryError)
+	b.w.Write(writeUint16(uint16(len(err.Code))))
+	b.w.WriteString(err.Code)
+	b.w.Write(writeUint16(uint16(len(err.Message))))
+	b.w.WriteString(err.Message)
+	return b.w.Flush()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Error codes returned to the clients. They are stable, clients may rely on them.
+const (
+	ErrBadRequest           = "bad_request"
+	ErrBadPubkey            = "bad_pubkey"
+	ErrTruncatedBody        = "truncated_body"
+	ErrBodyTooLarge         = "body_too_large"
+	ErrBadSignature         = "bad_signature"
+	ErrPowRequired          = "pow_required"
+	ErrRateLimited          = "rate_limited"
+	ErrMethodNotAllowed     = "method_not_allowed"
+	ErrUnsupportedMediaType = "unsupported_media_type"
+	ErrNotAcceptable        = "not_acceptable"
+	ErrForbidden            = "forbidden"
+	ErrNotFound             = "not_found"
+	ErrSequenceExpired      = "sequence_expired"
+	ErrReadOnly             = "read_only"
+	ErrNoLeader             = "no_leader"
+	ErrWrongShard           = "wrong_shard"
+	ErrStorage              = "storage_error"
+	ErrInternal             = "internal_error"
+)
+
+// APIError is the error model of all endpoints, sent as {"error": {"code": ..., "message": ..., "details": ...}}
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func NewAPIError(status int, code string, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// WithDetail returns a copy of the error with one more detail
+func (e *APIError) WithDetail(name string, value interface{}) *APIError {
+	details := make(map[string]interface{}, len(e.Details)+1)
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	details[name] = value
+	return &APIError{Status: e.Status, Code: e.Code, Message: e.Message, Details: details}
+}
+
+// toAPIError maps the errors of request parsing to the error model
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	var wrongPubkey *WrongPubkeyError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &wrongPubkey):
+		return NewAPIError(http.StatusBadRequest, ErrBadPubkey, err.Error())
+	case errors.As(err, &tooLarge):
+		return NewAPIError(http.StatusRequestEntityTooLarge, ErrBodyTooLarge, "Request body too large").
+			WithDetail("limit", tooLarge.Limit)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return NewAPIError(http.StatusBadRequest, ErrTruncatedBody, "Request body is truncated")
+	}
+	return NewAPIError(http.StatusBadRequest, ErrBadRequest, err.Error())
+}
+
+func writeError(w http.ResponseWriter, req *http.Request, err *APIError) {
+	logger := requestLogger(req)
+	if err.Status >= 500 {
+		logger.Error("Request failed", "code", err.Code, "error", err.Message, "details", err.Details)
+	} else {
+		logger.Info("Request rejected", "code", err.Code, "error", err.Message, "details", err.Details)
+	}
+
+	// the error is sent in the format the client asked for, so that it can always be parsed
+	switch negotiateFormat(req) {
+	case FormatBinary:
+		w.Header().Set("Content-Type", FormatBinary)
+		w.WriteHeader(err.Status)
+		out := newBinaryEntryWriter(w)
+		out.fail(err)
+	case FormatCBOR:
+		w.Header().Set("Content-Type", FormatCBOR)
+		w.WriteHeader(err.Status)
+		writeCBORError(w, err)
+	default:
+		writeJSON(w, err.Status, map[string]*APIError{"error": err})
+	}
+}
+
+// httpError responds with the error of parsing the request, msg tells at which stage it happened
+func httpError(err error, w http.ResponseWriter, req *http.Request, msg string) bool {
+	if err == nil {
+		return false
+	}
+	writeError(w, req, toAPIError(err).WithDetail("stage", msg))
+	return true
+}
+
+// databaseError responds with the error of a database operation
+func databaseError(err error, w http.ResponseWriter, req *http.Request, msg string) bool {
+	if err == nil {
+		return false
+	}
+	var notLeader *NotLeaderError
+	if errors.As(err, &notLeader) {
+		writeError(w, req, noLeaderError(notLeader).WithDetail("stage", msg))
+		return true
+	}
+	var wrongShard *WrongShardError
+	if errors.As(err, &wrongShard) {
+		writeError(w, req, wrongShardError(wrongShard.owner))
+		return true
+	}
+	requestLogger(req).Error("Database error", "error", err.Error(), "stage", msg)
+	writeError(w, req, NewAPIError(http.StatusInternalServerError, ErrStorage, "Storage error").WithDetail("stage", msg))
+	return true
+}
+
+// receiptError responds with the error of signing the receipt of a write
+func receiptError(err error, w http.ResponseWriter, req *http.Request) bool {
+	if err == nil {
+		return false
+	}
+	writeError(w, req, NewAPIError(http.StatusInternalServerError, ErrInternal, err.Error()).
+		WithDetail("stage", "signing the receipt"))
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestErrorResponses checks the status, the code and the details of the main errors of the signed endpoints
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(config *Config)
+		requests  int // the same request is sent this many times, the last response is checked
+		body      func(t *testing.T, key *testKey) []byte
+		status    int
+		code      string
+		detail    string
+	}{
+		{
+			name: "bad signature",
+			body: func(t *testing.T, key *testKey) []byte {
+				return key.body(t, putMessage([]byte("key"), []byte("signed")), putMessage([]byte("key"), []byte("sent")))
+			},
+			status: http.StatusForbidden,
+			code:   ErrBadSignature,
+		},
+		{
+			name:      "rate limited",
+			configure: func(config *Config) { config.Limits.IPRate, config.Limits.IPBurst = 0.001, 1 },
+			requests:  2,
+			body:      func(t *testing.T, key *testKey) []byte { return key.putRequest(t, "key", "value") },
+			status:    http.StatusTooManyRequests,
+			code:      ErrRateLimited,
+			detail:    "retry_after",
+		},
+		{
+			name:      "proof of work required",
+			configure: func(config *Config) { config.Limits.Pow, config.Limits.PowDifficulty = PowAll, 8 },
+			body:      func(t *testing.T, key *testKey) []byte { return key.putRequest(t, "key", "value") },
+			status:    http.StatusPreconditionRequired,
+			code:      ErrPowRequired,
+			detail:    "difficulty",
+		},
+		{
+			name:      "body too large",
+			configure: func(config *Config) { config.Limits.MaxBodyBytes = 200 },
+			body: func(t *testing.T, key *testKey) []byte {
+				return key.putRequest(t, "key", string(bytes.Repeat([]byte{'v'}, 500)))
+			},
+			status: http.StatusRequestEntityTooLarge,
+			code:   ErrBodyTooLarge,
+			detail: "limit",
+		},
+		{
+			name:   "truncated body",
+			body:   func(t *testing.T, key *testKey) []byte { return key.putRequest(t, "key", "value")[:105] },
+			status: http.StatusBadRequest,
+			code:   ErrTruncatedBody,
+			detail: "stage",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, test.configure)
+			key := newTestKey(t, 1)
+			var status int
+			var body []byte
+			for i := 0; i < max(test.requests, 1); i++ {
+				status, body = post(t, server.URL+"/put", test.body(t, key), nil)
+			}
+			if status != test.status {
+				t.Fatalf("status %d, expected %d: %s", status, test.status, body)
+			}
+			var response struct {
+				Error *APIError `json:"error"`
+			}
+			if err := json.Unmarshal(body, &response); err != nil || response.Error == nil {
+				t.Fatalf("not an error response: %s", body)
+			}
+			if response.Error.Code != test.code {
+				t.Errorf("code %q, expected %q", response.Error.Code, test.code)
+			}
+			if response.Error.Message == "" {
+				t.Error("no message")
+			}
+			if _, ok := response.Error.Details[test.detail]; test.detail != "" && !ok {
+				t.Errorf("no %s in the details %v", test.detail, response.Error.Details)
+			}
+		})
+	}
+}
+
+// TestErrorFormats checks that an error is sent in the format the client accepts
+func TestErrorFormats(t *testing.T) {
+	server := newTestServer(t, nil)
+	key := newTestKey(t, 1)
+	body := key.body(t, []byte("something else"), nil)
+	for _, format := range []string{FormatJSON, FormatCBOR, FormatBinary} {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/getAll", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", binaryContentType)
+		req.Header.Set("Accept", format)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Content-Type") != format {
+			t.Errorf("%s: status %d and %s, expected 403 and %s", format, resp.StatusCode, resp.Header.Get("Content-Type"), format)
+		}
+	}
+}
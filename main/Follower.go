@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"github.com/syndtr/goleveldb/leveldb"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// follower is set when the server replicates another one, the writes are then forwarded or rejected
+var follower *Follower
+
+// Follower applies the batches of the leader to the local database
+type Follower struct {
+	db      *Database
+	leader  *url.URL
+	client  *http.Client
+	config  ReplicationConfig
+	forward *httputil.ReverseProxy
+}
+
+type WrongLeaderError struct {
+	leader string
+}
+
+func (e *WrongLeaderError) Error() string {
+	return "Wrong leader URL " + e.leader + ", expected http:// or https://"
+}
+
+type WrongCAError struct {
+	path string
+}
+
+func (e *WrongCAError) Error() string {
+	return "No certificates in " + e.path
+}
+
+type TruncatedSnapshotError struct{}
+
+func (e *TruncatedSnapshotError) Error() string {
+	return "The snapshot ended before its end marker"
+}
+
+type LeaderError struct {
+	status int
+}
+
+func (e *LeaderError) Error() string {
+	return "The leader responded with " + strconv.Itoa(e.status)
+}
+
+func NewFollower(db *Database, config ReplicationConfig) (*Follower, error) {
+	leader, err := url.Parse(config.Follow)
+	if err != nil || (leader.Scheme != "http" && leader.Scheme != "https") || leader.Host == "" {
+		return nil, &WrongLeaderError{config.Follow}
+	}
+	transport, err := newAdminTransport(config.ClientCert, config.ClientKey, config.CA)
+	if err != nil {
+		return nil, err
+	}
+	forward := httputil.NewSingleHostReverseProxy(leader)
+	forward.Transport = transport
+	forwardClientIP(forward)
+	return &Follower{db: db, leader: leader, client: &http.Client{Transport: transport}, config: config, forward: forward}, nil
+}
+
+// newAdminTransport returns the transport for the admin endpoints of another server, with the client
+// certificate if clientCert is not empty and trusting only the CA certificates if ca is not empty
+func newAdminTransport(clientCert string, clientKey string, ca string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if clientCert != "" || ca != "" {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if clientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, &WrongCAError{ca}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	return transport, nil
+}
+
+// forwardWrite sends a signed write to the leader, or rejects it if the forwarding is disabled
+func forwardWrite(w http.ResponseWriter, req *http.Request) {
+	if !follower.config.ForwardWrites {
+		writeError(w, req, readOnlyError())
+		return
+	}
+	requestLogger(req).Debug("Forwarding to the leader", "leader", follower.leader.String())
+	follower.forward.ServeHTTP(w, req)
+}
+
+func readOnlyError() *APIError {
+	return NewAPIError(http.StatusForbidden, ErrReadOnly, "This server is a read-only follower").
+		WithDetail("leader", follower.leader.String())
+}
+
+// ApplyReplicated writes a batch of the leader, which carries its own sequence number
+func (db *Database) ApplyReplicated(replicated ReplicatedBatch) error {
+	batch := new(leveldb.Batch)
+	if err := batch.Load(replicated.Data); err != nil {
+		return err
+	}
+	db.replication.lock.Lock()
+	defer db.replication.lock.Unlock()
+	if err := db.db.Write(batch, nil); err != nil {
+		return err
+	}
+	db.replication.appendLocked(replicated)
+	replicationSequence.Set(float64(replicated.Seq))
+	if db.audit.Load() != nil {
+		if err := db.loadAuditHead(); err != nil {
+			return err
+		}
+	}
+	// the watchers of the follower see the changes of the leader, with the values written by the batch
+	replay := &replicatedEvents{values: make(map[string][]byte)}
+	if err := batch.Replay(replay); err != nil {
+		return err
+	}
+	for _, pubkey := range replay.order {
+		events := replay.events[pubkey]
+		for i, event := range events {
+			if event.Type == EventPut {
+				events[i].Value = replay.values[pubkey+string(event.Key)]
+			}
+		}
+		db.feed.publish([]byte(pubkey), events...)
+	}
+	return nil
+}
+
+// replicatedEvents collects the change events of a batch by pubkey from its change log entries,
+// and the values of the data keys it puts
+type replicatedEvents struct {
+	order  []string
+	events map[string][]ChangeEvent
+	values map[string][]byte
+}
+
+func (r *replicatedEvents) Put(key, value []byte) {
+	if isDataKey(key) {
+		r.values[string(key)] = append([]byte{}, value...)
+		return
+	}
+	if len(key) != 1+33+8 || key[0] != changeLogPrefix {
+		return
+	}
+	event, _, err := decodeChange(value)
+	if err != nil {
+		return
+	}
+	if r.events == nil {
+		r.events = make(map[string][]ChangeEvent)
+	}
+	pubkey := string(key[1 : 1+33])
+	if _, ok := r.events[pubkey]; !ok {
+		r.order = append(r.order, pubkey)
+	}
+	event.Seq = binary.BigEndian.Uint64(key[1+33:])
+	event.Key = append([]byte{}, event.Key...)
+	r.events[pubkey] = append(r.events[pubkey], event)
+}
+
+func (r *replicatedEvents) Delete(key []byte) {}
+
+// snapshotPending returns true if loading a snapshot has been interrupted, the database is then inconsistent
+func (db *Database) snapshotPending() (bool, error) {
+	return db.db.Has(replicationSnapshotKey, nil)
+}
+
+// LoadSnapshot replaces the whole database with the snapshot written by WriteSnapshot
+// and returns its replication sequence number. The snapshot is read into a staging database next to
+// this one first, so that the locks are only held while the keys are swapped, not during the download.
+func (db *Database) LoadSnapshot(r io.Reader) (uint64, error) {
+	stagingPath := db.path + ".snapshot"
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return 0, err
+	}
+	staging, err := leveldb.OpenFile(stagingPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(stagingPath)
+	defer staging.Close()
+
+	batch := new(leveldb.Batch)
+	flush := func(to *leveldb.DB, limit int) error {
+		if batch.Len() < limit {
+			return nil
+		}
+		err := to.Write(batch, nil)
+		batch.Reset()
+		return err
+	}
+	in := bufio.NewReaderSize(r, 64*1024)
+	for {
+		key, err := readSnapshotBytes(in)
+		if err != nil {
+			return 0, err
+		}
+		if len(key) == 0 {
+			break
+		}
+		value, err := readSnapshotBytes(in)
+		if err != nil {
+			return 0, err
+		}
+		batch.Put(key, value)
+		if err := flush(staging, 1000); err != nil {
+			return 0, err
+		}
+	}
+	if err := flush(staging, 1); err != nil {
+		return 0, err
+	}
+
+	db.replication.lock.Lock()
+	defer db.replication.lock.Unlock()
+
+	if err := db.db.Put(replicationSnapshotKey, nil, nil); err != nil {
+		return 0, err
+	}
+	iterator := db.db.NewIterator(nil, nil)
+	for iterator.Next() {
+		key := iterator.Key()
+		if string(key) == string(readyCheckKey) || string(key) == string(replicationSnapshotKey) {
+			continue
+		}
+		batch.Delete(append([]byte{}, key...))
+		if err := flush(db.db, 1000); err != nil {
+			iterator.Release()
+			return 0, err
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return 0, err
+	}
+	iterator = staging.NewIterator(nil, nil)
+	for iterator.Next() {
+		batch.Put(append([]byte{}, iterator.Key()...), append([]byte{}, iterator.Value()...))
+		if err := flush(db.db, 1000); err != nil {
+			iterator.Release()
+			return 0, err
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return 0, err
+	}
+	batch.Delete(replicationSnapshotKey)
+	if err := flush(db.db, 1); err != nil {
+		return 0, err
+	}
+
+	seq, err := readReplicationSeq(db.db)
+	if err != nil {
+		return 0, err
+	}
+	db.replication.resetLocked(seq)
+	replicationSequence.Set(float64(seq))
+	if db.audit.Load() != nil {
+		return seq, db.loadAuditHead()
+	}
+	return seq, nil
+}
+
+func readSnapshotBytes(in *bufio.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(in, size); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &TruncatedSnapshotError{}
+		}
+		return nil, err
+	}
+	bytes := make([]byte, binary.LittleEndian.Uint32(size))
+	if _, err := io.ReadFull(in, bytes); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &TruncatedSnapshotError{}
+		}
+		return nil, err
+	}
+	return bytes, nil
+}
+
+func (f *Follower) get(path string, query url.Values) (*http.Response, error) {
+	target := f.leader.JoinPath(path)
+	target.RawQuery = query.Encode()
+	return f.client.Get(target.String())
+}
+
+// catchUp loads a snapshot of the leader
+func (f *Follower) catchUp() error {
+	start := time.Now()
+	resp, err := f.get("/replication/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &LeaderError{resp.StatusCode}
+	}
+	seq, err := f.db.LoadSnapshot(resp.Body)
+	if err != nil {
+		return err
+	}
+	replicationSnapshots.Inc()
+	slog.Info("Snapshot loaded from the leader", "seq", seq, "duration", time.Since(start).String())
+	return nil
+}
+
+// poll applies the batches after the local sequence number, waiting for them up to the poll timeout.
+// expired is true if the leader does not have them anymore.
+func (f *Follower) poll() (expired bool, err error) {
+	since := f.db.Replication().Last()
+	resp, err := f.get("/replication/stream", url.Values{
+		"since":   {strconv.FormatUint(since, 10)},
+		"timeout": {strconv.FormatFloat(f.config.PollTimeout.Seconds(), 'f', -1, 64)},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return false, &LeaderError{resp.StatusCode}
+	}
+	leaderSeq, err := strconv.ParseUint(resp.Header.Get(ReplicationSequenceHeader), 10, 64)
+	if err != nil {
+		return false, err
+	}
+	in := bufio.NewReaderSize(resp.Body, 64*1024)
+	var last ReplicatedBatch
+	for resp.StatusCode == http.StatusOK {
+		batch, err := readReplicationFrame(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if batch.Seq != f.db.Replication().Last()+1 {
+			return true, nil
+		}
+		if err := f.db.ApplyReplicated(batch); err != nil {
+			return false, err
+		}
+		last = batch
+	}
+	applied := f.db.Replication().Last()
+	replicationLeaderSequence.Set(float64(leaderSeq))
+	replicationLag.Set(float64(max(leaderSeq, applied) - applied))
+	if last.Seq > 0 && applied < leaderSeq {
+		replicationLagSeconds.Set(time.Since(last.Time).Seconds())
+	} else {
+		replicationLagSeconds.Set(0)
+	}
+	return false, nil
+}
+
+// Run follows the leader until quit is closed, leaving the compaction and the purges to the leader
+func (f *Follower) Run(quit <-chan struct{}) {
+	f.db.following.Store(true)
+	slog.Info("Following the leader", "leader", f.leader.String(), "seq", f.db.Replication().Last())
+	backoff := time.Second
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		expired, err := f.db.snapshotPending()
+		if err == nil && !expired {
+			expired, err = f.poll()
+		}
+		if err == nil && expired {
+			err = f.catchUp()
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		replicationErrors.Inc()
+		slog.Warn("Replication failed", "leader", f.leader.String(), "error", err, "retry_in", backoff.String())
+		select {
+		case <-quit:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
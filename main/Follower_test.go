@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// runFollower follows the leader with a database of its own until the returned function is called
+func runFollower(t *testing.T, leader string) (*Database, func()) {
+	t.Helper()
+	config := testConfig(t)
+	config.Replication.Follow = leader
+	config.Replication.PollTimeout = 100 * time.Millisecond
+	database, err := NewDatabase(config.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFollower(database, config.Replication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		f.Run(quit)
+		close(done)
+	}()
+	stopped := false
+	stop := func() {
+		if !stopped {
+			stopped = true
+			close(quit)
+			<-done
+			database.Close()
+		}
+	}
+	t.Cleanup(stop)
+	return database, stop
+}
+
+func putKeys(t *testing.T, url string, key *testKey, from int, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if status, body := post(t, url+"/put", key.putRequest(t, fmt.Sprint(i), fmt.Sprint("value", i)), nil); status != http.StatusOK {
+			t.Fatalf("put: %d %s", status, body)
+		}
+	}
+}
+
+// waitReplicated waits until the follower has the same keys as the leader
+func waitReplicated(t *testing.T, follower *Database, key *testKey) {
+	t.Helper()
+	keys := func(database *Database) string {
+		var all bytes.Buffer
+		err := database.ForEach(key.point(), func(key []byte, value []byte) error {
+			fmt.Fprintf(&all, "%s=%s,", key, value)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return all.String()
+	}
+	for deadline := time.Now().Add(10 * time.Second); keys(follower) != keys(db); {
+		if time.Now().After(deadline) {
+			t.Fatalf("the follower has %s, the leader %s", keys(follower), keys(db))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if follower.Replication().Last() != db.Replication().Last() {
+		t.Errorf("the follower is at %d, the leader at %d", follower.Replication().Last(), db.Replication().Last())
+	}
+}
+
+// TestFollower checks that a follower starts from a snapshot of the leader, follows its batches,
+// and loads a snapshot again when the leader does not have the batches it needs anymore
+func TestFollower(t *testing.T) {
+	server := newTestServer(t, func(config *Config) { config.Database.ReplicationBufferSize = 4 })
+	key := newTestKey(t, 1)
+	snapshots := testutil.ToFloat64(replicationSnapshots)
+
+	admin := newAdminServer(t, server)
+	putKeys(t, server.URL, key, 0, 10)
+	follower, stop := runFollower(t, admin.URL)
+	waitReplicated(t, follower, key)
+	if loaded := testutil.ToFloat64(replicationSnapshots) - snapshots; loaded != 1 {
+		t.Errorf("%v snapshots loaded, expected 1", loaded)
+	}
+
+	putKeys(t, server.URL, key, 10, 12)
+	if status, body := post(t, server.URL+"/clear", key.body(t, []byte("clear"), nil), nil); status != http.StatusOK {
+		t.Fatalf("clear: %d %s", status, body)
+	}
+	putKeys(t, server.URL, key, 12, 13)
+	waitReplicated(t, follower, key)
+	if loaded := testutil.ToFloat64(replicationSnapshots) - snapshots; loaded != 1 {
+		t.Errorf("%v snapshots loaded, expected the batches to be applied", loaded)
+	}
+	stop()
+
+	// the batches after the follower are gone from the leader, it answers 410 and the follower resyncs
+	path := follower.path
+	putKeys(t, server.URL, key, 13, 23)
+	config := testConfig(t)
+	config.Database.Path = path
+	follower, err := NewDatabase(config.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFollower(follower, ReplicationConfig{Follow: admin.URL, PollTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := f.poll()
+	if err != nil || !expired {
+		t.Fatalf("expired %v, error %v, expected 410 Gone", expired, err)
+	}
+	if err = f.catchUp(); err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	waitReplicated(t, follower, key)
+	if loaded := testutil.ToFloat64(replicationSnapshots) - snapshots; loaded != 2 {
+		t.Errorf("%v snapshots loaded, expected 2", loaded)
+	}
+}
+
+// TestForwardedClientIP checks that the client address forwarded by a follower is used for the rate limit
+// only when the follower passes the admin check
+func TestForwardedClientIP(t *testing.T) {
+	server := newTestServer(t, func(config *Config) { config.Limits.IPRate, config.Limits.IPBurst = 0.001, 1 })
+	admin := newAdminServer(t, server)
+	key := newTestKey(t, 1)
+	forwarded := func(url string, ip string) int {
+		status, _ := post(t, url+"/put", key.putRequest(t, "key", "value"), http.Header{ClientIPHeader: {ip}})
+		return status
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if status := forwarded(admin.URL, ip); status != http.StatusOK {
+			t.Errorf("the first put from %s: %d, expected 200", ip, status)
+		}
+	}
+	if status := forwarded(admin.URL, "192.0.2.1"); status != http.StatusTooManyRequests {
+		t.Errorf("the second put from 192.0.2.1: %d, expected 429", status)
+	}
+
+	// outside of the admin listener the header is ignored, all the puts come from the loopback
+	if status := forwarded(server.URL, "192.0.2.3"); status != http.StatusOK {
+		t.Errorf("the first put from the loopback: %d, expected 200", status)
+	}
+	if status := forwarded(server.URL, "192.0.2.4"); status != http.StatusTooManyRequests {
+		t.Errorf("the second put from the loopback: %d, expected 429", status)
+	}
+}
+
+// TestForwardWrite checks that the follower passes the client address to the leader
+func TestForwardWrite(t *testing.T) {
+	var got string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get(ClientIPHeader)
+	}))
+	defer leader.Close()
+	f, err := NewFollower(nil, ReplicationConfig{Follow: leader.URL, ForwardWrites: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower = f
+	defer func() { follower = nil }()
+	admin := httptest.NewServer(adminListener(http.HandlerFunc(forwardWrite)))
+	defer admin.Close()
+	post(t, admin.URL+"/put", nil, http.Header{ClientIPHeader: {"192.0.2.1"}})
+	if got != "192.0.2.1" {
+		t.Errorf("the leader got %q, expected the address forwarded to the follower", got)
+	}
+	server := httptest.NewServer(http.HandlerFunc(forwardWrite))
+	defer server.Close()
+	post(t, server.URL+"/put", nil, http.Header{ClientIPHeader: {"192.0.2.1"}})
+	if got != "127.0.0.1" {
+		t.Errorf("the leader got %q, expected the address of the client", got)
+	}
+}
+
+// TestReadyzSnapshotPending checks that a database half replaced by a snapshot is not ready
+func TestReadyzSnapshotPending(t *testing.T) {
+	server := newTestServer(t, nil)
+	status := func() int {
+		resp, err := http.Get(server.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if s := status(); s != http.StatusOK {
+		t.Fatalf("readyz: %d, expected 200", s)
+	}
+	if err := db.db.Put(replicationSnapshotKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := status(); s != http.StatusServiceUnavailable {
+		t.Errorf("readyz with a pending snapshot: %d, expected 503", s)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"github.com/ndv/kv/bitcurve"
+	"github.com/ndv/kv/kvpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// the gRPC metadata key carrying the proof of work nonce, same as the HTTP header
+const powMetadata = "x-pow-nonce"
+
+// grpcServer implements the gRPC API on top of the same Database and the same checks as the HTTP handlers
+type grpcServer struct {
+	kvpb.UnimplementedKVServer
+}
+
+// NewGRPCServer creates the gRPC server, with TLS if tlsConfig is not nil
+func NewGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(maxBodySize)),
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	kvpb.RegisterKVServer(server, &grpcServer{})
+	return server
+}
+
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusGone:                  codes.OutOfRange,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusMisdirectedRequest:    codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.InvalidArgument,
+	http.StatusPreconditionRequired:  codes.FailedPrecondition,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusInternalServerError:   codes.Internal,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+}
+
+// grpcError converts the error model to a gRPC status, the error code goes to ErrorInfo.Reason
+func grpcError(ctx context.Context, err *APIError) error {
+	code, ok := grpcCodes[err.Status]
+	if !ok {
+		code = codes.Unknown
+	}
+	contextLogger(ctx).Info("Request rejected", "code", err.Code, "error", err.Message, "details", err.Details)
+	st := status.New(code, err.Message)
+	if withDetails, detailsErr := st.WithDetails(&errdetails.ErrorInfo{Reason: err.Code, Domain: "kv"}); detailsErr == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+func grpcStorageError(ctx context.Context, err error, stage string) error {
+	var notLeader *NotLeaderError
+	if errors.As(err, &notLeader) {
+		return grpcError(ctx, noLeaderError(notLeader))
+	}
+	var wrongShard *WrongShardError
+	if errors.As(err, &wrongShard) {
+		return grpcError(ctx, wrongShardError(wrongShard.owner))
+	}
+	contextLogger(ctx).Error("Database error", "error", err.Error(), "stage", stage)
+	return grpcError(ctx, NewAPIError(http.StatusInternalServerError, ErrStorage, "Storage error"))
+}
+
+func peerIP(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// grpcContext attaches a request logger and applies the per-IP rate limit, like the HTTP middleware
+func grpcContext(ctx context.Context, method string) (context.Context, error) {
+	ip := peerIP(ctx)
+	logger := slog.Default().With("request_id", newRequestID(), "endpoint", method, "ip", ip)
+	ctx = context.WithValue(ctx, loggerKey{}, logger)
+	if ok, wait := ipLimiter.Allow(ip); !ok {
+		return ctx, grpcError(ctx, NewAPIError(http.StatusTooManyRequests, ErrRateLimited, "Too many requests").
+			WithDetail("retry_after", wait.Seconds()))
+	}
+	return ctx, nil
+}
+
+func observeGRPC(method string, start time.Time, err error) {
+	code := status.Code(err).String()
+	grpcRequestsTotal.WithLabelValues(method, code).Inc()
+	grpcRequestDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, err := grpcContext(ctx, info.FullMethod)
+	var resp interface{}
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	observeGRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+type loggingStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *loggingStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := grpcContext(stream.Context(), info.FullMethod)
+	if err == nil {
+		err = handler(srv, &loggingStream{ServerStream: stream, ctx: ctx})
+	}
+	observeGRPC(info.FullMethod, start, err)
+	return err
+}
+
+// authenticate parses the signature and checks it together with the proof of work and the pubkey rate limit.
+// The returned context should be freed by the caller.
+func authenticate(ctx context.Context, sig *kvpb.Signature, message []byte, method string, write bool) (*CryptoContext, error) {
+	if sig == nil {
+		return nil, grpcError(ctx, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Missing signature"))
+	}
+	crypto, err := NewCryptoContext(sig.R, sig.S, sig.Pubkey)
+	if err != nil {
+		return nil, grpcError(ctx, toAPIError(err))
+	}
+
+	if write {
+		var nonce string
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(powMetadata)) > 0 {
+			nonce = md.Get(powMetadata)[0]
+		}
+		ok, err := crypto.verifyProofOfWork(message, nonce)
+		if err != nil {
+			crypto.free()
+			return nil, grpcStorageError(ctx, err, "querying the database")
+		}
+		if !ok {
+			crypto.free()
+			return nil, grpcError(ctx, NewAPIError(http.StatusPreconditionRequired, ErrPowRequired, "Proof of work required").
+				WithDetail("difficulty", pow.Difficulty))
+		}
+	}
+
+	if !crypto.verify(message, method, contextLogger(ctx)) {
+		crypto.free()
+		return nil, grpcError(ctx, NewAPIError(http.StatusForbidden, ErrBadSignature, "Wrong signature"))
+	}
+
+	if ok, wait := pubkeyLimiter.Allow(hex.EncodeToString(bitcurve.MarshallCompressedPoint(crypto.pubkey))); !ok {
+		crypto.free()
+		return nil, grpcError(ctx, NewAPIError(http.StatusTooManyRequests, ErrRateLimited, "Too many requests").
+			WithDetail("retry_after", wait.Seconds()))
+	}
+	return crypto, nil
+}
+
+type KeyTooLongError struct{}
+
+func (e *KeyTooLongError) Error() string {
+	return "Keys and values should be shorter than 65536 bytes"
+}
+
+func checkSizes(ctx context.Context, key []byte, value []byte) error {
+	if len(key) > 0xFFFF || len(value) > 0xFFFF {
+		return grpcError(ctx, toAPIError(&KeyTooLongError{}))
+	}
+	return nil
+}
+
+func (s *grpcServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	if follower != nil {
+		return nil, grpcError(ctx, readOnlyError())
+	}
+	if err := checkSizes(ctx, req.Key, req.Value); err != nil {
+		return nil, err
+	}
+	message := putMessage(req.Key, req.Value)
+	crypto, err := authenticate(ctx, req.Signature, message, "/kv.KV/Put", true)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.free()
+	if err := shardGRPC(ctx, crypto); err != nil {
+		return nil, err
+	}
+
+	version, err := db.Put(crypto.pubkey, req.Key, req.Value, crypto.signed(OpPut, message))
+	if err != nil {
+		return nil, grpcStorageError(ctx, err, "writing to the database")
+	}
+	putBytes.Observe(float64(len(req.Key) + len(req.Value)))
+	contextLogger(ctx).Info("Put", pubkeyAttr(crypto.pubkey), keyAttr(req.Key), "value_size", len(req.Value), "version", version)
+	receipt, err := newReceipt(crypto.pubkey, req.Key, req.Value, version)
+	if err != nil {
+		return nil, grpcReceiptError(ctx, err)
+	}
+	return &kvpb.PutResponse{Receipt: receipt.toProto()}, nil
+}
+
+func grpcReceiptError(ctx context.Context, err error) error {
+	return grpcError(ctx, NewAPIError(http.StatusInternalServerError, ErrInternal, err.Error()).
+		WithDetail("stage", "signing the receipt"))
+}
+
+func (r *Receipt) toProto() *kvpb.Receipt {
+	return &kvpb.Receipt{
+		Op:           r.Op,
+		Pubkey:       r.Pubkey,
+		Key:          r.Key,
+		ValueHash:    r.ValueHash,
+		Version:      r.Version,
+		Timestamp:    r.Time.UnixNano(),
+		ServerPubkey: r.ServerPubkey,
+		R:            r.R,
+		S:            r.S,
+	}
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	if err := checkSizes(ctx, req.Key, nil); err != nil {
+		return nil, err
+	}
+	crypto, err := authenticate(ctx, req.Signature, getMessage(req.Key), "/kv.KV/Get", false)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.free()
+	if err := shardGRPC(ctx, crypto); err != nil {
+		return nil, err
+	}
+
+	value, found, err := db.Get(crypto.pubkey, req.Key)
+	if err != nil {
+		return nil, grpcStorageError(ctx, err, "querying the database")
+	}
+	contextLogger(ctx).Info("Get", pubkeyAttr(crypto.pubkey), keyAttr(req.Key), "found", found)
+	return &kvpb.GetResponse{Found: found, Value: value}, nil
+}
+
+func (s *grpcServer) GetAll(req *kvpb.GetAllRequest, stream kvpb.KV_GetAllServer) error {
+	ctx := stream.Context()
+	crypto, err := authenticate(ctx, req.Signature, []byte("getAll"), "/kv.KV/GetAll", false)
+	if err != nil {
+		return err
+	}
+	defer crypto.free()
+	if err := shardGRPC(ctx, crypto); err != nil {
+		return err
+	}
+
+	count := 0
+	err = db.ForEach(crypto.pubkey, func(key []byte, value []byte) error {
+		count++
+		return stream.Send(&kvpb.Entry{Key: key, Value: value})
+	})
+	if err != nil {
+		if _, isStatus := status.FromError(err); isStatus {
+			return err
+		}
+		return grpcStorageError(ctx, err, "querying the database")
+	}
+	contextLogger(ctx).Info("Get all", pubkeyAttr(crypto.pubkey), "count", count)
+	return nil
+}
+
+func (s *grpcServer) Clear(ctx context.Context, req *kvpb.ClearRequest) (*kvpb.ClearResponse, error) {
+	if follower != nil {
+		return nil, grpcError(ctx, readOnlyError())
+	}
+	crypto, err := authenticate(ctx, req.Signature, []byte("clear"), "/kv.KV/Clear", false)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.free()
+	if err := shardGRPC(ctx, crypto); err != nil {
+		return nil, err
+	}
+
+	contextLogger(ctx).Info("Clear", pubkeyAttr(crypto.pubkey))
+	version, err := db.Clear(crypto.pubkey, crypto.signed(OpClear, []byte("clear")))
+	if err != nil {
+		return nil, grpcStorageError(ctx, err, "clearing the database")
+	}
+	receipt, err := newRequestReceipt(OpClear, crypto.pubkey, []byte("clear"), version)
+	if err != nil {
+		return nil, grpcReceiptError(ctx, err)
+	}
+	return &kvpb.ClearResponse{Receipt: receipt.toProto()}, nil
+}
+
+func (s *grpcServer) Batch(ctx context.Context, req *kvpb.BatchRequest) (*kvpb.BatchResponse, error) {
+	if follower != nil {
+		return nil, grpcError(ctx, readOnlyError())
+	}
+	ops := make([]BatchOp, len(req.Ops))
+	size := 0
+	for i, op := range req.Ops {
+		if err := checkSizes(ctx, op.Key, op.Value); err != nil {
+			return nil, err
+		}
+		ops[i] = BatchOp{Delete: op.Type == kvpb.BatchOp_DELETE, Key: op.Key}
+		if !ops[i].Delete {
+			ops[i].Value = op.Value
+		}
+		size += len(op.Key) + len(ops[i].Value)
+	}
+	message := batchMessage(ops)
+	crypto, err := authenticate(ctx, req.Signature, message, "/kv.KV/Batch", true)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.free()
+	if err := shardGRPC(ctx, crypto); err != nil {
+		return nil, err
+	}
+
+	version, err := db.Batch(crypto.pubkey, ops, crypto.signed(OpBatch, message))
+	if err != nil {
+		return nil, grpcStorageError(ctx, err, "writing to the database")
+	}
+	putBytes.Observe(float64(size))
+	contextLogger(ctx).Info("Batch", pubkeyAttr(crypto.pubkey), "ops", len(ops), "version", version)
+	receipt, err := newRequestReceipt(OpBatch, crypto.pubkey, message, version)
+	if err != nil {
+		return nil, grpcReceiptError(ctx, err)
+	}
+	return &kvpb.BatchResponse{Receipt: receipt.toProto()}, nil
+}
+
+// stopGRPC stops the server gracefully, or forcibly after the timeout
+func stopGRPC(server *grpc.Server, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		server.Stop()
+		return context.DeadlineExceeded
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"github.com/ndv/kv/kvpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestGRPCClient serves the gRPC API of a fresh database over an in-memory connection
+func newTestGRPCClient(t *testing.T, configure func(config *Config)) kvpb.KVClient {
+	t.Helper()
+	newTestServer(t, configure)
+	listener := bufconn.Listen(1 << 20)
+	server := NewGRPCServer(nil)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return kvpb.NewKVClient(conn)
+}
+
+func (k *testKey) signature(t *testing.T, message []byte) *kvpb.Signature {
+	t.Helper()
+	r, s := k.sign(t, message)
+	return &kvpb.Signature{R: r, S: s, Pubkey: k.pubkey}
+}
+
+// checkGRPCError checks the status code and the error code in the ErrorInfo of a failed call
+func checkGRPCError(t *testing.T, err error, code codes.Code, reason string) {
+	t.Helper()
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		t.Fatalf("expected a %s error, got %v", code, err)
+	}
+	if st.Code() != code {
+		t.Errorf("code %s, expected %s: %s", st.Code(), code, st.Message())
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			if info.Reason != reason {
+				t.Errorf("reason %q, expected %q", info.Reason, reason)
+			}
+			return
+		}
+	}
+	t.Errorf("no ErrorInfo in %v", st.Details())
+}
+
+func receiptFromProto(r *kvpb.Receipt) *Receipt {
+	if r == nil {
+		return nil
+	}
+	return &Receipt{Op: r.Op, Pubkey: r.Pubkey, Key: r.Key, ValueHash: r.ValueHash, Version: r.Version,
+		Time: time.Unix(0, r.Timestamp), ServerPubkey: r.ServerPubkey, R: r.R, S: r.S}
+}
+
+func TestGRPC(t *testing.T) {
+	client := newTestGRPCClient(t, nil)
+	key := newTestKey(t, 1)
+	ctx := context.Background()
+
+	get := func(k string) *kvpb.GetResponse {
+		t.Helper()
+		resp, err := client.Get(ctx, &kvpb.GetRequest{Signature: key.signature(t, getMessage([]byte(k))), Key: []byte(k)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	put, err := client.Put(ctx, &kvpb.PutRequest{
+		Signature: key.signature(t, putMessage([]byte("a"), []byte("1"))),
+		Key:       []byte("a"),
+		Value:     []byte("1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReceipt(t, receiptFromProto(put.Receipt), OpPut, key, []byte("1"), 1)
+	if resp := get("a"); !resp.Found || string(resp.Value) != "1" {
+		t.Errorf("got %v, expected 1", resp)
+	}
+
+	ops := []BatchOp{{Key: []byte("b"), Value: []byte("2")}, {Key: []byte("a"), Delete: true}}
+	batch, err := client.Batch(ctx, &kvpb.BatchRequest{
+		Signature: key.signature(t, batchMessage(ops)),
+		Ops: []*kvpb.BatchOp{
+			{Type: kvpb.BatchOp_PUT, Key: []byte("b"), Value: []byte("2")},
+			{Type: kvpb.BatchOp_DELETE, Key: []byte("a")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReceipt(t, receiptFromProto(batch.Receipt), OpBatch, key, batchMessage(ops), 3)
+	if resp := get("a"); resp.Found {
+		t.Error("a was not deleted by the batch")
+	}
+	if resp := get("b"); !resp.Found || string(resp.Value) != "2" {
+		t.Errorf("got %v, expected 2", resp)
+	}
+
+	clear, err := client.Clear(ctx, &kvpb.ClearRequest{Signature: key.signature(t, []byte("clear"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReceipt(t, receiptFromProto(clear.Receipt), OpClear, key, []byte("clear"), 4)
+	if resp := get("b"); resp.Found {
+		t.Error("b was not deleted by the clear")
+	}
+
+	_, err = client.Put(ctx, &kvpb.PutRequest{
+		Signature: key.signature(t, putMessage([]byte("a"), []byte("signed"))),
+		Key:       []byte("a"),
+		Value:     []byte("sent"),
+	})
+	checkGRPCError(t, err, codes.PermissionDenied, ErrBadSignature)
+	if resp := get("a"); resp.Found {
+		t.Error("a put with a wrong signature was written")
+	}
+}
+
+func TestGRPCFollower(t *testing.T) {
+	client := newTestGRPCClient(t, nil)
+	leader, err := url.Parse("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower = &Follower{leader: leader}
+	key := newTestKey(t, 1)
+	_, err = client.Put(context.Background(), &kvpb.PutRequest{
+		Signature: key.signature(t, putMessage([]byte("a"), []byte("1"))),
+		Key:       []byte("a"),
+		Value:     []byte("1"),
+	})
+	checkGRPCError(t, err, codes.PermissionDenied, ErrReadOnly)
+}
+
+func TestGRPCWrongShard(t *testing.T) {
+	self, other := "http://127.0.0.1:1", "http://127.0.0.1:2"
+	client := newTestGRPCClient(t, func(config *Config) {
+		config.Sharding.Shards = self + "," + other
+		config.Sharding.Self = self
+	})
+	var key *testKey
+	for private := byte(1); key == nil; private++ {
+		if k := newTestKey(t, private); shards.ring.Owner(k.pubkey) == other {
+			key = k
+		}
+	}
+	ctx := context.Background()
+	_, err := client.Put(ctx, &kvpb.PutRequest{
+		Signature: key.signature(t, putMessage([]byte("a"), []byte("1"))),
+		Key:       []byte("a"),
+		Value:     []byte("1"),
+	})
+	checkGRPCError(t, err, codes.FailedPrecondition, ErrWrongShard)
+	_, err = client.Get(ctx, &kvpb.GetRequest{Signature: key.signature(t, getMessage([]byte("a"))), Key: []byte("a")})
+	checkGRPCError(t, err, codes.FailedPrecondition, ErrWrongShard)
+}
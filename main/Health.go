@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ndv/kv/bitcurve"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+var (
+	// version is set at build time with -ldflags "-X main.version=..."
+	version = "dev"
+
+	// set when the server starts shutting down, so that the load balancer stops sending requests
+	shuttingDown atomic.Bool
+)
+
+var (
+	protocolVersions = []string{"1"}
+	signatureSchemes = []string{"ecdsa-secp256k1-sha256"}
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleHealthz reports that the process is alive
+func handleHealthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the server can serve requests: it is not shutting down,
+// the database accepts reads and writes and is not half replaced by a snapshot of the leader,
+// the cluster node has written all the committed batches, and the curve is initialized
+func handleReadyz(w http.ResponseWriter, req *http.Request) {
+	checks := map[string]string{
+		"shutdown": "ok",
+		"database": "ok",
+		"bitcurve": "ok",
+	}
+	ready := true
+
+	if shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+		ready = false
+	}
+	if db == nil {
+		delete(checks, "database") // a router has no database
+	} else if err := db.Check(); err != nil {
+		checks["database"] = err.Error()
+		ready = false
+	} else if pending, err := db.snapshotPending(); err != nil || pending {
+		checks["database"] = "loading a snapshot of the leader"
+		if err != nil {
+			checks["database"] = err.Error()
+		}
+		ready = false
+	}
+	if cluster != nil {
+		checks["cluster"] = "ok"
+		if err := cluster.Failed(); err != nil {
+			checks["cluster"] = err.Error()
+			ready = false
+		}
+	}
+	if !bitcurve.Initialized() {
+		checks["bitcurve"] = "not initialized"
+		ready = false
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+		requestLogger(req).Warn("Not ready", "checks", checks)
+	}
+	writeJSON(w, status, map[string]interface{}{"ready": ready, "checks": checks})
+}
+
+// handleVersion reports the build and the protocol versions and signature schemes the server supports
+func handleVersion(w http.ResponseWriter, req *http.Request) {
+	build := map[string]string{"version": version}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build["go"] = info.GoVersion
+		build["module"] = info.Main.Version
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				build[setting.Key] = setting.Value
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"build":             build,
+		"protocol_versions": protocolVersions,
+		"signature_schemes": signatureSchemes,
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/ndv/kv/bitcurve"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testConfig returns the default settings with everything on disk under a temporary directory
+// and without the rate limits
+func testConfig(t *testing.T) Config {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.Database.Path = filepath.Join(dir, "database")
+	config.Database.PubkeyCountInterval = 0
+	config.Identity.KeyFile = filepath.Join(dir, "identity.key")
+	config.Cluster.Dir = filepath.Join(dir, "raft")
+	config.Limits.IPRate = 0
+	config.Limits.PubkeyRate = 0
+	return config
+}
+
+// newTestServer serves the HTTP API of a fresh database like main does, configure adjusts the settings.
+// The server uses the globals, so there is one at a time.
+func newTestServer(t *testing.T, configure func(config *Config)) *httptest.Server {
+	t.Helper()
+	config := testConfig(t)
+	if configure != nil {
+		configure(&config)
+	}
+	ipLimiter = NewRateLimiter("ip", config.Limits.IPRate, config.Limits.IPBurst)
+	pubkeyLimiter = NewRateLimiter("pubkey", config.Limits.PubkeyRate, config.Limits.PubkeyBurst)
+	var err error
+	pow, err = NewProofOfWork(config.Limits.Pow, config.Limits.PowDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxBodySize = config.Limits.MaxBodyBytes
+	maxWatchTimeout = config.Watch.MaxTimeout
+
+	server := httptest.NewServer(newServerMux(config, io.Discard))
+	t.Cleanup(func() {
+		server.Close()
+		if cluster != nil {
+			cluster.Shutdown()
+		}
+		db.Close()
+		db, follower, cluster, shards = nil, nil, nil, nil
+		pow = ProofOfWork{Mode: PowOff}
+	})
+	return server
+}
+
+// newAdminServer serves the handlers of the test server like its admin listen address
+func newAdminServer(t *testing.T, server *httptest.Server) *httptest.Server {
+	admin := httptest.NewServer(adminListener(server.Config.Handler))
+	t.Cleanup(admin.Close)
+	return admin
+}
+
+// testKey is a client key pair
+type testKey struct {
+	key    bitcurve.Key
+	pubkey []byte
+}
+
+func newTestKey(t *testing.T, private byte) *testKey {
+	t.Helper()
+	d := make([]byte, 32)
+	d[31] = private
+	key, ok := bitcurve.KeyFromPrivate(d)
+	if !ok {
+		t.Fatal("Cannot create the key")
+	}
+	t.Cleanup(func() { bitcurve.FreeKey(key) })
+	return &testKey{key: key, pubkey: bitcurve.MarshallCompressedPoint(bitcurve.PublicKey(key))}
+}
+
+// sign returns r and s of the message
+func (k *testKey) sign(t *testing.T, message []byte) ([]byte, []byte) {
+	t.Helper()
+	hash := sha256.Sum256(message)
+	r, s, ok := bitcurve.SignHash(hash[:], k.key)
+	if !ok {
+		t.Fatal("Cannot sign")
+	}
+	return r, s
+}
+
+// body is the signed request body: r, s, the pubkey and the payload
+func (k *testKey) body(t *testing.T, message []byte, payload []byte) []byte {
+	t.Helper()
+	r, s := k.sign(t, message)
+	return append(append(append(append([]byte{}, r...), s...), k.pubkey...), payload...)
+}
+
+// post sends the body to the server and returns the status and the response body
+func post(t *testing.T, url string, body []byte, header http.Header) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Content-Type", binaryContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// putRequest is the body of a /put
+func (k *testKey) putRequest(t *testing.T, key string, value string) []byte {
+	message := putMessage([]byte(key), []byte(value))
+	return k.body(t, message, message)
+}
+
+// errorCode returns the code of a JSON error response
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var response struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Error == nil {
+		t.Fatalf("Not an error response: %s", body)
+	}
+	return response.Error.Code
+}
+
+func (k *testKey) point() bitcurve.Point {
+	return bitcurve.PublicKey(k.key)
+}
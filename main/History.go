@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/ndv/kv/bitcurve"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"log/slog"
+	"time"
+)
+
+// The history keyspace: 'h' + pubkey + uint16 big endian key size + key + uint64 big endian version
+// holds uint64 big endian unix time in nanoseconds, 'p' or 'd', and the value for 'p'.
+// The version is the sequence number of the change in the change log.
+const historyPrefix = 'h'
+
+func (c HistoryConfig) enabled() bool {
+	return c.Versions > 0 || c.MaxAge > 0
+}
+
+// Version is one version of a key, Deleted if the key was deleted or cleared at this version
+type Version struct {
+	Version uint64
+	Time    time.Time
+	Deleted bool
+	Value   []byte
+}
+
+func historyKeyPrefix(pubkey []byte, key []byte) []byte {
+	prefix := append([]byte{historyPrefix}, pubkey...)
+	prefix = binary.BigEndian.AppendUint16(prefix, uint16(len(key)))
+	return append(prefix, key...)
+}
+
+func historyKey(pubkey []byte, key []byte, version uint64) []byte {
+	return binary.BigEndian.AppendUint64(historyKeyPrefix(pubkey, key), version)
+}
+
+func encodeVersion(deleted bool, value []byte, now time.Time) []byte {
+	encoded := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	if deleted {
+		return append(encoded, 'd')
+	}
+	return append(append(encoded, 'p'), value...)
+}
+
+func decodeVersion(version uint64, encoded []byte) (Version, error) {
+	if len(encoded) < 9 || (encoded[8] != 'p' && encoded[8] != 'd') {
+		return Version{}, &CorruptedChangeError{}
+	}
+	return Version{
+		Version: version,
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(encoded))),
+		Deleted: encoded[8] == 'd',
+		Value:   append([]byte{}, encoded[9:]...),
+	}, nil
+}
+
+// EnableHistory turns on the value history with the retention policy, and starts the periodic purge
+func (db *Database) EnableHistory(config HistoryConfig) {
+	db.history = config
+	if config.enabled() && config.PurgeInterval > 0 {
+		go db.purgeHistoryEvery(config)
+	}
+}
+
+// historyReplay collects the data keys of the pubkey deleted by a batch
+type historyReplay struct {
+	pubkey  []byte
+	deleted [][]byte
+}
+
+func (r *historyReplay) Put(key, value []byte) {}
+
+func (r *historyReplay) Delete(key []byte) {
+	if len(key) >= 33 && string(key[:33]) == string(r.pubkey) {
+		r.deleted = append(r.deleted, append([]byte{}, key[33:]...))
+	}
+}
+
+// recordHistory adds the versions written by the events, starting from the sequence number first, to the batch.
+// The keys removed by a clear are taken from the deletions in the batch.
+func (db *Database) recordHistory(batch *leveldb.Batch, pubkey []byte, first uint64, events []ChangeEvent) error {
+	if !db.history.enabled() {
+		return nil
+	}
+	now := time.Now()
+	for i, event := range events {
+		version := first + uint64(i)
+		switch event.Type {
+		case EventPut:
+			batch.Put(historyKey(pubkey, event.Key, version), encodeVersion(false, event.Value, now))
+		case EventDelete:
+			batch.Put(historyKey(pubkey, event.Key, version), encodeVersion(true, nil, now))
+		case EventClear:
+			replay := &historyReplay{pubkey: pubkey}
+			if err := batch.Replay(replay); err != nil {
+				return err
+			}
+			for _, key := range replay.deleted {
+				batch.Put(historyKey(pubkey, key, version), encodeVersion(true, nil, now))
+			}
+		}
+	}
+	return nil
+}
+
+// History returns the kept versions of the key, the oldest first
+func (db *Database) History(pubkey bitcurve.Point, key []byte) ([]Version, error) {
+	iterator := db.db.NewIterator(util.BytesPrefix(historyKeyPrefix(bitcurve.MarshallCompressedPoint(pubkey), key)), nil)
+	defer iterator.Release()
+	var versions []Version
+	for iterator.Next() {
+		k := iterator.Key()
+		version, err := decodeVersion(binary.BigEndian.Uint64(k[len(k)-8:]), iterator.Value())
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, iterator.Error()
+}
+
+// GetAt returns the version of the key current at the sequence number at.
+// found is false if the key did not exist then, or if its versions up to then are not kept anymore.
+func (db *Database) GetAt(pubkey bitcurve.Point, key []byte, at uint64) (version Version, found bool, err error) {
+	prefix := historyKeyPrefix(bitcurve.MarshallCompressedPoint(pubkey), key)
+	iterator := db.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iterator.Release()
+
+	// the first version after at, then one step back
+	ok := iterator.Seek(binary.BigEndian.AppendUint64(append([]byte{}, prefix...), at))
+	if !ok || binary.BigEndian.Uint64(iterator.Key()[len(prefix):]) > at {
+		ok = iterator.Prev()
+	}
+	if !ok {
+		return version, false, iterator.Error()
+	}
+	version, err = decodeVersion(binary.BigEndian.Uint64(iterator.Key()[len(prefix):]), iterator.Value())
+	if err != nil {
+		return version, false, err
+	}
+	return version, !version.Deleted, nil
+}
+
+// PurgeHistory removes the versions outside of the retention policy
+func (db *Database) PurgeHistory(config HistoryConfig) (removed int, err error) {
+	iterator := db.db.NewIterator(util.BytesPrefix([]byte{historyPrefix}), nil)
+	defer iterator.Release()
+
+	cutoff := time.Now().Add(-config.MaxAge)
+	batch := new(leveldb.Batch)
+	var group []byte  // the history key prefix of the current key
+	var keys [][]byte // the versions of the current key, the oldest first
+	var times []time.Time
+	flush := func() error {
+		for i, key := range keys {
+			recent := config.Versions > 0 && i >= len(keys)-config.Versions
+			young := config.MaxAge > 0 && times[i].After(cutoff)
+			if !recent && !young {
+				batch.Delete(key)
+				removed++
+			}
+		}
+		keys, times = keys[:0], times[:0]
+		if batch.Len() < 1000 {
+			return nil
+		}
+		err := db.write(batch, nil, nil)
+		batch.Reset()
+		return err
+	}
+	for iterator.Next() {
+		key := iterator.Key()
+		if len(key) < 1+33+2+8 || len(iterator.Value()) < 8 {
+			continue
+		}
+		if group == nil || string(key[:len(key)-8]) != string(group) {
+			if err := flush(); err != nil {
+				return removed, err
+			}
+			group = append([]byte{}, key[:len(key)-8]...)
+		}
+		keys = append(keys, append([]byte{}, key...))
+		times = append(times, time.Unix(0, int64(binary.BigEndian.Uint64(iterator.Value()))))
+	}
+	if err := iterator.Error(); err != nil {
+		return removed, err
+	}
+	if err := flush(); err != nil {
+		return removed, err
+	}
+	return removed, db.write(batch, nil, nil)
+}
+
+// purgeHistoryEvery runs PurgeHistory periodically until the database is closed
+func (db *Database) purgeHistoryEvery(config HistoryConfig) {
+	ticker := time.NewTicker(config.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.quit:
+			return
+		case <-ticker.C:
+		}
+		if !db.leading() {
+			continue // the leader of the cluster or of the replication does it for all the nodes
+		}
+		start := time.Now()
+		removed, err := db.PurgeHistory(config)
+		if err != nil {
+			slog.Error("History purge failed", "removed", removed, "error", err)
+			continue
+		}
+		slog.Info("History purged", "removed", removed, "duration", time.Since(start).String())
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestGetAt checks the version of a key at every sequence number of its puts, deletes and clear
+func TestGetAt(t *testing.T) {
+	newTestServer(t, func(config *Config) { config.History.Versions = 10 })
+	key := newTestKey(t, 1)
+	put := func(name string, value string) {
+		if _, err := db.Put(key.point(), []byte(name), []byte(value), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the sequence numbers: 1 k=v1, 2 other=o, 3 k=v2, 4 k deleted, 5 k=v3, 6 clear, 7 k=v4
+	put("k", "v1")
+	put("other", "o")
+	put("k", "v2")
+	if _, err := db.Batch(key.point(), []BatchOp{{Key: []byte("k"), Delete: true}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	put("k", "v3")
+	if _, err := db.Clear(key.point(), nil); err != nil {
+		t.Fatal(err)
+	}
+	put("k", "v4")
+
+	tests := []struct {
+		at    uint64
+		value string // empty if not found
+	}{
+		{0, ""}, {1, "v1"}, {2, "v1"}, {3, "v2"}, {4, ""}, {5, "v3"}, {6, ""}, {7, "v4"}, {100, "v4"},
+	}
+	for _, test := range tests {
+		version, found, err := db.GetAt(key.point(), []byte("k"), test.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != (test.value != "") || string(version.Value) != test.value {
+			t.Errorf("at %d: %q found %v, expected %q", test.at, version.Value, found, test.value)
+		}
+	}
+	if _, found, err := db.GetAt(key.point(), []byte("other"), 5); err != nil || !found {
+		t.Errorf("other at 5: found %v %v, expected its put", found, err)
+	}
+	if _, found, err := db.GetAt(key.point(), []byte("other"), 6); err != nil || found {
+		t.Errorf("other at 6: found %v %v, expected the clear", found, err)
+	}
+
+	versions, err := db.History(key.point(), []byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		version uint64
+		deleted bool
+	}{{1, false}, {3, false}, {4, true}, {5, false}, {6, true}, {7, false}}
+	if len(versions) != len(expected) {
+		t.Fatalf("%d versions, expected %d", len(versions), len(expected))
+	}
+	for i, version := range versions {
+		if version.Version != expected[i].version || version.Deleted != expected[i].deleted {
+			t.Errorf("version %d is %d deleted %v, expected %d deleted %v", i, version.Version, version.Deleted,
+				expected[i].version, expected[i].deleted)
+		}
+	}
+}
+
+// TestPurgeHistory checks the retention of the versions by count, by age and by both
+func TestPurgeHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  HistoryConfig
+		removed int
+		oldest  uint64 // the first version of k kept, 0 if none
+	}{
+		{name: "versions", config: HistoryConfig{Versions: 2}, removed: 3, oldest: 5},
+		{name: "recent", config: HistoryConfig{MaxAge: time.Hour}, removed: 0, oldest: 1},
+		{name: "old", config: HistoryConfig{MaxAge: time.Nanosecond}, removed: 6, oldest: 0},
+		{name: "versions or recent", config: HistoryConfig{Versions: 1, MaxAge: time.Hour}, removed: 0, oldest: 1},
+		{name: "versions or old", config: HistoryConfig{Versions: 1, MaxAge: time.Nanosecond}, removed: 4, oldest: 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestServer(t, func(config *Config) { config.History.Versions = 10 })
+			key := newTestKey(t, 1)
+			for i, value := range []string{"v1", "v2", "v3", "v4", "v5"} {
+				if _, err := db.Put(key.point(), []byte("k"), []byte(value), nil); err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 {
+					// a key with a single version
+					if _, err := db.Put(key.point(), []byte("single"), []byte(value), nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			time.Sleep(time.Millisecond)
+
+			removed, err := db.PurgeHistory(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != test.removed {
+				t.Errorf("%d versions removed, expected %d", removed, test.removed)
+			}
+			versions, err := db.History(key.point(), []byte("k"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldest := uint64(0)
+			if len(versions) > 0 {
+				oldest = versions[0].Version
+			}
+			if oldest != test.oldest {
+				t.Errorf("the oldest version kept is %d, expected %d", oldest, test.oldest)
+			}
+			// the purged versions are not found anymore
+			if _, found, err := db.GetAt(key.point(), []byte("k"), 1); err != nil || found != (test.oldest == 1) {
+				t.Errorf("k at 1: found %v %v", found, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/ndv/kv/bitcurve"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// identity is the secp256k1 key of the server, it signs the write receipts
+var identity *Identity
+
+type Identity struct {
+	key    bitcurve.Key
+	Pubkey []byte // compressed
+}
+
+type WrongIdentityKeyError struct {
+	path string
+}
+
+func (e *WrongIdentityKeyError) Error() string {
+	return "Wrong identity key in " + e.path + ", expected 32 bytes in hex"
+}
+
+type KeyGenerationError struct{}
+
+func (e *KeyGenerationError) Error() string {
+	return "Cannot generate the identity key"
+}
+
+type SigningError struct{}
+
+func (e *SigningError) Error() string {
+	return "Cannot sign with the identity key"
+}
+
+// LoadIdentity reads the private key from the file, in hex, or generates a new one and saves it there
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, ok := bitcurve.GenerateKey()
+		if !ok {
+			return nil, &KeyGenerationError{}
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			bitcurve.FreeKey(key)
+			return nil, err
+		}
+		if err = os.WriteFile(path, []byte(hex.EncodeToString(bitcurve.PrivateKeyBytes(key))+"\n"), 0600); err != nil {
+			bitcurve.FreeKey(key)
+			return nil, err
+		}
+		return &Identity{key: key, Pubkey: bitcurve.MarshallCompressedPoint(bitcurve.PublicKey(key))}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	private, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(private) != 32 {
+		return nil, &WrongIdentityKeyError{path}
+	}
+	key, ok := bitcurve.KeyFromPrivate(private)
+	if !ok {
+		return nil, &WrongIdentityKeyError{path}
+	}
+	return &Identity{key: key, Pubkey: bitcurve.MarshallCompressedPoint(bitcurve.PublicKey(key))}, nil
+}
+
+// Sign signs sha256 of the message, the same way the clients sign their requests
+func (id *Identity) Sign(message []byte) (r []byte, s []byte, err error) {
+	hash := sha256.Sum256(message)
+	r, s, ok := bitcurve.SignHash(hash[:], id.key)
+	if !ok {
+		return nil, nil, &SigningError{}
+	}
+	return r, s, nil
+}
+
+// Receipt proves that the server has accepted a write
+type Receipt struct {
+	Op           string // OpPut, OpBatch, OpClear or OpRestore
+	Pubkey       []byte // the compressed pubkey of the namespace
+	Key          []byte // empty except for a put
+	ValueHash    []byte // sha256 of the value of a put, or of the signed message of the other writes
+	Version      uint64 // the sequence number of the pubkey after the write
+	Time         time.Time
+	ServerPubkey []byte
+	R, S         []byte // the signature of the server
+}
+
+// message is the signed form of the receipt: "receipt", pubkey, uint16 key size, key, value hash,
+// uint64 version and uint64 unix time in nanoseconds, all integers little-endian like in the requests.
+// The receipts of the writes other than put start with "receipt/" and the operation instead,
+// which cannot be confused with the first byte of a compressed pubkey.
+func (r *Receipt) message() []byte {
+	message := []byte("receipt")
+	if r.Op != OpPut {
+		message = append(append(message, '/'), r.Op...)
+	}
+	message = append(message, r.Pubkey...)
+	message = append(message, writeUint16(uint16(len(r.Key)))...)
+	message = append(message, r.Key...)
+	message = append(message, r.ValueHash...)
+	message = binary.LittleEndian.AppendUint64(message, r.Version)
+	return binary.LittleEndian.AppendUint64(message, uint64(r.Time.UnixNano()))
+}
+
+// newReceipt signs the receipt of a put with the server identity
+func newReceipt(pubkey bitcurve.Point, key []byte, value []byte, version uint64) (*Receipt, error) {
+	hash := sha256.Sum256(value)
+	return signReceipt(&Receipt{Op: OpPut, Key: key, ValueHash: hash[:]}, pubkey, version)
+}
+
+// newRequestReceipt signs the receipt of a batch, clear or restore, over the signed message of the request
+func newRequestReceipt(op string, pubkey bitcurve.Point, message []byte, version uint64) (*Receipt, error) {
+	hash := sha256.Sum256(message)
+	return signReceipt(&Receipt{Op: op, Key: []byte{}, ValueHash: hash[:]}, pubkey, version)
+}
+
+func signReceipt(receipt *Receipt, pubkey bitcurve.Point, version uint64) (*Receipt, error) {
+	receipt.Pubkey = bitcurve.MarshallCompressedPoint(pubkey)
+	receipt.Version = version
+	receipt.Time = time.Now()
+	receipt.ServerPubkey = identity.Pubkey
+	var err error
+	receipt.R, receipt.S, err = identity.Sign(receipt.message())
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+type receiptJSON struct {
+	Op           string `json:"op"`
+	Pubkey       string `json:"pubkey"`
+	Key          string `json:"key"`
+	ValueHash    string `json:"value_hash"`
+	Version      uint64 `json:"version"`
+	Timestamp    int64  `json:"timestamp"` // unix time in nanoseconds
+	ServerPubkey string `json:"server_pubkey"`
+	R            string `json:"r"`
+	S            string `json:"s"`
+}
+
+func (r *Receipt) toJSON() *receiptJSON {
+	return &receiptJSON{
+		Op:           r.Op,
+		Pubkey:       hex.EncodeToString(r.Pubkey),
+		Key:          hex.EncodeToString(r.Key),
+		ValueHash:    hex.EncodeToString(r.ValueHash),
+		Version:      r.Version,
+		Timestamp:    r.Time.UnixNano(),
+		ServerPubkey: hex.EncodeToString(r.ServerPubkey),
+		R:            hex.EncodeToString(r.R),
+		S:            hex.EncodeToString(r.S),
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// checkReceipt verifies the signature of the receipt by the server and its fields
+func checkReceipt(t *testing.T, receipt *Receipt, op string, key *testKey, signed []byte, version uint64) {
+	t.Helper()
+	if receipt == nil {
+		t.Fatalf("no %s receipt", op)
+	}
+	crypto, err := NewCryptoContext(receipt.R, receipt.S, receipt.ServerPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crypto.free()
+	if !crypto.verify(receipt.message(), "receipt", slog.Default()) {
+		t.Errorf("wrong signature of the %s receipt", op)
+	}
+	if !bytes.Equal(receipt.ServerPubkey, identity.Pubkey) {
+		t.Errorf("the %s receipt is signed by %x", op, receipt.ServerPubkey)
+	}
+	hash := sha256.Sum256(signed)
+	if receipt.Op != op || !bytes.Equal(receipt.Pubkey, key.pubkey) || !bytes.Equal(receipt.ValueHash, hash[:]) {
+		t.Errorf("wrong %s receipt %+v", op, receipt)
+	}
+	if receipt.Version != version {
+		t.Errorf("%s receipt version %d, expected %d", op, receipt.Version, version)
+	}
+}
+
+// parseReceipt reads the receipt field of a JSON response
+func parseReceipt(t *testing.T, body []byte) *Receipt {
+	t.Helper()
+	var response struct {
+		Receipt *receiptJSON `json:"receipt"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Receipt == nil {
+		t.Fatalf("no receipt in %s", body)
+	}
+	r := response.Receipt
+	receipt := &Receipt{Op: r.Op, Version: r.Version, Time: time.Unix(0, r.Timestamp)}
+	for _, field := range []struct {
+		to   *[]byte
+		from string
+	}{{&receipt.Pubkey, r.Pubkey}, {&receipt.Key, r.Key}, {&receipt.ValueHash, r.ValueHash},
+		{&receipt.ServerPubkey, r.ServerPubkey}, {&receipt.R, r.R}, {&receipt.S, r.S}} {
+		var err error
+		if *field.to, err = hex.DecodeString(field.from); err != nil {
+			t.Fatalf("wrong hex in %s", body)
+		}
+	}
+	return receipt
+}
+
+func TestReceipts(t *testing.T) {
+	server := newTestServer(t, func(config *Config) { config.Trash.Retention = time.Hour })
+	key := newTestKey(t, 1)
+
+	for i, k := range []string{"a", "b"} {
+		status, body := post(t, server.URL+"/put", key.putRequest(t, k, "value"), nil)
+		if status != http.StatusOK {
+			t.Fatalf("put: %d %s", status, body)
+		}
+		checkReceipt(t, parseReceipt(t, body), OpPut, key, []byte("value"), uint64(i+1))
+	}
+
+	status, body := post(t, server.URL+"/clear", key.body(t, []byte("clear"), nil), nil)
+	if status != http.StatusOK {
+		t.Fatalf("clear: %d %s", status, body)
+	}
+	checkReceipt(t, parseReceipt(t, body), OpClear, key, []byte("clear"), 3)
+
+	timestamp := uint64(time.Now().UnixNano())
+	restore := restoreMessage(0, timestamp)
+	status, body = post(t, server.URL+"/restore?timestamp="+strconv.FormatUint(timestamp, 10), key.body(t, restore, nil), nil)
+	if status != http.StatusOK {
+		t.Fatalf("restore: %d %s", status, body)
+	}
+	checkReceipt(t, parseReceipt(t, body), OpRestore, key, restore, 5)
+	// the signature is bound to the generation and expires
+	query := "?generation=1&timestamp=" + strconv.FormatUint(timestamp, 10)
+	if status, body = post(t, server.URL+"/restore"+query, key.body(t, restore, nil), nil); status != http.StatusForbidden {
+		t.Errorf("restore with another generation: %d %s", status, body)
+	}
+	old := uint64(time.Now().Add(-time.Hour).UnixNano())
+	query = "?timestamp=" + strconv.FormatUint(old, 10)
+	if status, body = post(t, server.URL+"/restore"+query, key.body(t, restoreMessage(0, old), nil), nil); status != http.StatusBadRequest {
+		t.Errorf("restore signed an hour ago: %d %s", status, body)
+	}
+
+	// a clear of nothing changes nothing, the receipt has the current version
+	other := newTestKey(t, 2)
+	status, body = post(t, server.URL+"/clear", other.body(t, []byte("clear"), nil), nil)
+	if status != http.StatusOK {
+		t.Fatalf("clear: %d %s", status, body)
+	}
+	checkReceipt(t, parseReceipt(t, body), OpClear, other, []byte("clear"), 0)
+}
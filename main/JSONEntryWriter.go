@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// The encodings of keys and values in the JSON responses
+const (
+	EncodingHex    = "hex"
+	EncodingBase64 = "base64"
+	EncodingUTF8   = "utf8" // the bytes as a string if they are valid UTF-8, base64 otherwise
+)
+
+func validEncoding(encoding string) bool {
+	return encoding == EncodingHex || encoding == EncodingBase64 || encoding == EncodingUTF8
+}
+
+// encodeBytes returns the encoded bytes and the encoding actually used
+func encodeBytes(b []byte, encoding string) (string, string) {
+	switch encoding {
+	case EncodingHex:
+		return hex.EncodeToString(b), EncodingHex
+	case EncodingUTF8:
+		if utf8.Valid(b) {
+			return string(b), EncodingUTF8
+		}
+	}
+	return base64.StdEncoding.EncodeToString(b), EncodingBase64
+}
+
+type jsonEntry struct {
+	Key           string `json:"key"`
+	Value         string `json:"value"`
+	KeyEncoding   string `json:"key_encoding"`
+	ValueEncoding string `json:"value_encoding"`
+	Size          int    `json:"size"`
+}
+
+// jsonEntryWriter streams a JSON array of entries, one line per entry
+type jsonEntryWriter struct {
+	w        *bufio.Writer
+	encoding string
+	first    bool
+}
+
+func newJSONEntryWriter(w io.Writer, encoding string) *jsonEntryWriter {
+	return &jsonEntryWriter{w: bufio.NewWriter(w), encoding: encoding, first: true}
+}
+
+func (j *jsonEntryWriter) begin() error {
+	_, err := j.w.WriteString("[")
+	return err
+}
+
+func (j *jsonEntryWriter) entry(key []byte, value []byte) error {
+	e := jsonEntry{Size: len(value)}
+	e.Key, e.KeyEncoding = encodeBytes(key, j.encoding)
+	e.Value, e.ValueEncoding = encodeBytes(value, j.encoding)
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	if !j.first {
+		j.w.WriteString(",")
+	}
+	j.w.WriteString("\n")
+	j.first = false
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonEntryWriter) end() error {
+	if _, err := j.w.WriteString("\n]\n"); err != nil {
+		return err
+	}
+	return j.w.Flush()
+}
+
+// fail leaves the array unterminated, so that the client can't take a partial list for a complete one
+func (j *jsonEntryWriter) fail(err *APIError) error {
+	return j.w.Flush()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ndv/kv/bitcurve"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+)
+
+const (
+	LogFull   = "full"   // log pubkeys and key names as they are
+	LogHash   = "hash"   // log a keyed hash, so that requests of one user can still be correlated
+	LogRedact = "redact" // don't log them at all
+
+	RequestIDHeader = "X-Request-Id"
+)
+
+// privacy settings for the user metadata in the logs
+var (
+	logPubkeys  = LogHash
+	logKeys     = LogHash
+	logHashSalt []byte
+)
+
+type WrongLogSettingError struct {
+	setting string
+	value   string
+}
+
+func (e *WrongLogSettingError) Error() string {
+	return fmt.Sprintf("Wrong logging.%s value %q", e.setting, e.value)
+}
+
+func checkPrivacyMode(setting, mode string) error {
+	switch mode {
+	case LogFull, LogHash, LogRedact:
+		return nil
+	}
+	return &WrongLogSettingError{setting, mode}
+}
+
+// SetupLogging installs the default slog logger according to the config
+func SetupLogging(config LoggingConfig, output io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return &WrongLogSettingError{"level", config.Level}
+	}
+	if err := checkPrivacyMode("pubkeys", config.Pubkeys); err != nil {
+		return err
+	}
+	if err := checkPrivacyMode("keys", config.Keys); err != nil {
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch config.Format {
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	case "text":
+		handler = slog.NewTextHandler(output, options)
+	default:
+		return &WrongLogSettingError{"format", config.Format}
+	}
+	slog.SetDefault(slog.New(handler))
+
+	logPubkeys = config.Pubkeys
+	logKeys = config.Keys
+	logHashSalt = []byte(config.HashSalt)
+	if len(logHashSalt) == 0 && (logPubkeys == LogHash || logKeys == LogHash) {
+		// without a key the hashes could be reversed by hashing the known pubkeys and key names,
+		// a random one only keeps them correlated until the restart
+		logHashSalt = make([]byte, 32)
+		if _, err := rand.Read(logHashSalt); err != nil {
+			return err
+		}
+		slog.Warn("No logging.hash_salt, the hashes in the log change with every restart")
+	}
+	return nil
+}
+
+func privateValue(mode string, value []byte) string {
+	switch mode {
+	case LogFull:
+		return hex.EncodeToString(value)
+	case LogHash:
+		mac := hmac.New(sha256.New, logHashSalt)
+		mac.Write(value)
+		return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return "-"
+}
+
+// pubkeyAttr formats the pubkey for the log according to the privacy settings
+func pubkeyAttr(pubkey bitcurve.Point) slog.Attr {
+	return slog.String("pubkey", privateValue(logPubkeys, bitcurve.MarshallCompressedPoint(pubkey)))
+}
+
+// keyAttr formats a key name for the log according to the privacy settings
+func keyAttr(key []byte) slog.Attr {
+	if logKeys == LogFull {
+		return slog.String("key", string(key))
+	}
+	return slog.String("key", privateValue(logKeys, key))
+}
+
+type loggerKey struct{}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID assigns an ID to the request, or keeps the one set by a proxy in X-Request-Id,
+// returns it in the response header and attaches a logger carrying it to the request context
+func withRequestID(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		logger := slog.Default().With("request_id", id, "endpoint", req.URL.Path, "ip", clientIP(req))
+		handler(w, req.WithContext(context.WithValue(req.Context(), loggerKey{}, logger)))
+	}
+}
+
+// requestLogger returns the logger of the request
+func requestLogger(req *http.Request) *slog.Logger {
+	return contextLogger(req.Context())
+}
+
+func contextLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
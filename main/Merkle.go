@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The Merkle tree of a pubkey follows RFC 6962: the leaves are the keys in the key order, a leaf hash is
+// sha256(0x00, uint16 key size, key, sha256(value)), an inner node is sha256(0x01, left, right),
+// the left subtree holding the largest power of two leaves less than the size. The empty tree is sha256("").
+
+func leafHash(key []byte, value []byte) []byte {
+	valueHash := sha256.Sum256(value)
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(writeUint16(uint16(len(key))))
+	h.Write(key)
+	h.Write(valueHash[:])
+	return h.Sum(nil)
+}
+
+func nodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint is the largest power of two less than n
+func splitPoint(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// The hash of every data key is kept next to it, in the same batch, under leafPrefix and the data key.
+// Every commit of a pubkey stores its root under rootPrefix and the pubkey, as uint64 big endian version,
+// uint64 big endian size and the root, and the roots of the complete subtrees of its tree under nodePrefix,
+// the pubkey, uint8 level and uint64 big endian position, like the audit log.
+const (
+	leafPrefix = 'k'
+	rootPrefix = 'r'
+	nodePrefix = 'p'
+)
+
+// leavesIndexedKey is set once the leaf hashes of all the data keys are stored
+var leavesIndexedKey = []byte("\x00merkle-leaves")
+
+func leafKey(dataKey []byte) []byte {
+	return append([]byte{leafPrefix}, dataKey...)
+}
+
+func rootKey(pubkey []byte) []byte {
+	return append([]byte{rootPrefix}, pubkey...)
+}
+
+func nodeKeyPrefix(pubkey []byte) []byte {
+	return append([]byte{nodePrefix}, pubkey...)
+}
+
+// nodeKeys returns the function making the keys of the subtree roots of the pubkey
+func nodeKeys(pubkey []byte) func(level int, position uint64) []byte {
+	return func(level int, position uint64) []byte {
+		key := append(nodeKeyPrefix(pubkey), byte(level))
+		return binary.BigEndian.AppendUint64(key, position)
+	}
+}
+
+// leafIndexer collects the leaf hash updates of the data keys written by a batch
+type leafIndexer struct {
+	updates *leveldb.Batch
+}
+
+func isDataKey(key []byte) bool {
+	return len(key) >= 33 && (key[0] == 2 || key[0] == 3)
+}
+
+func (l *leafIndexer) Put(key []byte, value []byte) {
+	if isDataKey(key) {
+		l.updates.Put(leafKey(key), leafHash(key[33:], value))
+	}
+}
+
+func (l *leafIndexer) Delete(key []byte) {
+	if isDataKey(key) {
+		l.updates.Delete(leafKey(key))
+	}
+}
+
+// indexLeaves adds the leaf hashes of the data keys put by the batch and removes those of the deleted ones
+func indexLeaves(batch *leveldb.Batch) error {
+	indexer := &leafIndexer{updates: new(leveldb.Batch)}
+	if err := batch.Replay(indexer); err != nil {
+		return err
+	}
+	return indexer.updates.Replay(batch)
+}
+
+// indexAllLeaves stores the leaf hashes of the data keys written before they were kept
+func indexAllLeaves(db *leveldb.DB) error {
+	if _, err := db.Get(leavesIndexedKey, nil); err != leveldb.ErrNotFound {
+		return err
+	}
+	iterator := db.NewIterator(dataRange, nil)
+	defer iterator.Release()
+	batch := new(leveldb.Batch)
+	for iterator.Next() {
+		batch.Put(leafKey(iterator.Key()), leafHash(iterator.Key()[33:], iterator.Value()))
+		if batch.Len() >= 1000 {
+			if err := db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+	batch.Put(leavesIndexedKey, nil)
+	return db.Write(batch, nil)
+}
+
+// rootBuilder computes the root of the leaves added in order, keeping the roots of the complete
+// subtrees of the left part, the largest first
+type rootBuilder struct {
+	hashes [][]byte
+	sizes  []uint64
+	size   uint64
+}
+
+// add appends the leaf and returns the roots of the complete subtrees ending with it, of 1, 2, 4... leaves
+func (b *rootBuilder) add(leaf []byte) [][]byte {
+	completed := [][]byte{leaf}
+	hash, size := leaf, uint64(1)
+	for n := len(b.sizes); n > 0 && b.sizes[n-1] == size; n-- {
+		hash, size = nodeHash(b.hashes[n-1], hash), size*2
+		completed = append(completed, hash)
+		b.hashes, b.sizes = b.hashes[:n-1], b.sizes[:n-1]
+	}
+	b.hashes, b.sizes = append(b.hashes, hash), append(b.sizes, size)
+	b.size++
+	return completed
+}
+
+func (b *rootBuilder) clone() *rootBuilder {
+	return &rootBuilder{
+		hashes: append([][]byte{}, b.hashes...),
+		sizes:  append([]uint64{}, b.sizes...),
+		size:   b.size,
+	}
+}
+
+func (b *rootBuilder) root() []byte {
+	if len(b.hashes) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	root := b.hashes[len(b.hashes)-1]
+	for i := len(b.hashes) - 2; i >= 0; i-- {
+		root = nodeHash(b.hashes[i], root)
+	}
+	return root
+}
+
+// storedTree reads the roots of the complete subtrees making the leaves from start to end, the largest first,
+// stored under the keys made by nodeKey. In the RFC 6962 tree start is a multiple of the largest of them.
+func storedTree(reader leveldb.Reader, nodeKey func(level int, position uint64) []byte, start uint64, end uint64) (*rootBuilder, error) {
+	tree := &rootBuilder{size: end - start}
+	for level := 63; level >= 0; level-- {
+		if tree.size&(1<<level) == 0 {
+			continue
+		}
+		hash, err := reader.Get(nodeKey(level, start>>level), nil)
+		if err != nil {
+			return nil, err
+		}
+		tree.hashes, tree.sizes = append(tree.hashes, hash), append(tree.sizes, 1<<level)
+		start += 1 << level
+	}
+	return tree, nil
+}
+
+// rootChanges collects the leaf hashes of the data keys of the pubkey written by a batch, nil for the deleted ones
+type rootChanges struct {
+	pubkey []byte
+	hashes map[string][]byte
+}
+
+func (r *rootChanges) Put(key []byte, value []byte) {
+	if isDataKey(key) && bytes.HasPrefix(key, r.pubkey) {
+		r.hashes[string(key[33:])] = leafHash(key[33:], value)
+	}
+}
+
+func (r *rootChanges) Delete(key []byte) {
+	if isDataKey(key) && bytes.HasPrefix(key, r.pubkey) {
+		r.hashes[string(key[33:])] = nil
+	}
+}
+
+// storeRoot adds the root of the pubkey after the batch to it, at the version, with the roots of the subtrees
+// the batch changes. The leaves before the first key the batch changes keep their subtrees, which are read
+// from the database, only the ones from this key on are hashed again. The caller holds the write lock
+// of the pubkey, so the database has the tree of the previous version.
+func (db *Database) storeRoot(batch *leveldb.Batch, pubkey []byte, version uint64) error {
+	changes := &rootChanges{pubkey: pubkey, hashes: make(map[string][]byte)}
+	if err := batch.Replay(changes); err != nil {
+		return err
+	}
+	changed := make([]string, 0, len(changes.hashes))
+	for key := range changes.hashes {
+		changed = append(changed, key)
+	}
+	sort.Strings(changed)
+
+	iterator := db.db.NewIterator(util.BytesPrefix(leafKey(pubkey)), nil)
+	defer iterator.Release()
+	// the number of the leaves before the first changed key
+	var start uint64
+	ok := iterator.First()
+	for ; ok && (len(changed) == 0 || string(iterator.Key()[1+33:]) < changed[0]); ok = iterator.Next() {
+		start++
+	}
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+	nodeKey := nodeKeys(pubkey)
+	builder, err := storedTree(db.db, nodeKey, 0, start)
+	if err == leveldb.ErrNotFound {
+		// stored before the subtrees were kept, the whole tree is hashed
+		builder, ok = &rootBuilder{}, iterator.First()
+	} else if err != nil {
+		return err
+	}
+
+	add := func(hash []byte) {
+		index := builder.size
+		for level, subtree := range builder.add(hash) {
+			batch.Put(nodeKey(level, index>>level), subtree)
+		}
+	}
+	for ok || len(changed) > 0 {
+		if len(changed) > 0 && (!ok || changed[0] <= string(iterator.Key()[1+33:])) {
+			if ok && changed[0] == string(iterator.Key()[1+33:]) {
+				ok = iterator.Next()
+			}
+			if hash := changes.hashes[changed[0]]; hash != nil {
+				add(hash)
+			}
+			changed = changed[1:]
+			continue
+		}
+		add(append([]byte{}, iterator.Value()...))
+		ok = iterator.Next()
+	}
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+	stored := binary.BigEndian.AppendUint64(nil, version)
+	stored = binary.BigEndian.AppendUint64(stored, builder.size)
+	batch.Put(rootKey(pubkey), append(stored, builder.root()...))
+	return nil
+}
+
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return nodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// consistencyProof is the RFC 6962 proof that the tree of the first m leaves is a prefix of the tree of
+// n leaves, subtree returning the root of the leaves from start to end. It is empty if m is 0 or n.
+func consistencyProof(m uint64, n uint64, subtree func(start uint64, end uint64) ([]byte, error)) ([][]byte, error) {
+	if m == 0 || m == n {
+		return nil, nil
+	}
+	return subproof(m, 0, n, true, subtree)
+}
+
+// subproof is SUBPROOF(m, D[start:end], complete) of RFC 6962, with m counted from start
+func subproof(m uint64, start uint64, end uint64, complete bool, subtree func(uint64, uint64) ([]byte, error)) ([][]byte, error) {
+	if m == end-start {
+		if complete {
+			return nil, nil
+		}
+		root, err := subtree(start, end)
+		return [][]byte{root}, err
+	}
+	k := uint64(splitPoint(int(end - start)))
+	if m <= k {
+		proof, err := subproof(m, start, start+k, complete, subtree)
+		if err != nil {
+			return nil, err
+		}
+		root, err := subtree(start+k, end)
+		return append(proof, root), err
+	}
+	proof, err := subproof(m-k, start+k, end, false, subtree)
+	if err != nil {
+		return nil, err
+	}
+	root, err := subtree(start, start+k)
+	return append(proof, root), err
+}
+
+// merklePath is the audit path of the leaf, from the bottom up
+func merklePath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(merklePath(index, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(index-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// Commitment is the Merkle root of the keys of a pubkey at a version, signed by the server
+type Commitment struct {
+	Pubkey  []byte
+	Version uint64 // the sequence number of the last change
+	Size    uint64 // the number of keys
+	Root    []byte
+	Time    time.Time
+	R, S    []byte
+}
+
+// message is the signed form of the commitment: "root", pubkey, uint64 version, uint64 size, root,
+// uint64 unix time in nanoseconds, the integers little-endian
+func (c *Commitment) message() []byte {
+	message := append([]byte("root"), c.Pubkey...)
+	message = binary.LittleEndian.AppendUint64(message, c.Version)
+	message = binary.LittleEndian.AppendUint64(message, c.Size)
+	message = append(message, c.Root...)
+	return binary.LittleEndian.AppendUint64(message, uint64(c.Time.UnixNano()))
+}
+
+// the signed commitments by pubkey, reused while the version is the same
+var (
+	commitmentsLock sync.Mutex
+	commitments     = make(map[string]*Commitment)
+)
+
+const maxCachedCommitments = 10000
+
+// View is a consistent read-only view of the keys of one pubkey. It should be released with Release
+type View struct {
+	db       *Database
+	snapshot *leveldb.Snapshot
+	pubkey   []byte
+}
+
+func (db *Database) View(pubkey []byte) (*View, error) {
+	snapshot, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &View{db: db, snapshot: snapshot, pubkey: pubkey}, nil
+}
+
+func (v *View) Release() {
+	v.snapshot.Release()
+}
+
+// ForEach calls fn for every key in the key order, stopping at the first error.
+// The key and value slices are only valid until fn returns.
+func (v *View) ForEach(fn func(key []byte, value []byte) error) error {
+	iterator := v.snapshot.NewIterator(util.BytesPrefix(v.pubkey), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		if err := fn(iterator.Key()[33:], iterator.Value()); err != nil {
+			return err
+		}
+	}
+	return iterator.Error()
+}
+
+func (v *View) Get(key []byte) (value []byte, found bool, err error) {
+	value, err = v.snapshot.Get(append(append([]byte{}, v.pubkey...), key...), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+// forEachLeaf calls fn for every stored leaf hash in the key order, stopping at the first error.
+// The key and hash slices are only valid until fn returns.
+func (v *View) forEachLeaf(fn func(key []byte, hash []byte) error) error {
+	iterator := v.snapshot.NewIterator(util.BytesPrefix(leafKey(v.pubkey)), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		if err := fn(iterator.Key()[1+33:], iterator.Value()); err != nil {
+			return err
+		}
+	}
+	return iterator.Error()
+}
+
+// leaves returns the leaf hashes and the keys in the key order
+func (v *View) leaves() ([][]byte, [][]byte, error) {
+	var hashes, keys [][]byte
+	err := v.forEachLeaf(func(key []byte, hash []byte) error {
+		hashes = append(hashes, append([]byte{}, hash...))
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	return hashes, keys, err
+}
+
+// root returns the Merkle root of the view and the number of keys. The root stored by the commit
+// of the version is used, a pubkey not written since the roots are stored has it computed from the stored
+// leaf hashes, without reading the values.
+func (v *View) root(version uint64) ([]byte, uint64, error) {
+	stored, err := v.snapshot.Get(rootKey(v.pubkey), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return nil, 0, err
+	}
+	if len(stored) == 8+8+32 && binary.BigEndian.Uint64(stored) == version {
+		return stored[16:], binary.BigEndian.Uint64(stored[8:]), nil
+	}
+
+	builder := &rootBuilder{}
+	err = v.forEachLeaf(func(key []byte, hash []byte) error {
+		builder.add(append([]byte{}, hash...))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return builder.root(), builder.size, nil
+}
+
+// Commitment returns the signed Merkle root of the view. The root is signed on the first read of every version.
+func (v *View) Commitment() (*Commitment, error) {
+	version, err := lastSeq(v.snapshot, v.pubkey)
+	if err != nil {
+		return nil, err
+	}
+	commitmentsLock.Lock()
+	cached := commitments[string(v.pubkey)]
+	commitmentsLock.Unlock()
+	if cached != nil && cached.Version == version {
+		return cached, nil
+	}
+
+	root, size, err := v.root(version)
+	if err != nil {
+		return nil, err
+	}
+	commitment := &Commitment{
+		Pubkey:  v.pubkey,
+		Version: version,
+		Size:    size,
+		Root:    root,
+		Time:    time.Now(),
+	}
+	if commitment.R, commitment.S, err = identity.Sign(commitment.message()); err != nil {
+		return nil, err
+	}
+
+	commitmentsLock.Lock()
+	if len(commitments) >= maxCachedCommitments {
+		commitments = make(map[string]*Commitment)
+	}
+	if cached := commitments[string(v.pubkey)]; cached == nil || cached.Version < version {
+		commitments[string(v.pubkey)] = commitment
+	}
+	commitmentsLock.Unlock()
+	return commitment, nil
+}
+
+// ProofLeaf is a leaf of the tree with its audit path
+type ProofLeaf struct {
+	Index     int
+	Key       []byte
+	ValueHash []byte
+	Path      [][]byte
+}
+
+// Proof proves that the key is in the tree, with the leaf of the key, or that it is not,
+// with the neighbouring leaves Left and Right, either of which is missing at the ends of the tree
+type Proof struct {
+	Found bool
+	Leaf  *ProofLeaf
+	Left  *ProofLeaf
+	Right *ProofLeaf
+}
+
+// Proof returns the inclusion or non-inclusion proof of the key in the tree of the view
+func (v *View) Proof(key []byte) (*Proof, error) {
+	hashes, keys, err := v.leaves()
+	if err != nil {
+		return nil, err
+	}
+	proofLeaf := func(i int) (*ProofLeaf, error) {
+		value, _, err := v.Get(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		valueHash := sha256.Sum256(value)
+		return &ProofLeaf{Index: i, Key: keys[i], ValueHash: valueHash[:], Path: merklePath(i, hashes)}, nil
+	}
+
+	// the index of the first key not less than the key
+	i := 0
+	for i < len(keys) && bytes.Compare(keys[i], key) < 0 {
+		i++
+	}
+	proof := &Proof{}
+	if i < len(keys) && bytes.Equal(keys[i], key) {
+		proof.Found = true
+		proof.Leaf, err = proofLeaf(i)
+		return proof, err
+	}
+	if i > 0 {
+		if proof.Left, err = proofLeaf(i - 1); err != nil {
+			return nil, err
+		}
+	}
+	if i < len(keys) {
+		if proof.Right, err = proofLeaf(i); err != nil {
+			return nil, err
+		}
+	}
+	return proof, nil
+}
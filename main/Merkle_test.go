@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/ndv/kv/bitcurve"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRootBuilder(t *testing.T) {
+	var leaves [][]byte
+	for n := 0; n <= 33; n++ {
+		builder := &rootBuilder{}
+		for _, leaf := range leaves {
+			builder.add(leaf)
+		}
+		if !bytes.Equal(builder.root(), merkleRoot(leaves)) || builder.size != uint64(n) {
+			t.Errorf("wrong root of %d leaves", n)
+		}
+		hash := sha256.Sum256([]byte{byte(n)})
+		leaves = append(leaves, hash[:])
+	}
+}
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	config := testConfig(t)
+	database, err := NewDatabase(config.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// checkRoot compares the commitment of the pubkey with the root of its keys and values
+func checkRoot(t *testing.T, database *Database, key *testKey, size uint64) {
+	t.Helper()
+	view, err := database.View(key.pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Release()
+	var leaves [][]byte
+	err = view.ForEach(func(key []byte, value []byte) error {
+		leaves = append(leaves, leafHash(key, value))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitment, err := view.Commitment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commitment.Root, merkleRoot(leaves)) || commitment.Size != size || uint64(len(leaves)) != size {
+		t.Errorf("root of %d keys, expected %d", commitment.Size, size)
+	}
+}
+
+func TestStoredLeaves(t *testing.T) {
+	identity = &Identity{}
+	identity.key, _ = bitcurve.KeyFromPrivate(bytes.Repeat([]byte{1}, 32))
+	defer func() { bitcurve.FreeKey(identity.key); identity = nil }()
+	database := newTestDatabase(t)
+	database.trash.Retention = time.Hour
+	key := newTestKey(t, 1)
+	point := key.point()
+
+	checkRoot(t, database, key, 0)
+	for i := 0; i < 10; i++ {
+		if _, err := database.Put(point, []byte(fmt.Sprint(i)), []byte("value"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRoot(t, database, key, 10)
+	if _, err := database.Put(point, []byte("5"), []byte("changed"), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRoot(t, database, key, 10)
+	ops := []BatchOp{{Key: []byte("1"), Delete: true}, {Key: []byte("10"), Value: []byte("new")}, {Key: []byte("2"), Delete: true}}
+	if _, err := database.Batch(point, ops, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRoot(t, database, key, 9)
+	if _, err := database.Clear(point, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRoot(t, database, key, 0)
+	if _, _, _, _, err := database.Restore(point, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRoot(t, database, key, 9)
+
+	// the leaf hashes of a database written without them are stored on the next start
+	batch := new(leveldb.Batch)
+	batch.Put(append(append([]byte{}, key.pubkey...), "raw"...), []byte("value"))
+	batch.Put(seqKey(key.pubkey), []byte{0, 0, 0, 0, 0, 0, 1, 0})
+	batch.Delete(leavesIndexedKey)
+	if err := database.db.Write(batch, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexAllLeaves(database.db); err != nil {
+		t.Fatal(err)
+	}
+	checkRoot(t, database, key, 10)
+}
+
+// TestStoredRoot checks the root stored by every commit against the one of all the keys, with the writes
+// anywhere in the key order and after the subtrees are lost
+func TestStoredRoot(t *testing.T) {
+	database := newTestDatabase(t)
+	key := newTestKey(t, 1)
+	point := key.point()
+	random := rand.New(rand.NewSource(1))
+	check := func() {
+		t.Helper()
+		view, err := database.View(key.pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer view.Release()
+		var leaves [][]byte
+		err = view.ForEach(func(key []byte, value []byte) error {
+			leaves = append(leaves, leafHash(key, value))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, err := lastSeq(view.snapshot, key.pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := view.snapshot.Get(rootKey(key.pubkey), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint64(stored) != version || binary.BigEndian.Uint64(stored[8:]) != uint64(len(leaves)) ||
+			!bytes.Equal(stored[16:], merkleRoot(leaves)) {
+			t.Fatalf("stored root of version %d and %d keys, expected %d and %d keys",
+				binary.BigEndian.Uint64(stored), binary.BigEndian.Uint64(stored[8:]), version, len(leaves))
+		}
+	}
+
+	for i := 0; i < 300; i++ {
+		var ops []BatchOp
+		for j := random.Intn(3); j >= 0; j-- {
+			name := []byte(fmt.Sprint(random.Intn(50)))
+			ops = append(ops, BatchOp{Key: name, Value: []byte(fmt.Sprint(i)), Delete: random.Intn(3) == 0})
+		}
+		if _, err := database.Batch(point, ops, nil); err != nil {
+			t.Fatal(err)
+		}
+		check()
+		if i%100 == 50 {
+			// the subtrees are not kept by the databases written before them
+			iterator := database.db.NewIterator(util.BytesPrefix(nodeKeyPrefix(key.pubkey)), nil)
+			for iterator.Next() {
+				if err := database.db.Delete(iterator.Key(), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			iterator.Release()
+		}
+	}
+	if _, err := database.Clear(point, nil); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if _, err := database.Put(point, []byte("again"), []byte("value"), nil); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
@@ -0,0 +1,54 @@
+package main
+
+import "encoding/binary"
+
+// The byte strings signed by the clients. The hash of the message is signed, not the message itself.
+
+// putMessage: uint16 key size, key, uint16 value size, value
+func putMessage(key []byte, value []byte) []byte {
+	message := append(writeUint16(uint16(len(key))), key...)
+	message = append(message, writeUint16(uint16(len(value)))...)
+	return append(message, value...)
+}
+
+// getMessage: "get", uint16 key size, key
+func getMessage(key []byte) []byte {
+	message := append([]byte("get"), writeUint16(uint16(len(key)))...)
+	return append(message, key...)
+}
+
+// historyMessage: "history", uint16 key size, key
+func historyMessage(key []byte) []byte {
+	message := append([]byte("history"), writeUint16(uint16(len(key)))...)
+	return append(message, key...)
+}
+
+// proofMessage: "proof", uint16 key size, key
+func proofMessage(key []byte) []byte {
+	message := append([]byte("proof"), writeUint16(uint16(len(key)))...)
+	return append(message, key...)
+}
+
+// restoreMessage: "restore", uint64 generation, 0 for the last clear, uint64 unix time in nanoseconds
+// of the request, the integers little-endian
+func restoreMessage(generation uint64, timestamp uint64) []byte {
+	message := binary.LittleEndian.AppendUint64([]byte("restore"), generation)
+	return binary.LittleEndian.AppendUint64(message, timestamp)
+}
+
+// batchMessage: "batch", then 'p', uint16 key size, key, uint16 value size, value for every put
+// and 'd', uint16 key size, key for every delete
+func batchMessage(ops []BatchOp) []byte {
+	message := []byte("batch")
+	for _, op := range ops {
+		if op.Delete {
+			message = append(message, 'd')
+			message = append(message, writeUint16(uint16(len(op.Key)))...)
+			message = append(message, op.Key...)
+		} else {
+			message = append(message, 'p')
+			message = append(message, putMessage(op.Key, op.Value)...)
+		}
+	}
+	return message
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The metric names are part of the public interface, see the list in README.md before renaming anything
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kv_http_requests_total",
+		Help: "Number of HTTP requests by endpoint and response status.",
+	}, []string{"endpoint", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kv_http_request_duration_seconds",
+		Help:    "HTTP request latency by endpoint and response status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "status"})
+
+	grpcRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kv_grpc_requests_total",
+		Help: "Number of gRPC calls by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kv_grpc_request_duration_seconds",
+		Help:    "gRPC call latency by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	signatureFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kv_signature_failures_total",
+		Help: "Number of requests rejected because of a wrong signature, by endpoint.",
+	}, []string{"endpoint"})
+
+	putBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kv_put_bytes",
+		Help:    "Size of the key and value written by each successful /put.",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 7),
+	})
+)
+
+var (
+	replicationSequence = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kv_replication_sequence",
+		Help: "Replication sequence number of the last batch written, or applied by a follower.",
+	})
+
+	replicationLeaderSequence = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kv_replication_leader_sequence",
+		Help: "Replication sequence number of the leader, as last seen by the follower.",
+	})
+
+	replicationLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kv_replication_lag_batches",
+		Help: "Number of leader batches not applied by the follower yet.",
+	})
+
+	replicationLagSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kv_replication_lag_seconds",
+		Help: "Age of the last batch applied by the follower while it is behind, 0 when it has caught up.",
+	})
+
+	replicationSnapshots = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kv_replication_snapshots_total",
+		Help: "Number of snapshots of the leader loaded by the follower.",
+	})
+
+	replicationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kv_replication_errors_total",
+		Help: "Number of failed attempts of the follower to get or apply the batches of the leader.",
+	})
+)
+
+var (
+	clusterLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kv_cluster_leader",
+		Help: "1 if this node is the leader of the cluster and accepts the writes, 0 otherwise.",
+	})
+
+	clusterApplied = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kv_cluster_applied_index",
+		Help: "Raft index of the last committed batch written to the database.",
+	})
+
+	clusterErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kv_cluster_apply_errors_total",
+		Help: "Number of committed batches this node could not write to its database.",
+	})
+
+	shardForwarded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kv_shard_forwarded_total",
+		Help: "Number of signed requests forwarded to the shard owning their pubkey, by shard.",
+	}, []string{"shard"})
+
+	shardMoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kv_shard_moved_pubkeys_total",
+		Help: "Number of pubkeys moved from this shard to another one by the rebalancing.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, grpcRequestsTotal, grpcRequestDuration, signatureFailures, putBytes,
+		&databaseCollector{})
+	prometheus.MustRegister(replicationSequence, replicationLeaderSequence, replicationLag, replicationLagSeconds,
+		replicationSnapshots, replicationErrors)
+	prometheus.MustRegister(clusterLeader, clusterApplied, clusterErrors)
+	prometheus.MustRegister(shardForwarded, shardMoved)
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument counts the requests of the endpoint and measures their latency
+func instrument(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, req)
+		status := strconv.Itoa(recorder.status)
+		requestsTotal.WithLabelValues(endpoint, status).Inc()
+		requestDuration.WithLabelValues(endpoint, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+var (
+	levelSizesDesc = prometheus.NewDesc("kv_leveldb_level_size_bytes",
+		"Total size of the tables in each leveldb level.", []string{"level"}, nil)
+	levelTablesDesc = prometheus.NewDesc("kv_leveldb_level_tables",
+		"Number of tables in each leveldb level.", []string{"level"}, nil)
+	compactionsDesc = prometheus.NewDesc("kv_leveldb_compactions_total",
+		"Number of leveldb compactions by type: memory, level0, non_level0 and seek.", []string{"type"}, nil)
+	ioBytesDesc = prometheus.NewDesc("kv_leveldb_io_bytes_total",
+		"Bytes read and written by leveldb.", []string{"direction"}, nil)
+	writeDelaysDesc = prometheus.NewDesc("kv_leveldb_write_delays_total",
+		"Number of writes delayed by leveldb compaction.", nil, nil)
+	pubkeysDesc = prometheus.NewDesc("kv_pubkeys",
+		"Number of distinct pubkeys with at least one stored key.", nil, nil)
+)
+
+// databaseCollector reads the leveldb statistics on every scrape, and the last count of the pubkeys
+type databaseCollector struct{}
+
+func (c *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- levelSizesDesc
+	ch <- levelTablesDesc
+	ch <- compactionsDesc
+	ch <- ioBytesDesc
+	ch <- writeDelaysDesc
+	ch <- pubkeysDesc
+}
+
+func (c *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	if db == nil {
+		return
+	}
+
+	var stats leveldb.DBStats
+	if err := db.Stats(&stats); err != nil {
+		slog.Error("Cannot read the database stats", "error", err)
+		return
+	}
+	for level, size := range stats.LevelSizes {
+		ch <- prometheus.MustNewConstMetric(levelSizesDesc, prometheus.GaugeValue, float64(size), strconv.Itoa(level))
+	}
+	for level, count := range stats.LevelTablesCounts {
+		ch <- prometheus.MustNewConstMetric(levelTablesDesc, prometheus.GaugeValue, float64(count), strconv.Itoa(level))
+	}
+	ch <- prometheus.MustNewConstMetric(compactionsDesc, prometheus.CounterValue, float64(stats.MemComp), "memory")
+	ch <- prometheus.MustNewConstMetric(compactionsDesc, prometheus.CounterValue, float64(stats.Level0Comp), "level0")
+	ch <- prometheus.MustNewConstMetric(compactionsDesc, prometheus.CounterValue, float64(stats.NonLevel0Comp), "non_level0")
+	ch <- prometheus.MustNewConstMetric(compactionsDesc, prometheus.CounterValue, float64(stats.SeekComp), "seek")
+	ch <- prometheus.MustNewConstMetric(ioBytesDesc, prometheus.CounterValue, float64(stats.IORead), "read")
+	ch <- prometheus.MustNewConstMetric(ioBytesDesc, prometheus.CounterValue, float64(stats.IOWrite), "write")
+	ch <- prometheus.MustNewConstMetric(writeDelaysDesc, prometheus.CounterValue, float64(stats.WriteDelayCount))
+
+	// counted in the background by countPubkeysEvery
+	if pubkeys := db.pubkeys.Load(); pubkeys >= 0 {
+		ch <- prometheus.MustNewConstMetric(pubkeysDesc, prometheus.GaugeValue, float64(pubkeys))
+	}
+}
+
+func metricsHandler() http.HandlerFunc {
+	return promhttp.Handler().ServeHTTP
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const binaryContentType = "application/octet-stream"
+
+var maxBodySize int64 = 256 * 1024
+
+// allowMethods rejects the requests with other methods with 405
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, method := range methods {
+			if req.Method == method {
+				handler(w, req)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, req, NewAPIError(http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Method not allowed").
+			WithDetail("method", req.Method))
+	}
+}
+
+// binaryBody accepts only binary request bodies up to maxBodySize. Older clients send no Content-Type at all,
+// so that is accepted too.
+func binaryBody(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if contentType := req.Header.Get("Content-Type"); contentType != "" {
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil || mediaType != binaryContentType {
+				w.Header().Set("Accept", binaryContentType)
+				writeError(w, req, NewAPIError(http.StatusUnsupportedMediaType, ErrUnsupportedMediaType, "Content-Type should be "+binaryContentType).
+					WithDetail("content_type", contentType))
+				return
+			}
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, maxBodySize)
+		handler(w, req)
+	}
+}
+
+// noCache marks the response as not cacheable, all signed API responses are per-user data
+func noCache(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		handler(w, req)
+	}
+}
+
+// handleSigned registers a signed API endpoint: POST with a binary body, routed to the shard of the pubkey
+// in the sharded mode
+func handleSigned(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	if shards != nil {
+		handler = shards.route(handler)
+	}
+	mux.HandleFunc(pattern, withRequestID(instrument(pattern, noCache(allowMethods(binaryBody(handler), http.MethodPost)))))
+}
+
+// handlePublic registers an endpoint without a request body
+func handlePublic(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, withRequestID(instrument(pattern, allowMethods(handler, http.MethodGet, http.MethodHead))))
+}
+
+// handleAdmin registers an endpoint restricted to the administrators
+func handleAdmin(mux *http.ServeMux, pattern string, handler http.HandlerFunc, methods ...string) {
+	mux.HandleFunc(pattern, withRequestID(instrument(pattern, allowMethods(adminOnly(handler), methods...))))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"github.com/ndv/kv/bitcurve"
+	"net/http"
+	"strconv"
+)
+
+// The headers carrying the signed Merkle root of the namespace on the reads
+const (
+	RootHeader          = "X-Kv-Root"
+	RootVersionHeader   = "X-Kv-Root-Version"
+	RootSizeHeader      = "X-Kv-Root-Size"
+	RootTimestampHeader = "X-Kv-Root-Timestamp"
+	RootSignatureHeader = "X-Kv-Root-Signature" // r and s, 64 bytes in hex
+)
+
+func setCommitmentHeaders(w http.ResponseWriter, c *Commitment) {
+	w.Header().Set(RootHeader, hex.EncodeToString(c.Root))
+	w.Header().Set(RootVersionHeader, strconv.FormatUint(c.Version, 10))
+	w.Header().Set(RootSizeHeader, strconv.FormatUint(c.Size, 10))
+	w.Header().Set(RootTimestampHeader, strconv.FormatInt(c.Time.UnixNano(), 10))
+	w.Header().Set(RootSignatureHeader, hex.EncodeToString(append(append([]byte{}, c.R...), c.S...)))
+}
+
+type commitmentJSON struct {
+	Pubkey       string `json:"pubkey"`
+	Version      uint64 `json:"version"`
+	Size         uint64 `json:"size"`
+	Root         string `json:"root"`
+	Timestamp    int64  `json:"timestamp"` // unix time in nanoseconds
+	ServerPubkey string `json:"server_pubkey"`
+	R            string `json:"r"`
+	S            string `json:"s"`
+}
+
+type proofLeafJSON struct {
+	Index     int      `json:"index"`
+	Key       string   `json:"key"`
+	ValueHash string   `json:"value_hash"`
+	Path      []string `json:"path"` // the sibling hashes from the bottom up
+}
+
+type proofJSON struct {
+	Found      bool            `json:"found"`
+	Leaf       *proofLeafJSON  `json:"leaf,omitempty"`
+	Left       *proofLeafJSON  `json:"left,omitempty"`
+	Right      *proofLeafJSON  `json:"right,omitempty"`
+	Commitment *commitmentJSON `json:"commitment"`
+}
+
+func (l *ProofLeaf) toJSON() *proofLeafJSON {
+	if l == nil {
+		return nil
+	}
+	path := make([]string, len(l.Path))
+	for i, hash := range l.Path {
+		path[i] = hex.EncodeToString(hash)
+	}
+	return &proofLeafJSON{Index: l.Index, Key: hex.EncodeToString(l.Key), ValueHash: hex.EncodeToString(l.ValueHash), Path: path}
+}
+
+func (c *Commitment) toJSON() *commitmentJSON {
+	return &commitmentJSON{
+		Pubkey:       hex.EncodeToString(c.Pubkey),
+		Version:      c.Version,
+		Size:         c.Size,
+		Root:         hex.EncodeToString(c.Root),
+		Timestamp:    c.Time.UnixNano(),
+		ServerPubkey: hex.EncodeToString(identity.Pubkey),
+		R:            hex.EncodeToString(c.R),
+		S:            hex.EncodeToString(c.S),
+	}
+}
+
+// handleProof returns the inclusion or non-inclusion proof of ?key= (hex) against the signed root
+func handleProof(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
+	body := bufio.NewReader(req.Body)
+
+	ctx, err := readRequestHeader(body)
+	if httpError(err, w, req, "reading the header") {
+		return
+	}
+
+	key, err := hex.DecodeString(req.URL.Query().Get("key"))
+	if err != nil || len(key) > 0xFFFF {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "The key should be hex").
+			WithDetail("key", req.URL.Query().Get("key")))
+		return
+	}
+
+	if !ctx.checkSignature(proofMessage(key), w, req) || !ctx.checkPubkeyRateLimit(w, req) {
+		return
+	}
+
+	view, err := db.View(bitcurve.MarshallCompressedPoint(ctx.pubkey))
+	if databaseError(err, w, req, "querying the database") {
+		return
+	}
+	defer view.Release()
+	commitment, err := view.Commitment()
+	if databaseError(err, w, req, "computing the root") {
+		return
+	}
+	proof, err := view.Proof(key)
+	if databaseError(err, w, req, "computing the proof") {
+		return
+	}
+	requestLogger(req).Info("Proof", pubkeyAttr(ctx.pubkey), keyAttr(key), "found", proof.Found, "size", commitment.Size)
+	setCommitmentHeaders(w, commitment)
+	writeJSON(w, http.StatusOK, proofJSON{
+		Found:      proof.Found,
+		Leaf:       proof.Leaf.toJSON(),
+		Left:       proof.Left.toJSON(),
+		Right:      proof.Right.toJSON(),
+		Commitment: commitment.toJSON(),
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ndv/kv/bitcurve"
+	"math/bits"
+	"net/http"
+)
+
+const (
+	PowOff = "off" // no proof of work required
+	PowNew = "new" // required for the first write from a pubkey which has no data in the database
+	PowAll = "all" // required for every write
+
+	PowHeader = "X-Pow-Nonce"
+)
+
+// ProofOfWork is a hashcash-style stamp: the client searches for a nonce such that
+// sha256(pubkey || sha256(message) || nonce) starts with Difficulty zero bits.
+// The message is the same byte string that is signed, so a stamp can't be reused for another write.
+type ProofOfWork struct {
+	Mode       string
+	Difficulty int
+}
+
+var pow = ProofOfWork{Mode: PowOff}
+
+// a client needs 2^difficulty hashes on average, 32 bits are already minutes of CPU
+const maxPowDifficulty = 32
+
+type WrongPowModeError struct {
+	mode string
+}
+
+func (e *WrongPowModeError) Error() string {
+	return fmt.Sprintf("Unknown proof of work mode %q, should be one of %s, %s, %s", e.mode, PowOff, PowNew, PowAll)
+}
+
+type WrongPowDifficultyError struct {
+	difficulty int
+}
+
+func (e *WrongPowDifficultyError) Error() string {
+	return fmt.Sprintf("Wrong proof of work difficulty %d, should be from 0 to %d bits", e.difficulty, maxPowDifficulty)
+}
+
+func NewProofOfWork(mode string, difficulty int) (ProofOfWork, error) {
+	if difficulty < 0 || difficulty > maxPowDifficulty {
+		return ProofOfWork{}, &WrongPowDifficultyError{difficulty}
+	}
+	switch mode {
+	case PowOff, PowNew, PowAll:
+		return ProofOfWork{Mode: mode, Difficulty: difficulty}, nil
+	}
+	return ProofOfWork{}, &WrongPowModeError{mode}
+}
+
+func powHash(pubkey []byte, message []byte, nonce []byte) [32]byte {
+	messageHash := sha256.Sum256(message)
+	data := append(append(append([]byte{}, pubkey...), messageHash[:]...), nonce...)
+	return sha256.Sum256(data)
+}
+
+func leadingZeroBits(hash []byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+func (p ProofOfWork) Verify(pubkey []byte, message []byte, nonce []byte) bool {
+	hash := powHash(pubkey, message, nonce)
+	return leadingZeroBits(hash[:]) >= p.Difficulty
+}
+
+func (p ProofOfWork) required(pubkey bitcurve.Point) (bool, error) {
+	switch p.Mode {
+	case PowAll:
+		return true, nil
+	case PowNew:
+		exists, err := db.HasPubkey(pubkey)
+		return !exists, err
+	}
+	return false, nil
+}
+
+// verifyProofOfWork checks the hex-encoded nonce if the server requires a proof of work for the pubkey.
+// It is much cheaper than the signature check, so it runs first.
+func (ctx *CryptoContext) verifyProofOfWork(message []byte, nonceHex string) (bool, error) {
+	required, err := pow.required(ctx.pubkey)
+	if err != nil || !required {
+		return err == nil, err
+	}
+	nonce, err := hex.DecodeString(nonceHex)
+	return err == nil && pow.Verify(bitcurve.MarshallCompressedPoint(ctx.pubkey), message, nonce), nil
+}
+
+// checkProofOfWork verifies the stamp passed in the X-Pow-Nonce header
+func (ctx *CryptoContext) checkProofOfWork(message []byte, w http.ResponseWriter, req *http.Request) bool {
+	ok, err := ctx.verifyProofOfWork(message, req.Header.Get(PowHeader))
+	if databaseError(err, w, req, "querying the database") {
+		return false
+	}
+	if ok {
+		return true
+	}
+
+	requestLogger(req).Info("Missing or insufficient proof of work", pubkeyAttr(ctx.pubkey))
+	writeError(w, req, NewAPIError(http.StatusPreconditionRequired, ErrPowRequired, "Proof of work required").
+		WithDetail("difficulty", pow.Difficulty).WithDetail("header", PowHeader))
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// mine returns the first hex nonce of the proof of work for the message
+func mine(key *testKey, message []byte, difficulty int) string {
+	p := ProofOfWork{Mode: PowAll, Difficulty: difficulty}
+	nonce := make([]byte, 8)
+	for i := uint64(0); ; i++ {
+		binary.LittleEndian.PutUint64(nonce, i)
+		if p.Verify(key.pubkey, message, nonce) {
+			return hex.EncodeToString(nonce)
+		}
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		hash string
+		bits int
+	}{
+		{"ff", 0},
+		{"01", 7},
+		{"0080", 8},
+		{"00000000ff", 32},
+		{"000000007f", 33},
+		{"0000", 16},
+	}
+	for _, test := range tests {
+		hash, _ := hex.DecodeString(test.hash)
+		if bits := leadingZeroBits(hash); bits != test.bits {
+			t.Errorf("%s: %d bits, expected %d", test.hash, bits, test.bits)
+		}
+	}
+}
+
+// TestVerifyProofOfWork checks the nonces at the difficulties 0 and 32 and in the three modes
+func TestVerifyProofOfWork(t *testing.T) {
+	newTestServer(t, nil)
+	key := newTestKey(t, 1)
+	ctx := &CryptoContext{pubkey: key.point()}
+	message := putMessage([]byte("key"), []byte("value"))
+	mined := mine(key, message, 8)
+	tests := []struct {
+		name       string
+		mode       string
+		difficulty int
+		nonce      string
+		stored     bool // the pubkey has data
+		ok         bool
+	}{
+		{name: "off", mode: PowOff, difficulty: 32, nonce: "", ok: true},
+		{name: "all without a nonce", mode: PowAll, difficulty: 8, nonce: "", ok: false},
+		{name: "all", mode: PowAll, difficulty: 8, nonce: mined, ok: true},
+		{name: "all with the data", mode: PowAll, difficulty: 8, nonce: "", stored: true, ok: false},
+		{name: "new without a nonce", mode: PowNew, difficulty: 8, nonce: "", ok: false},
+		{name: "new", mode: PowNew, difficulty: 8, nonce: mined, ok: true},
+		{name: "new with the data", mode: PowNew, difficulty: 8, nonce: "", stored: true, ok: true},
+		{name: "difficulty 0", mode: PowAll, difficulty: 0, nonce: "00", ok: true},
+		{name: "difficulty 0 with an empty nonce", mode: PowAll, difficulty: 0, nonce: "", ok: true},
+		{name: "difficulty 0 with a malformed nonce", mode: PowAll, difficulty: 0, nonce: "0g", ok: false},
+		{name: "malformed nonce", mode: PowAll, difficulty: 8, nonce: mined + "0", ok: false},
+		{name: "difficulty 32", mode: PowAll, difficulty: 32, nonce: mined, ok: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.stored {
+				if _, err := db.Put(key.point(), []byte("stored"), []byte("value"), nil); err != nil {
+					t.Fatal(err)
+				}
+				defer db.Clear(key.point(), nil)
+			}
+			var err error
+			if pow, err = NewProofOfWork(test.mode, test.difficulty); err != nil {
+				t.Fatal(err)
+			}
+			ok, err := ctx.verifyProofOfWork(message, test.nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.ok {
+				t.Errorf("verified %v, expected %v", ok, test.ok)
+			}
+		})
+	}
+}
+
+func TestNewProofOfWork(t *testing.T) {
+	for _, difficulty := range []int{-1, maxPowDifficulty + 1} {
+		if _, err := NewProofOfWork(PowAll, difficulty); err == nil {
+			t.Errorf("difficulty %d accepted", difficulty)
+		}
+	}
+	if _, err := NewProofOfWork("some", 8); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+// TestProofOfWorkResponse checks the 428 of a put without a proof of work and its details
+func TestProofOfWorkResponse(t *testing.T) {
+	server := newTestServer(t, func(config *Config) { config.Limits.Pow, config.Limits.PowDifficulty = PowNew, 8 })
+	key := newTestKey(t, 1)
+	body := key.putRequest(t, "key", "value")
+	status, response := post(t, server.URL+"/put", body, nil)
+	if status != http.StatusPreconditionRequired {
+		t.Fatalf("put without a nonce: %d %s, expected 428", status, response)
+	}
+	var result struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil || result.Error == nil {
+		t.Fatalf("not an error response: %s", response)
+	}
+	if result.Error.Code != ErrPowRequired || result.Error.Details["difficulty"] != float64(8) ||
+		result.Error.Details["header"] != PowHeader {
+		t.Errorf("error %+v, expected %s with the difficulty 8 and the header", result.Error, ErrPowRequired)
+	}
+
+	nonce := mine(key, putMessage([]byte("key"), []byte("value")), 8)
+	if status, response = post(t, server.URL+"/put", body, http.Header{PowHeader: {nonce}}); status != http.StatusOK {
+		t.Fatalf("put with a nonce: %d %s", status, response)
+	}
+	// the pubkey has data now
+	if status, response = post(t, server.URL+"/put", key.putRequest(t, "other", "value"), nil); status != http.StatusOK {
+		t.Errorf("second put without a nonce: %d %s", status, response)
+	}
+}
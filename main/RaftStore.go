@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"strconv"
+	"time"
+)
+
+// RaftStore keeps the Raft log and the Raft state of a cluster node in its own leveldb, apart from the data.
+// 'l' + uint64 big endian index holds a log entry: uint64 term, uint8 type, uint64 unix time in nanoseconds
+// of the append, uint32 data size, the data and the extensions, the integers little-endian.
+// 's' + name holds a value of the stable store.
+const (
+	raftLogPrefix    = 'l'
+	raftStablePrefix = 's'
+)
+
+// the log entries and the votes must survive a crash before Raft relies on them
+var raftSync = &opt.WriteOptions{Sync: true}
+
+type RaftStore struct {
+	db *leveldb.DB
+}
+
+type CorruptedRaftLogError struct {
+	index uint64
+}
+
+func (e *CorruptedRaftLogError) Error() string {
+	return "Corrupted Raft log entry " + strconv.FormatUint(e.index, 10)
+}
+
+type CorruptedRaftStateError struct {
+	key string
+}
+
+func (e *CorruptedRaftStateError) Error() string {
+	return "Corrupted Raft state " + e.key
+}
+
+func NewRaftStore(path string) (*RaftStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &RaftStore{db: db}, nil
+}
+
+func (s *RaftStore) Close() error {
+	return s.db.Close()
+}
+
+func raftLogKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{raftLogPrefix}, index)
+}
+
+func encodeRaftLog(log *raft.Log) []byte {
+	value := binary.LittleEndian.AppendUint64(nil, log.Term)
+	value = append(value, byte(log.Type))
+	value = binary.LittleEndian.AppendUint64(value, uint64(log.AppendedAt.UnixNano()))
+	value = binary.LittleEndian.AppendUint32(value, uint32(len(log.Data)))
+	value = append(value, log.Data...)
+	return append(value, log.Extensions...)
+}
+
+func decodeRaftLog(index uint64, value []byte, log *raft.Log) error {
+	if len(value) < 21 || len(value)-21 < int(binary.LittleEndian.Uint32(value[17:])) {
+		return &CorruptedRaftLogError{index}
+	}
+	size := int(binary.LittleEndian.Uint32(value[17:]))
+	log.Index = index
+	log.Term = binary.LittleEndian.Uint64(value)
+	log.Type = raft.LogType(value[8])
+	log.AppendedAt = time.Unix(0, int64(binary.LittleEndian.Uint64(value[9:])))
+	log.Data = value[21 : 21+size]
+	log.Extensions = value[21+size:]
+	return nil
+}
+
+// index returns the index of the first or the last log entry, 0 if the log is empty
+func (s *RaftStore) index(last bool) (uint64, error) {
+	iterator := s.db.NewIterator(util.BytesPrefix([]byte{raftLogPrefix}), nil)
+	defer iterator.Release()
+	found := iterator.First()
+	if last {
+		found = iterator.Last()
+	}
+	if !found {
+		return 0, iterator.Error()
+	}
+	return binary.BigEndian.Uint64(iterator.Key()[1:]), nil
+}
+
+func (s *RaftStore) FirstIndex() (uint64, error) {
+	return s.index(false)
+}
+
+func (s *RaftStore) LastIndex() (uint64, error) {
+	return s.index(true)
+}
+
+func (s *RaftStore) GetLog(index uint64, log *raft.Log) error {
+	value, err := s.db.Get(raftLogKey(index), nil)
+	if err == leveldb.ErrNotFound {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return decodeRaftLog(index, value, log)
+}
+
+func (s *RaftStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *RaftStore) StoreLogs(logs []*raft.Log) error {
+	batch := new(leveldb.Batch)
+	for _, log := range logs {
+		batch.Put(raftLogKey(log.Index), encodeRaftLog(log))
+	}
+	return s.db.Write(batch, raftSync)
+}
+
+// DeleteRange removes the log entries from min to max inclusive
+func (s *RaftStore) DeleteRange(min, max uint64) error {
+	batch := new(leveldb.Batch)
+	iterator := s.db.NewIterator(&util.Range{Start: raftLogKey(min), Limit: raftLogKey(max + 1)}, nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		batch.Delete(append([]byte{}, iterator.Key()...))
+		if batch.Len() >= 1000 {
+			if err := s.db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+func raftStableKey(key []byte) []byte {
+	return append([]byte{raftStablePrefix}, key...)
+}
+
+func (s *RaftStore) Set(key []byte, value []byte) error {
+	return s.db.Put(raftStableKey(key), value, raftSync)
+}
+
+// Get returns an empty value for a missing key
+func (s *RaftStore) Get(key []byte) ([]byte, error) {
+	value, err := s.db.Get(raftStableKey(key), nil)
+	if err == leveldb.ErrNotFound {
+		return []byte{}, nil
+	}
+	return value, err
+}
+
+func (s *RaftStore) SetUint64(key []byte, value uint64) error {
+	return s.Set(key, binary.BigEndian.AppendUint64(nil, value))
+}
+
+func (s *RaftStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if err != nil || len(value) == 0 {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, &CorruptedRaftStateError{string(key)}
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per key (client IP or pubkey).
+// A limiter with a zero rate never limits anything.
+type RateLimiter struct {
+	name    string  // for the logs
+	rate    float64 // tokens per second
+	burst   float64
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	lastGC  time.Time
+}
+
+func NewRateLimiter(name string, rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		name:    name,
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		lastGC:  time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the given key. If the bucket is empty,
+// it returns false and the time after which the next token becomes available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil || l.rate <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.gc(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// drop the buckets that have been refilled completely, they are indistinguishable from new ones
+func (l *RateLimiter) gc(now time.Time) {
+	if now.Sub(l.lastGC) < time.Minute {
+		return
+	}
+	l.lastGC = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestRateLimiter checks the burst and the refill of the token bucket, the time is moved by setting back
+// the last refill of the bucket
+func TestRateLimiter(t *testing.T) {
+	type step struct {
+		after   time.Duration // since the previous request
+		allowed bool
+		wait    time.Duration // until the next token, when not allowed
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{
+			name:  "burst",
+			rate:  1,
+			burst: 3,
+			steps: []step{{0, true, 0}, {0, true, 0}, {0, true, 0}, {0, false, time.Second}},
+		},
+		{
+			name:  "burst of at least one",
+			rate:  1,
+			burst: 0,
+			steps: []step{{0, true, 0}, {0, false, time.Second}},
+		},
+		{
+			name:  "refill",
+			rate:  2,
+			burst: 1,
+			steps: []step{{0, true, 0}, {0, false, 500 * time.Millisecond}, {250 * time.Millisecond, false, 250 * time.Millisecond},
+				{250 * time.Millisecond, true, 0}},
+		},
+		{
+			name:  "refill up to the burst",
+			rate:  10,
+			burst: 2,
+			steps: []step{{0, true, 0}, {0, true, 0}, {time.Hour, true, 0}, {0, true, 0}, {0, false, 100 * time.Millisecond}},
+		},
+		{
+			name:  "zero rate",
+			rate:  0,
+			burst: 1,
+			steps: []step{{0, true, 0}, {0, true, 0}, {0, true, 0}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewRateLimiter("test", test.rate, test.burst)
+			for i, step := range test.steps {
+				if b := limiter.buckets["key"]; b != nil {
+					b.last = b.last.Add(-step.after)
+				}
+				allowed, wait := limiter.Allow("key")
+				if allowed != step.allowed {
+					t.Fatalf("request %d: allowed %v, expected %v", i, allowed, step.allowed)
+				}
+				// the requests are not instantaneous
+				if wait > step.wait || wait < step.wait-10*time.Millisecond {
+					t.Errorf("request %d: wait %v, expected %v", i, wait, step.wait)
+				}
+			}
+			if allowed, _ := limiter.Allow("other"); !allowed {
+				t.Error("the bucket of another key is not full")
+			}
+		})
+	}
+}
+
+// TestRateLimitResponse checks the 429 of the IP and the pubkey limits and their Retry-After
+func TestRateLimitResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		configure  func(config *Config)
+		limiter    string
+		retryAfter int
+	}{
+		{
+			name:       "ip",
+			configure:  func(config *Config) { config.Limits.IPRate, config.Limits.IPBurst = 0.25, 2 },
+			limiter:    "ip",
+			retryAfter: 4,
+		},
+		{
+			name:       "pubkey",
+			configure:  func(config *Config) { config.Limits.PubkeyRate, config.Limits.PubkeyBurst = 0.5, 2 },
+			limiter:    "pubkey",
+			retryAfter: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, test.configure)
+			key := newTestKey(t, 1)
+			for i := 0; i < 2; i++ {
+				if status, body := post(t, server.URL+"/put", key.putRequest(t, "key", "value"), nil); status != http.StatusOK {
+					t.Fatalf("put %d: %d %s", i, status, body)
+				}
+			}
+			resp, err := http.Post(server.URL+"/put", binaryContentType, bytes.NewReader(key.putRequest(t, "key", "value")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var response struct {
+				Error struct {
+					Code    string         `json:"code"`
+					Details map[string]any `json:"details"`
+				} `json:"error"`
+			}
+			if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusTooManyRequests || response.Error.Code != ErrRateLimited {
+				t.Fatalf("third put: %d %s, expected 429 %s", resp.StatusCode, response.Error.Code, ErrRateLimited)
+			}
+			if retryAfter := resp.Header.Get("Retry-After"); retryAfter != strconv.Itoa(test.retryAfter) {
+				t.Errorf("Retry-After %q, expected %d", retryAfter, test.retryAfter)
+			}
+			if response.Error.Details["limiter"] != test.limiter || response.Error.Details["retry_after"] != float64(test.retryAfter) {
+				t.Errorf("details %v, expected the %s limiter and %d seconds", response.Error.Details, test.limiter, test.retryAfter)
+			}
+		})
+	}
+}
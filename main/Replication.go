@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/syndtr/goleveldb/leveldb"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every batch written to leveldb gets the next replication sequence number, stored in the batch itself
+// under replicationSeqKey, so that a follower applying the batch remembers how far it got.
+// The leader keeps the recent batches in memory for the followers; one that falls behind them,
+// or starts from scratch, copies a snapshot of the whole database first.
+var (
+	replicationSeqKey      = []byte("\x00replication")
+	replicationSnapshotKey = []byte("\x00replication-snapshot") // set while a snapshot is being loaded
+)
+
+// The header with the replication sequence number of the leader, or of the snapshot
+const ReplicationSequenceHeader = "X-Kv-Replication-Sequence"
+
+const (
+	maxReplicationFrames = 1000
+	maxReplicationBytes  = 4 * 1024 * 1024
+)
+
+// ReplicatedBatch is one committed leveldb batch
+type ReplicatedBatch struct {
+	Seq  uint64
+	Time time.Time
+	Data []byte // leveldb.Batch.Dump()
+}
+
+// ReplicationLog keeps the recent batches in memory and wakes up the followers waiting for new ones
+type ReplicationLog struct {
+	lock    sync.Mutex
+	seq     uint64            // the sequence number of the last batch
+	batches []ReplicatedBatch // ring buffer of the last batches
+	start   int
+	count   int
+	changed chan struct{} // closed and replaced on every append
+}
+
+func NewReplicationLog(seq uint64, capacity int) *ReplicationLog {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &ReplicationLog{seq: seq, batches: make([]ReplicatedBatch, capacity), changed: make(chan struct{})}
+}
+
+// appendLocked adds the batch, the caller holds the lock
+func (r *ReplicationLog) appendLocked(batch ReplicatedBatch) {
+	r.seq = batch.Seq
+	if r.count < len(r.batches) {
+		r.batches[(r.start+r.count)%len(r.batches)] = batch
+		r.count++
+	} else {
+		r.batches[r.start] = batch
+		r.start = (r.start + 1) % len(r.batches)
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// resetLocked forgets the batches after a snapshot has been loaded, the caller holds the lock
+func (r *ReplicationLog) resetLocked(seq uint64) {
+	r.seq, r.start, r.count = seq, 0, 0
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Last returns the sequence number of the last batch
+func (r *ReplicationLog) Last() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.seq
+}
+
+// Since returns the batches after the sequence number, at most maxReplicationFrames of them and about
+// maxReplicationBytes, the last sequence number and a channel closed on the next append.
+// ok is false if the batches after since are not kept anymore, or since is ahead of this log.
+func (r *ReplicationLog) Since(since uint64) (batches []ReplicatedBatch, last uint64, changed <-chan struct{}, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	oldest := r.seq - uint64(r.count) + 1
+	if since+1 < oldest || since > r.seq {
+		return nil, r.seq, r.changed, false
+	}
+	size := 0
+	for i := int(since + 1 - oldest); i < r.count && len(batches) < maxReplicationFrames && size < maxReplicationBytes; i++ {
+		batch := r.batches[(r.start+i)%len(r.batches)]
+		batches = append(batches, batch)
+		size += len(batch.Data)
+	}
+	return batches, r.seq, r.changed, true
+}
+
+func readReplicationSeq(reader leveldb.Reader) (uint64, error) {
+	value, err := reader.Get(replicationSeqKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, &CorruptedChangeError{}
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// write is the only way the batches get to leveldb, so that the followers see all of them in the commit order.
+// The events of the pubkey are published once the batch is written. In the clustered mode the batch is
+// committed through Raft first, and every node of the cluster writes it in applyCommitted.
+// The leaf hashes of the data keys written by the batch are added to it here, and the audit log entry
+// of the signed request, if not nil, when the batch is written.
+func (db *Database) write(batch *leveldb.Batch, pubkey []byte, signed *SignedRequest, events ...ChangeEvent) error {
+	if err := indexLeaves(batch); err != nil {
+		return err
+	}
+	if db.audit.Load() == nil {
+		signed = nil
+	}
+	if c := db.cluster.Load(); c != nil {
+		return c.propose(batch, pubkey, signed, time.Now(), events)
+	}
+	return db.writeBatch(batch, pubkey, signed, time.Now(), events)
+}
+
+// writeBatch writes the batch with the next replication sequence number and the audit log entry of the signed
+// request made at now, and publishes the events. The replication lock orders the batches, the audit entries
+// and the events the same way.
+func (db *Database) writeBatch(batch *leveldb.Batch, pubkey []byte, signed *SignedRequest, now time.Time, events []ChangeEvent) error {
+	db.replication.lock.Lock()
+	defer db.replication.lock.Unlock()
+	seq := db.replication.seq + 1
+	batch.Put(replicationSeqKey, binary.BigEndian.AppendUint64(nil, seq))
+	audit := db.appendAuditLog(batch, signed, now)
+	if err := db.db.Write(batch, nil); err != nil {
+		return err
+	}
+	if audit != nil {
+		db.audit.Store(audit)
+	}
+	// the callers reuse their batches after a Reset, so the data is copied
+	db.replication.appendLocked(ReplicatedBatch{Seq: seq, Time: now, Data: append([]byte{}, batch.Dump()...)})
+	replicationSequence.Set(float64(seq))
+	db.feed.publish(pubkey, events...)
+	return nil
+}
+
+// Replication returns the log of the recent batches
+func (db *Database) Replication() *ReplicationLog {
+	return db.replication
+}
+
+// writeReplicationFrame writes uint64 sequence number, uint64 unix time in nanoseconds, uint32 size and the batch,
+// the integers little-endian
+func writeReplicationFrame(w io.Writer, batch ReplicatedBatch) error {
+	header := binary.LittleEndian.AppendUint64(nil, batch.Seq)
+	header = binary.LittleEndian.AppendUint64(header, uint64(batch.Time.UnixNano()))
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(batch.Data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(batch.Data)
+	return err
+}
+
+func readReplicationFrame(r io.Reader) (ReplicatedBatch, error) {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return ReplicatedBatch{}, err
+	}
+	batch := ReplicatedBatch{
+		Seq:  binary.LittleEndian.Uint64(header),
+		Time: time.Unix(0, int64(binary.LittleEndian.Uint64(header[8:]))),
+		Data: make([]byte, binary.LittleEndian.Uint32(header[16:])),
+	}
+	_, err := io.ReadFull(r, batch.Data)
+	return batch, err
+}
+
+// WriteSnapshot streams all the keys of a consistent snapshot, each as uint32 key size, key, uint32 value size
+// and value, little-endian, followed by a zero key size. started is called with the replication sequence number
+// of the snapshot before anything is written.
+func (db *Database) WriteSnapshot(w io.Writer, started func(seq uint64)) error {
+	snapshot, err := db.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+	seq, err := readReplicationSeq(snapshot)
+	if err != nil {
+		return err
+	}
+	started(seq)
+	return writeSnapshot(snapshot, w)
+}
+
+// writeSnapshot streams the keys of the leveldb snapshot in the format of WriteSnapshot
+func writeSnapshot(snapshot *leveldb.Snapshot, w io.Writer) error {
+	iterator := snapshot.NewIterator(nil, nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		key := iterator.Key()
+		if string(key) == string(readyCheckKey) || string(key) == string(replicationSnapshotKey) {
+			continue
+		}
+		if err := writeSnapshotEntry(w, key, iterator.Value()); err != nil {
+			return err
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+	return writeSnapshotEnd(w)
+}
+
+// writeSnapshotEntry writes one key and value of a snapshot, each of them preceded by its uint32 size
+func writeSnapshotEntry(w io.Writer, key []byte, value []byte) error {
+	frame := binary.LittleEndian.AppendUint32(nil, uint32(len(key)))
+	frame = append(frame, key...)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(value)))
+	if _, err := w.Write(frame); err != nil {
+		return err
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+// writeSnapshotEnd writes the empty key ending a snapshot
+func writeSnapshotEnd(w io.Writer) error {
+	_, err := w.Write(binary.LittleEndian.AppendUint32(nil, 0))
+	return err
+}
+
+// handleReplicationStream sends the batches committed after ?since=, waiting up to ?timeout= seconds for new ones
+func handleReplicationStream(w http.ResponseWriter, req *http.Request) {
+	since, ok := parseUintParam(w, req, "since", 0)
+	if !ok {
+		return
+	}
+	timeout := maxWatchTimeout
+	if s := req.URL.Query().Get("timeout"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds < 0 {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong timeout value").WithDetail("timeout", s))
+			return
+		}
+		timeout = min(time.Duration(seconds*float64(time.Second)), maxWatchTimeout)
+	}
+	if timeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		batches, last, changed, ok := db.Replication().Since(since)
+		if !ok {
+			writeError(w, req, NewAPIError(http.StatusGone, ErrSequenceExpired, "The batches after this sequence number are not kept anymore").
+				WithDetail("since", since).WithDetail("last", last))
+			return
+		}
+		if len(batches) > 0 {
+			w.Header().Set("Content-Type", binaryContentType)
+			w.Header().Set(ReplicationSequenceHeader, strconv.FormatUint(last, 10))
+			out := bufio.NewWriter(w)
+			for _, batch := range batches {
+				if err := writeReplicationFrame(out, batch); err != nil {
+					return
+				}
+			}
+			out.Flush()
+			return
+		}
+		select {
+		case <-changed:
+			continue
+		case <-timer.C:
+		case <-stopping:
+		case <-req.Context().Done():
+			return
+		}
+		w.Header().Set(ReplicationSequenceHeader, strconv.FormatUint(last, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+}
+
+// handleReplicationSnapshot sends all the keys of the database for a follower to start from
+func handleReplicationSnapshot(w http.ResponseWriter, req *http.Request) {
+	// a snapshot can take longer than the usual write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	out := bufio.NewWriterSize(w, 64*1024)
+	var seq uint64
+	started := false
+	err := db.WriteSnapshot(out, func(snapshotSeq uint64) {
+		seq, started = snapshotSeq, true
+		w.Header().Set("Content-Type", binaryContentType)
+		w.Header().Set(ReplicationSequenceHeader, strconv.FormatUint(seq, 10))
+	})
+	if !started {
+		databaseError(err, w, req, "reading the snapshot")
+		return
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		// without the final zero key size the follower sees the snapshot as truncated
+		requestLogger(req).Error("Snapshot failed", "seq", seq, "error", err)
+		return
+	}
+	requestLogger(req).Info("Snapshot", "seq", seq)
+}
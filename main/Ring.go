@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Ring assigns the pubkeys to the shards by consistent hashing. Every shard has a number of virtual nodes,
+// points on a ring of uint64 hashes, and a pubkey belongs to the shard of the first point at or after its hash.
+// When a shard joins or leaves, only the pubkeys between its points and the preceding ones change the owner.
+type Ring struct {
+	points []uint64
+	owners []string // the shard of each point
+	shards []string
+}
+
+func ringHash(data []byte) uint64 {
+	hash := sha256.Sum256(data)
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// NewRing places virtualNodes points of every shard on the ring, the shards are identified by their URLs,
+// so all the nodes given the same list build the same ring whatever its order
+func NewRing(shards []string, virtualNodes int) *Ring {
+	r := &Ring{shards: shards}
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(shards)*virtualNodes)
+	for _, shard := range shards {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{ringHash([]byte(shard + "#" + strconv.Itoa(i))), shard})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	r.points = make([]uint64, len(points))
+	r.owners = make([]string, len(points))
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.owners[i] = p.owner
+	}
+	return r
+}
+
+// Owner returns the URL of the shard of the compressed pubkey
+func (r *Ring) Owner(pubkey []byte) string {
+	hash := ringHash(pubkey)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+func (r *Ring) Shards() []string {
+	return r.shards
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+// ringPubkeys returns pubkey-like keys, the ring only hashes them
+func ringPubkeys(n int) [][]byte {
+	pubkeys := make([][]byte, n)
+	for i := range pubkeys {
+		hash := sha256.Sum256(binary.BigEndian.AppendUint64(nil, uint64(i)))
+		pubkeys[i] = append([]byte{2}, hash[:]...)
+	}
+	return pubkeys
+}
+
+func TestRingDistribution(t *testing.T) {
+	shards := []string{"http://a", "http://b", "http://c", "http://d"}
+	ring := NewRing(shards, 128)
+	counts := map[string]int{}
+	pubkeys := ringPubkeys(20000)
+	for _, pubkey := range pubkeys {
+		counts[ring.Owner(pubkey)]++
+	}
+	expected := len(pubkeys) / len(shards)
+	for _, shard := range shards {
+		if counts[shard] < expected*3/4 || counts[shard] > expected*5/4 {
+			t.Errorf("%s has %d pubkeys, expected about %d", shard, counts[shard], expected)
+		}
+	}
+
+	reversed := NewRing([]string{"http://d", "http://c", "http://b", "http://a"}, 128)
+	for _, pubkey := range pubkeys {
+		if reversed.Owner(pubkey) != ring.Owner(pubkey) {
+			t.Fatal("the owners depend on the order of the shards")
+		}
+	}
+}
+
+// TestRingStability checks that only the pubkeys of the shard joining or leaving change their shard
+func TestRingStability(t *testing.T) {
+	shards := []string{"http://a", "http://b", "http://c", "http://d"}
+	ring := NewRing(shards, 128)
+	grown := NewRing(append(append([]string{}, shards...), "http://e"), 128)
+	shrunk := NewRing(shards[1:], 128)
+	pubkeys := ringPubkeys(20000)
+	joined := 0
+	for _, pubkey := range pubkeys {
+		before, after := ring.Owner(pubkey), grown.Owner(pubkey)
+		if before != after {
+			if after != "http://e" {
+				t.Fatalf("a pubkey of %s moved to %s when http://e joined", before, after)
+			}
+			joined++
+		}
+		before, after = ring.Owner(pubkey), shrunk.Owner(pubkey)
+		if before != after && before != "http://a" {
+			t.Fatalf("a pubkey of %s moved to %s when http://a left", before, after)
+		}
+		if before == "http://a" && after == "http://a" {
+			t.Fatal("a pubkey stayed with http://a after it left")
+		}
+	}
+	expected := len(pubkeys) / 5
+	if joined < expected*3/4 || joined > expected*5/4 {
+		t.Errorf("%d pubkeys moved to the new shard, expected about %d", joined, expected)
+	}
+}
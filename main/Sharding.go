@@ -0,0 +1,803 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/ndv/kv/bitcurve"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In the sharded mode the pubkeys are split among the shards by consistent hashing, every key of a pubkey
+// starts with it, so each shard keeps whole pubkeys. A shard serves the signed requests of its pubkeys and
+// forwards the others to their shard, a router serves no data and forwards them all.
+// 'm' + pubkey holds the URL of the shard the pubkey has been moved to by a rebalancing, until the ring
+// changes too. A shard also owns the pubkeys it has imported before the ring changes, once their move is
+// complete: until then 'm' + pubkey points back to the shard moving them.
+const movedPrefix = 'm'
+
+// ShardForwardedHeader is set on the requests forwarded to the owning shard, so that they are not forwarded again
+const ShardForwardedHeader = "X-Kv-Shard-Forwarded"
+
+// shards is set when the server is a shard or a router
+var shards *Shards
+
+// routedEndpoints are the signed endpoints a router forwards to the shards
+var routedEndpoints = []string{"/put", "/clear", "/restore", "/getAll", "/watch", "/changes", "/get", "/history", "/proof"}
+
+type Shards struct {
+	ring      *Ring
+	db        *Database // nil on a router
+	config    ShardingConfig
+	client    *http.Client
+	proxies   sync.Map     // the shard URL to its *httputil.ReverseProxy
+	lock      sync.RWMutex // held for reading by the local writes, and for writing while a pubkey is moved away
+	rebalance sync.Mutex   // one rebalancing at a time
+}
+
+type WrongShardsError struct {
+	shards string
+}
+
+func (e *WrongShardsError) Error() string {
+	return "Wrong shard list " + strconv.Quote(e.shards) + ", expected comma-separated http:// or https:// URLs"
+}
+
+type WrongShardError struct {
+	owner string
+}
+
+func (e *WrongShardError) Error() string {
+	return "The pubkey belongs to the shard " + e.owner
+}
+
+type NotAShardError struct {
+	self string
+}
+
+func (e *NotAShardError) Error() string {
+	return "This shard " + e.self + " is not in the shard list"
+}
+
+type ShardImportError struct {
+	shard  string
+	status int
+	err    error // nil if the shard has responded
+}
+
+func (e *ShardImportError) Error() string {
+	if e.err != nil {
+		return "Cannot import the pubkey to the shard " + e.shard + ": " + e.err.Error()
+	}
+	return "The shard " + e.shard + " responded with " + strconv.Itoa(e.status) + " to the import"
+}
+
+func (e *ShardImportError) Unwrap() error {
+	return e.err
+}
+
+// parseShards splits the comma-separated shard URLs
+func parseShards(list string) ([]string, error) {
+	var urls []string
+	for _, shard := range strings.Split(list, ",") {
+		shard = strings.TrimRight(strings.TrimSpace(shard), "/")
+		if shard == "" {
+			continue
+		}
+		if checkNodeURL(shard) != nil {
+			return nil, &WrongShardsError{list}
+		}
+		urls = append(urls, shard)
+	}
+	if len(urls) == 0 {
+		return nil, &WrongShardsError{list}
+	}
+	return urls, nil
+}
+
+// NewShards builds the ring of the configured shards, db is nil on a router
+func NewShards(db *Database, config ShardingConfig) (*Shards, error) {
+	urls, err := parseShards(config.Shards)
+	if err != nil {
+		return nil, err
+	}
+	config.Self = strings.TrimRight(config.Self, "/")
+	if db != nil && !contains(urls, config.Self) {
+		return nil, &NotAShardError{config.Self}
+	}
+	if db == nil {
+		config.Self = ""
+	}
+	transport, err := newAdminTransport(config.ClientCert, config.ClientKey, config.CA)
+	if err != nil {
+		return nil, err
+	}
+	s := &Shards{
+		ring:   NewRing(urls, max(config.VirtualNodes, 1)),
+		db:     db,
+		config: config,
+		client: &http.Client{Transport: transport},
+	}
+	if db != nil {
+		db.shards.Store(s)
+	}
+	return s, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func movedKey(pubkey []byte) []byte {
+	return append([]byte{movedPrefix}, pubkey...)
+}
+
+// pubkeyPrefixes returns the prefixes of all the keys moved with the pubkey. The audit log stays,
+// its entries are chained with the other pubkeys of the shard.
+func pubkeyPrefixes(pubkey []byte) [][]byte {
+	return [][]byte{
+		pubkey,
+		seqKey(pubkey),
+		append([]byte{changeLogPrefix}, pubkey...),
+		append([]byte{historyPrefix}, pubkey...),
+		trashPubkeyPrefix(pubkey),
+		rootKey(pubkey),
+		nodeKeyPrefix(pubkey),
+	}
+}
+
+// owner returns the URL of the shard of the pubkey: the one it has been moved to, this shard if it has
+// the keys of the pubkey, or the owner on the ring
+func (s *Shards) owner(pubkey []byte) (string, error) {
+	owner := s.ring.Owner(pubkey)
+	if s.db == nil {
+		return owner, nil
+	}
+	moved, err := s.db.db.Get(movedKey(pubkey), nil)
+	if err == nil {
+		return string(moved), nil
+	}
+	if err != leveldb.ErrNotFound {
+		return "", err
+	}
+	if owner != s.config.Self {
+		has, err := hasPubkey(s.db.db, pubkey)
+		if err != nil {
+			return "", err
+		}
+		if has {
+			return s.config.Self, nil
+		}
+	}
+	return owner, nil
+}
+
+// hasPubkey returns true if the database has a key or a sequence number of the pubkey
+func hasPubkey(reader leveldb.Reader, pubkey []byte) (bool, error) {
+	_, err := reader.Get(seqKey(pubkey), nil)
+	if err != leveldb.ErrNotFound {
+		return err == nil, err
+	}
+	iterator := reader.NewIterator(util.BytesPrefix(pubkey), nil)
+	defer iterator.Release()
+	return iterator.First(), iterator.Error()
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// route serves the signed request if this shard owns its pubkey and forwards it to the owner otherwise.
+// handler is nil on a router. The writes check the owner again when they commit, see lockWrite.
+func (s *Shards) route(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		header := make([]byte, 97) // r, s and the compressed pubkey
+		n, err := io.ReadFull(req.Body, header)
+		req.Body = peekedBody{io.MultiReader(bytes.NewReader(header[:n]), req.Body), req.Body}
+		if err != nil {
+			// the handler rejects the request as usual
+			if handler != nil {
+				handler(w, req)
+				return
+			}
+			httpError(err, w, req, "reading the request header")
+			return
+		}
+		owner, err := s.owner(header[64:])
+		if databaseError(err, w, req, "reading the shard of the pubkey") {
+			return
+		}
+		if owner == s.config.Self {
+			handler(w, req)
+			return
+		}
+		if req.Header.Get(ShardForwardedHeader) != "" {
+			writeError(w, req, wrongShardError(owner))
+			return
+		}
+		s.forward(owner, w, req)
+	}
+}
+
+func (s *Shards) forward(owner string, w http.ResponseWriter, req *http.Request) {
+	requestLogger(req).Debug("Forwarding to the shard", "shard", owner)
+	shardForwarded.WithLabelValues(owner).Inc()
+	if s.db != nil {
+		req.Header.Set(ShardForwardedHeader, s.config.Self)
+	}
+	s.proxy(owner).ServeHTTP(w, req)
+}
+
+func (s *Shards) proxy(shard string) *httputil.ReverseProxy {
+	if proxy, ok := s.proxies.Load(shard); ok {
+		return proxy.(*httputil.ReverseProxy)
+	}
+	target, _ := url.Parse(shard) // checked by parseShards or by the shard that has moved the pubkey
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = s.client.Transport
+	forwardClientIP(proxy)
+	actual, _ := s.proxies.LoadOrStore(shard, proxy)
+	return actual.(*httputil.ReverseProxy)
+}
+
+func wrongShardError(owner string) *APIError {
+	return NewAPIError(http.StatusMisdirectedRequest, ErrWrongShard, "The pubkey belongs to another shard").
+		WithDetail("shard", owner)
+}
+
+// shardGRPC checks that the pubkey of a gRPC call belongs to this shard, gRPC calls are not forwarded
+func shardGRPC(ctx context.Context, crypto *CryptoContext) error {
+	if shards == nil {
+		return nil
+	}
+	owner, err := shards.owner(bitcurve.MarshallCompressedPoint(crypto.pubkey))
+	if err != nil {
+		return grpcStorageError(ctx, err, "reading the shard of the pubkey")
+	}
+	if owner != shards.config.Self {
+		return grpcError(ctx, wrongShardError(owner))
+	}
+	return nil
+}
+
+// hold takes the read lock if this shard owns the pubkey, so that the pubkey is not moved away until
+// the returned function is called, and fails with WrongShardError otherwise
+func (s *Shards) hold(pubkey []byte) (func(), error) {
+	s.lock.RLock()
+	owner, err := s.owner(pubkey)
+	if err == nil && owner != s.config.Self {
+		err = &WrongShardError{owner}
+	}
+	if err != nil {
+		s.lock.RUnlock()
+		return nil, err
+	}
+	return s.lock.RUnlock, nil
+}
+
+// lockWrite takes the write lock of the pubkey, one of pubkeyLocks chosen by its last byte. On a shard it
+// also holds the pubkey, which fails with WrongShardError if the pubkey has been moved away since the request
+// was routed.
+func (db *Database) lockWrite(pubkey []byte) (func(), error) {
+	release := func() {}
+	if s := db.shards.Load(); s != nil {
+		var err error
+		if release, err = s.hold(pubkey); err != nil {
+			return nil, err
+		}
+	}
+	unlock := db.lockPubkey(pubkey)
+	return func() {
+		unlock()
+		release()
+	}, nil
+}
+
+// lockPubkey takes the write lock of the pubkey without the shard checks, for the background writers
+func (db *Database) lockPubkey(pubkey []byte) func() {
+	lock := &db.pubkeyLocks[pubkey[len(pubkey)-1]]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// rebalancedKeys are the keys Rebalance finds the pubkeys in, with the offset of the pubkey in the key:
+// the data, then the sequence numbers of the pubkeys left with only a change log, history or trash
+var rebalancedKeys = []struct {
+	keys   *util.Range
+	offset int
+}{
+	{dataRange, 0},
+	{&util.Range{Start: []byte{seqPrefix}, Limit: []byte{seqPrefix + 1}}, 1},
+}
+
+// pubkeysAfter returns up to limit pubkeys of the keys from start to the end of the range, the pubkey
+// at offset in the key, and the key to continue from, nil at the end
+func (s *Shards) pubkeysAfter(keys *util.Range, offset int, start []byte, limit int) (pubkeys [][]byte, next []byte, err error) {
+	iterator := s.db.db.NewIterator(&util.Range{Start: start, Limit: keys.Limit}, nil)
+	defer iterator.Release()
+	for ok := iterator.First(); ok; {
+		key := iterator.Key()
+		if len(key) < offset+33 {
+			ok = iterator.Next()
+			continue
+		}
+		if len(pubkeys) == limit {
+			return pubkeys, append([]byte{}, key...), nil
+		}
+		pubkeys = append(pubkeys, append([]byte{}, key[offset:offset+33]...))
+		// the other keys of the pubkey are skipped
+		ok = iterator.Seek(util.BytesPrefix(key[:offset+33]).Limit)
+	}
+	return pubkeys, nil, iterator.Error()
+}
+
+// Rebalance moves the pubkeys of this shard that belong to another shard on the ring to their shard,
+// and points the moved records of the pubkeys moved before to their new shard. It returns the number
+// of the moved pubkeys.
+func (s *Shards) Rebalance(ctx context.Context, ring *Ring) (int, error) {
+	s.rebalance.Lock()
+	defer s.rebalance.Unlock()
+	moved := 0
+	for _, keys := range rebalancedKeys {
+		start := keys.keys.Start
+		for start != nil {
+			pubkeys, next, err := s.pubkeysAfter(keys.keys, keys.offset, start, 1000)
+			if err != nil {
+				return moved, err
+			}
+			for _, pubkey := range pubkeys {
+				owner := ring.Owner(pubkey)
+				if owner == s.config.Self {
+					continue
+				}
+				// a pubkey still being moved here by another shard
+				importing, err := s.db.db.Has(movedKey(pubkey), nil)
+				if err != nil {
+					return moved, err
+				}
+				if importing {
+					continue
+				}
+				if err := s.move(ctx, pubkey, owner); err != nil {
+					return moved, err
+				}
+				moved++
+			}
+			start = next
+		}
+	}
+	return moved, s.redirectMoved(ring)
+}
+
+// the changes made while the keys of a pubkey are sent are sent again while the pubkey is still written,
+// for at most maxCatchUpRounds rounds until there are at most smallDelta of them
+const (
+	maxCatchUpRounds = 5
+	smallDelta       = 100
+)
+
+// move sends all the keys of the pubkey to the shard, then deletes them and records where they have gone.
+// The keys are sent from a snapshot while the pubkey is still written, then the changes made meanwhile,
+// and only the last few changes are sent while the writes of the shard wait.
+func (s *Shards) move(ctx context.Context, pubkey []byte, shard string) error {
+	snapshot, err := s.db.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer func() { snapshot.Release() }()
+	reader, writer := io.Pipe()
+	go func() {
+		out := bufio.NewWriterSize(writer, 64*1024)
+		err := forEachPubkeyKey(snapshot, pubkey, func(key []byte, value []byte) error {
+			return writeSnapshotEntry(out, key, value)
+		})
+		if err == nil {
+			err = writeSnapshotEnd(out)
+		}
+		if err == nil {
+			err = out.Flush()
+		}
+		writer.CloseWithError(err)
+	}()
+	err = s.sendImport(ctx, shard, pubkey, "", reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	for round := 0; round < maxCatchUpRounds; round++ {
+		next, err := s.db.db.GetSnapshot()
+		if err != nil {
+			return err
+		}
+		delta, err := pubkeyDelta(snapshot, next, pubkey)
+		snapshot.Release()
+		snapshot = next
+		if err != nil {
+			return err
+		}
+		if delta.Len() == 0 {
+			break
+		}
+		if err := s.sendImport(ctx, shard, pubkey, "true", bytes.NewReader(delta.Dump())); err != nil {
+			return err
+		}
+		changed += delta.Len()
+		if delta.Len() <= smallDelta {
+			break
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current, err := s.db.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer current.Release()
+	delta, err := pubkeyDelta(snapshot, current, pubkey)
+	if err != nil {
+		return err
+	}
+	if err := s.sendImport(ctx, shard, pubkey, "final", bytes.NewReader(delta.Dump())); err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	err = forEachPubkeyKey(current, pubkey, func(key []byte, value []byte) error {
+		batch.Delete(append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	batch.Put(movedKey(pubkey), []byte(shard))
+	if err := s.db.write(batch, nil, nil); err != nil {
+		return err
+	}
+	shardMoved.Inc()
+	slog.Debug("Pubkey moved", "pubkey", privateValue(logPubkeys, pubkey), "shard", shard, "keys", batch.Len()-1,
+		"changed", changed+delta.Len(), "changed_locked", delta.Len())
+	return nil
+}
+
+// pubkeyDelta returns the changes of the keys moved with the pubkey from one snapshot to the other
+func pubkeyDelta(from *leveldb.Snapshot, to *leveldb.Snapshot, pubkey []byte) (*leveldb.Batch, error) {
+	delta := new(leveldb.Batch)
+	for _, prefix := range pubkeyPrefixes(pubkey) {
+		if err := diffKeys(from, to, prefix, delta); err != nil {
+			return nil, err
+		}
+	}
+	return delta, nil
+}
+
+// sendImport posts the keys of the pubkey to /shard/import of the shard, all of them in the snapshot format
+// with an empty delta, or the changes since the last request as a leveldb batch with delta "true",
+// the last ones with "final". The request is given up after the import timeout.
+func (s *Shards) sendImport(ctx context.Context, shard string, pubkey []byte, delta string, body io.Reader) error {
+	target, _ := url.Parse(shard)
+	target = target.JoinPath("/shard/import")
+	query := url.Values{"pubkey": {hex.EncodeToString(pubkey)}}
+	if delta != "" {
+		query.Set("delta", delta)
+	}
+	target.RawQuery = query.Encode()
+	ctx, cancel := context.WithTimeout(ctx, s.config.ImportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), body)
+	if err != nil {
+		return &ShardImportError{shard, 0, err}
+	}
+	req.Header.Set("Content-Type", binaryContentType)
+	req.Header.Set(ShardForwardedHeader, s.config.Self)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &ShardImportError{shard, 0, err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &ShardImportError{shard, resp.StatusCode, nil}
+	}
+	return nil
+}
+
+// diffKeys adds to the batch the changes of the keys with the prefix from one snapshot to the other
+func diffKeys(from leveldb.Reader, to leveldb.Reader, prefix []byte, batch *leveldb.Batch) error {
+	old := from.NewIterator(util.BytesPrefix(prefix), nil)
+	defer old.Release()
+	current := to.NewIterator(util.BytesPrefix(prefix), nil)
+	defer current.Release()
+	hasOld, hasCurrent := old.Next(), current.Next()
+	for hasOld || hasCurrent {
+		order := -1
+		if !hasOld {
+			order = 1
+		} else if hasCurrent {
+			order = bytes.Compare(old.Key(), current.Key())
+		}
+		switch {
+		case order < 0:
+			batch.Delete(old.Key())
+			hasOld = old.Next()
+		case order > 0:
+			batch.Put(current.Key(), current.Value())
+			hasCurrent = current.Next()
+		default:
+			if !bytes.Equal(old.Value(), current.Value()) {
+				batch.Put(current.Key(), current.Value())
+			}
+			hasOld, hasCurrent = old.Next(), current.Next()
+		}
+	}
+	if err := old.Error(); err != nil {
+		return err
+	}
+	return current.Error()
+}
+
+// forEachPubkeyKey calls fn for every key moved with the pubkey
+func forEachPubkeyKey(reader leveldb.Reader, pubkey []byte, fn func(key []byte, value []byte) error) error {
+	for _, prefix := range pubkeyPrefixes(pubkey) {
+		iterator := reader.NewIterator(util.BytesPrefix(prefix), nil)
+		for iterator.Next() {
+			if err := fn(iterator.Key(), iterator.Value()); err != nil {
+				iterator.Release()
+				return err
+			}
+		}
+		iterator.Release()
+		if err := iterator.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redirectMoved points the moved records to the owners on the ring, where the other shards move the pubkeys.
+// The records of the pubkeys coming back to this shard are deleted by their import.
+func (s *Shards) redirectMoved(ring *Ring) error {
+	iterator := s.db.db.NewIterator(util.BytesPrefix([]byte{movedPrefix}), nil)
+	defer iterator.Release()
+	batch := new(leveldb.Batch)
+	for iterator.Next() {
+		owner := ring.Owner(iterator.Key()[1:])
+		if owner != s.config.Self && owner != string(iterator.Value()) {
+			batch.Put(append([]byte{}, iterator.Key()...), []byte(owner))
+		}
+		if batch.Len() >= 1000 {
+			if err := s.db.write(batch, nil, nil); err != nil {
+				return err
+			}
+			batch = new(leveldb.Batch)
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return s.db.write(batch, nil, nil)
+}
+
+func parsePubkeyParam(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	pubkey, err := hex.DecodeString(req.URL.Query().Get("pubkey"))
+	if err != nil || len(pubkey) != 33 || (pubkey[0] != 2 && pubkey[0] != 3) {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadPubkey, "Wrong pubkey, expected 33 bytes in hex"))
+		return nil, false
+	}
+	return pubkey, true
+}
+
+type shardStatusJSON struct {
+	Self   string   `json:"self,omitempty"`
+	Shards []string `json:"shards"`
+	Owner  string   `json:"owner,omitempty"`
+}
+
+// handleShard returns the shard list and, with ?pubkey=, the shard of the pubkey
+func handleShard(w http.ResponseWriter, req *http.Request) {
+	status := shardStatusJSON{Self: shards.config.Self, Shards: shards.ring.Shards()}
+	if req.URL.Query().Has("pubkey") {
+		pubkey, ok := parsePubkeyParam(w, req)
+		if !ok {
+			return
+		}
+		owner, err := shards.owner(pubkey)
+		if databaseError(err, w, req, "reading the shard of the pubkey") {
+			return
+		}
+		status.Owner = owner
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleShardImport replaces the keys of ?pubkey= with the ones in the body, sent by the shard moving it here
+// in the snapshot format. The pubkey stays with that shard while it sends the changes made since, as
+// leveldb batches with ?delta=true, until the last ones with ?delta=final.
+func handleShardImport(w http.ResponseWriter, req *http.Request) {
+	pubkey, ok := parsePubkeyParam(w, req)
+	if !ok {
+		return
+	}
+	source := req.Header.Get(ShardForwardedHeader)
+	if err := checkNodeURL(source); err != nil {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "The shard moving the pubkey is required in "+
+			ShardForwardedHeader))
+		return
+	}
+	switch delta := req.URL.Query().Get("delta"); delta {
+	case "":
+	case "true", "final":
+		importDelta(pubkey, delta == "final", w, req)
+		return
+	default:
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong delta value").WithDetail("delta", delta))
+		return
+	}
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	prefixes := pubkeyPrefixes(pubkey)
+	batch := new(leveldb.Batch)
+	// the leftovers of an earlier move of the pubkey to this shard
+	err := forEachPubkeyKey(db.db, pubkey, func(key []byte, value []byte) error {
+		batch.Delete(append([]byte{}, key...))
+		return nil
+	})
+	if databaseError(err, w, req, "reading the keys of the pubkey") {
+		return
+	}
+
+	in := bufio.NewReaderSize(req.Body, 64*1024)
+	keys := 0
+	for {
+		key, err := readSnapshotBytes(in)
+		if httpError(err, w, req, "reading a key") {
+			return
+		}
+		if len(key) == 0 {
+			break
+		}
+		value, err := readSnapshotBytes(in)
+		if httpError(err, w, req, "reading a value") {
+			return
+		}
+		if !hasAnyPrefix(key, prefixes) {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "The key does not belong to the pubkey").
+				WithDetail("key", hex.EncodeToString(key)))
+			return
+		}
+		batch.Put(key, value)
+		keys++
+	}
+	batch.Put(movedKey(pubkey), []byte(source))
+	if databaseError(db.write(batch, nil, nil), w, req, "writing the keys") {
+		return
+	}
+	requestLogger(req).Info("Pubkey imported", "shard", source, "keys", keys)
+	writeJSON(w, http.StatusOK, map[string]int{"keys": keys})
+}
+
+// importDelta writes the changes of the keys of the pubkey made since its import, and takes the pubkey over
+// with the final ones
+func importDelta(pubkey []byte, final bool, w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(req.Body)
+	if httpError(err, w, req, "reading the changes") {
+		return
+	}
+	delta := new(leveldb.Batch)
+	if err := delta.Load(data); err != nil {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong batch of changes"))
+		return
+	}
+	batch := &pubkeyBatch{prefixes: pubkeyPrefixes(pubkey), batch: new(leveldb.Batch)}
+	if err := delta.Replay(batch); err != nil || batch.wrongKey != nil {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "The key does not belong to the pubkey").
+			WithDetail("key", hex.EncodeToString(batch.wrongKey)))
+		return
+	}
+	if final {
+		batch.batch.Delete(movedKey(pubkey))
+	}
+	if databaseError(db.write(batch.batch, nil, nil), w, req, "writing the changes") {
+		return
+	}
+	requestLogger(req).Info("Pubkey changes imported", "shard", req.Header.Get(ShardForwardedHeader), "changes", delta.Len(),
+		"final", final)
+	writeJSON(w, http.StatusOK, map[string]int{"changes": delta.Len()})
+}
+
+// pubkeyBatch copies the operations on the keys of a pubkey, wrongKey is the first other key
+type pubkeyBatch struct {
+	prefixes [][]byte
+	batch    *leveldb.Batch
+	wrongKey []byte
+}
+
+func (b *pubkeyBatch) Put(key []byte, value []byte) {
+	if b.check(key) {
+		b.batch.Put(key, value)
+	}
+}
+
+func (b *pubkeyBatch) Delete(key []byte) {
+	if b.check(key) {
+		b.batch.Delete(key)
+	}
+}
+
+func (b *pubkeyBatch) check(key []byte) bool {
+	if b.wrongKey == nil && !hasAnyPrefix(key, b.prefixes) {
+		b.wrongKey = append([]byte{}, key...)
+	}
+	return b.wrongKey == nil
+}
+
+func hasAnyPrefix(key []byte, prefixes [][]byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleShardRebalance moves the pubkeys of this shard owned by another one to their shard. With ?shards=
+// the owners are taken from that shard list instead of the configured one, to move the pubkeys before
+// the configuration changes.
+func handleShardRebalance(w http.ResponseWriter, req *http.Request) {
+	ring := shards.ring
+	if list := req.URL.Query().Get("shards"); list != "" {
+		urls, err := parseShards(list)
+		if err != nil {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, err.Error()))
+			return
+		}
+		ring = NewRing(urls, max(shards.config.VirtualNodes, 1))
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	moved, err := shards.Rebalance(req.Context(), ring)
+	var importErr *ShardImportError
+	if errors.As(err, &importErr) {
+		writeError(w, req, NewAPIError(http.StatusBadGateway, ErrInternal, err.Error()).WithDetail("moved", moved))
+		return
+	}
+	if databaseError(err, w, req, "moving the pubkeys") {
+		return
+	}
+	requestLogger(req).Info("Shard rebalanced", "moved", moved, "shards", ring.Shards())
+	writeJSON(w, http.StatusOK, map[string]interface{}{"moved": moved, "shards": ring.Shards()})
+}
+
+// handleRouterParams forwards /params to the shard of ?pubkey=, as every shard has its own identity key,
+// or to the first shard
+func handleRouterParams(w http.ResponseWriter, req *http.Request) {
+	shard := shards.ring.Shards()[0]
+	if req.URL.Query().Has("pubkey") {
+		pubkey, ok := parsePubkeyParam(w, req)
+		if !ok {
+			return
+		}
+		shard = shards.ring.Owner(pubkey)
+	}
+	shards.proxy(shard).ServeHTTP(w, req)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pubkeyKeys returns all the keys moved with the pubkey
+func pubkeyKeys(database *Database, pubkey []byte) (map[string]string, error) {
+	keys := map[string]string{}
+	err := forEachPubkeyKey(database.db, pubkey, func(key []byte, value []byte) error {
+		keys[string(key)] = string(value)
+		return nil
+	})
+	return keys, err
+}
+
+// TestShardRebalance moves a pubkey with keys and one with only a trash from a shard to the test server,
+// writing the first one while its snapshot is sent, and checks that the server ends up with the same keys
+func TestShardRebalance(t *testing.T) {
+	self, other := "http://127.0.0.1:1", "http://127.0.0.1:2"
+	server := newTestServer(t, func(config *Config) {
+		config.Sharding.Shards = self + "," + other
+		config.Sharding.Self = other
+	})
+	source, err := NewShards(newTestDatabase(t), ShardingConfig{Shards: self + "," + other, Self: self, VirtualNodes: 128,
+		ImportTimeout: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.db.trash.Retention = time.Hour
+	var owned []*testKey
+	for private := byte(1); len(owned) < 2; private++ {
+		if k := newTestKey(t, private); source.ring.Owner(k.pubkey) == self {
+			owned = append(owned, k)
+		}
+	}
+	written, cleared := owned[0], owned[1]
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := source.db.Put(written.point(), []byte(name), []byte("old"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := source.db.Put(cleared.point(), []byte("a"), []byte("trashed"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.db.Clear(cleared.point(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server behind a proxy writing the pubkey when its snapshot and the first changes are sent,
+	// which the shard accepts until the last changes
+	var expected map[string]string
+	var deltas []string
+	target, _ := url.Parse(newAdminServer(t, server).URL)
+	forward := httputil.NewSingleHostReverseProxy(target)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		pubkey, _ := hex.DecodeString(query.Get("pubkey"))
+		if bytes.Equal(pubkey, written.pubkey) {
+			deltas = append(deltas, query.Get("delta"))
+			var ops []BatchOp
+			switch query.Get("delta") {
+			case "":
+				ops = []BatchOp{
+					{Key: []byte("a"), Value: []byte("new")},
+					{Key: []byte("b"), Delete: true},
+					{Key: []byte("d"), Value: []byte("new")},
+				}
+			case "true":
+				ops = []BatchOp{{Key: []byte("c"), Value: []byte("catching up")}}
+			}
+			if ops != nil {
+				if _, err := source.db.Batch(written.point(), ops, nil); err != nil {
+					t.Error(err)
+				}
+				var err error
+				if expected, err = pubkeyKeys(source.db, written.pubkey); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+		forward.ServeHTTP(w, req)
+		if query.Get("delta") == "" {
+			// the pubkey stays with the source until the changes are sent
+			if owner, err := shards.owner(pubkey); err != nil || owner != self {
+				t.Errorf("owner %s %v during the move, expected %s", owner, err, self)
+			}
+		}
+	}))
+	defer proxy.Close()
+
+	moved, err := source.Rebalance(context.Background(), NewRing([]string{proxy.URL}, 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Errorf("moved %d pubkeys, expected 2", moved)
+	}
+
+	keys, err := pubkeyKeys(db, written.pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(expected) {
+		t.Errorf("%d keys imported, expected %d", len(keys), len(expected))
+	}
+	for key, value := range expected {
+		if keys[key] != value {
+			t.Errorf("imported %x = %q, expected %q", key, keys[key], value)
+		}
+	}
+	if value, found, _ := db.Get(written.point(), []byte("a")); !found || string(value) != "new" {
+		t.Errorf("a = %q, expected the value written during the move", value)
+	}
+	if _, found, _ := db.Get(written.point(), []byte("b")); found {
+		t.Error("b deleted during the move was imported")
+	}
+	if value, _, _ := db.Get(written.point(), []byte("c")); string(value) != "catching up" {
+		t.Errorf("c = %q, expected the value written while the changes were sent", value)
+	}
+	if strings.Join(deltas, ",") != ",true,final" {
+		t.Errorf("the keys were sent with the deltas %q", deltas)
+	}
+	checkRoot(t, db, written, 3)
+	if _, _, _, _, err := db.Restore(cleared.point(), 0, nil); err != nil {
+		t.Errorf("restoring the imported trash: %v", err)
+	}
+
+	for _, key := range owned {
+		if owner, err := shards.owner(key.pubkey); err != nil || owner != other {
+			t.Errorf("owner %s %v after the import, expected %s", owner, err, other)
+		}
+		if keys, err := pubkeyKeys(source.db, key.pubkey); err != nil || len(keys) != 0 {
+			t.Errorf("%d keys left on the source, %v", len(keys), err)
+		}
+		if owner, err := source.owner(key.pubkey); err != nil || owner != proxy.URL {
+			t.Errorf("owner %s %v on the source, expected %s", owner, err, proxy.URL)
+		}
+	}
+	var wrongShard *WrongShardError
+	if _, err := source.db.Put(written.point(), []byte("e"), []byte("late"), nil); !errors.As(err, &wrongShard) {
+		t.Errorf("a write on the source after the move: %v", err)
+	}
+}
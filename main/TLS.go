@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// CertificateReloader serves the server certificate and reloads it from disk on SIGHUP,
+// so that renewed certificates are picked up without a restart
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertificateReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.cert = &cert
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// ReloadOnSignal reloads the certificate every time the process receives SIGHUP.
+// A failed reload keeps the previous certificate.
+func (r *CertificateReloader) ReloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := r.Reload(); err != nil {
+				slog.Error("Cannot reload the certificate", "file", r.certFile, "error", err)
+			} else {
+				slog.Info("Reloaded the certificate", "file", r.certFile)
+			}
+		}
+	}()
+}
+
+type NoCertificatesError struct {
+	file string
+}
+
+func (e *NoCertificatesError) Error() string {
+	return fmt.Sprintf("No PEM certificates found in %s", e.file)
+}
+
+// NewTLSConfig creates the listener configuration. If clientCAFile is not empty, clients may present
+// a certificate signed by one of these CAs, which is then required for the admin endpoints.
+func NewTLSConfig(reloader *CertificateReloader, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// loadCertPool reads the PEM certificates of the file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, &NoCertificatesError{file}
+	}
+	return pool, nil
+}
+
+var adminClientCerts bool // true if admin endpoints are authenticated with client certificates
+
+type adminListenerKey struct{}
+
+// adminListener marks the requests of the admin_listen address, whose clients are all admins
+func adminListener(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), adminListenerKey{}, true)))
+	})
+}
+
+// isAdmin returns true for the requests received on the admin listen address, and for the clients
+// with a verified certificate if mutual TLS is configured. Without both the admin endpoints are off.
+func isAdmin(req *http.Request) bool {
+	if req.Context().Value(adminListenerKey{}) != nil {
+		return true
+	}
+	return adminClientCerts && req.TLS != nil && len(req.TLS.VerifiedChains) > 0
+}
+
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isAdmin(req) {
+			writeError(w, req, NewAPIError(http.StatusForbidden, ErrForbidden, "Admin access denied"))
+			return
+		}
+		handler(w, req)
+	}
+}
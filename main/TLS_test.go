@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// newTestCert issues a certificate signed by the parent, self-signed if the parent is nil
+func newTestCert(t *testing.T, name string, serial int64, parent *testCert, client bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		if client {
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		} else {
+			// the nodes of a cluster present their server certificate as clients too
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+			template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestAdminClientCertificates checks that with tls.client_ca the admin endpoints need a client certificate
+// signed by the CA, while the other endpoints don't, and that SIGHUP reloads the server certificate
+func TestAdminClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "kv test CA", 1, nil, false)
+	server := newTestCert(t, "server", 2, ca, false)
+	client := newTestCert(t, "admin", 3, ca, true)
+	other := newTestCert(t, "stranger", 4, newTestCert(t, "other CA", 5, nil, false), true)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	server.write(t, certFile, keyFile)
+	ca.write(t, caFile, "")
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.ReloadOnSignal()
+	tlsConfig, err := NewTLSConfig(reloader, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminClientCerts = true
+	defer func() { adminClientCerts = false }()
+
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusOK) }
+	handleAdmin(mux, "/admin", ok, http.MethodGet)
+	handlePublic(mux, "/public", ok)
+	// StartTLS would replace GetCertificate with the certificate of httptest
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Listener = tls.NewListener(ts.Listener, tlsConfig)
+	ts.Start()
+	defer ts.Close()
+	url := strings.Replace(ts.URL, "http://", "https://", 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(path string, cert *tls.Certificate) (*http.Response, error) {
+		config := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			// send it whatever CAs the server asks for
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert, nil }
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+		return c.Get(url + path)
+	}
+	status := func(path string, cert *tls.Certificate) int {
+		t.Helper()
+		resp, err := get(path, cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if s := status("/admin", nil); s != http.StatusForbidden {
+		t.Errorf("admin without a client certificate: %d, expected 403", s)
+	}
+	if s := status("/admin", &client.pair); s != http.StatusOK {
+		t.Errorf("admin with a client certificate: %d, expected 200", s)
+	}
+	if s := status("/public", nil); s != http.StatusOK {
+		t.Errorf("public without a client certificate: %d, expected 200", s)
+	}
+	if resp, err := get("/public", &other.pair); err == nil {
+		resp.Body.Close()
+		t.Error("a client certificate of another CA was accepted")
+	}
+
+	renewed := newTestCert(t, "server", 6, ca, false)
+	renewed.write(t, certFile, keyFile)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		resp, err := get("/public", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.TLS.PeerCertificates[0].SerialNumber.Int64() == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the renewed certificate was not loaded on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestAdminListener checks that without client certificates the admin endpoints are only served on the
+// admin listen address, the loopback included
+func TestAdminListener(t *testing.T) {
+	server := newTestServer(t, nil)
+	admin := newAdminServer(t, server)
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{server.URL, http.StatusForbidden},
+		{admin.URL, http.StatusOK},
+	} {
+		resp, err := http.Get(test.url + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s/metrics: %d, expected %d", test.url, resp.StatusCode, test.status)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/ndv/kv/bitcurve"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"log/slog"
+	"time"
+)
+
+// The trash keyspace: 't' + pubkey + uint64 big endian generation + key holds the value.
+// The generation is the unix time in nanoseconds of the clear that moved the key there.
+const trashPrefix = 't'
+
+func (c TrashConfig) enabled() bool {
+	return c.Retention > 0
+}
+
+func trashPubkeyPrefix(pubkey []byte) []byte {
+	return append([]byte{trashPrefix}, pubkey...)
+}
+
+func trashGenerationPrefix(pubkey []byte, generation uint64) []byte {
+	return binary.BigEndian.AppendUint64(trashPubkeyPrefix(pubkey), generation)
+}
+
+// EnableTrash turns on the soft delete of Clear with the retention window, and starts the periodic purge
+func (db *Database) EnableTrash(config TrashConfig) {
+	db.trash = config
+	if config.enabled() && config.PurgeInterval > 0 {
+		go db.purgeTrashEvery(config)
+	}
+}
+
+type NothingToRestoreError struct{}
+
+func (e *NothingToRestoreError) Error() string {
+	return "Nothing to restore"
+}
+
+// Restore brings back the keys moved to the trash by the clear of the generation, or by the last clear
+// if generation is 0. The keys written again since the clear keep their new values and are skipped.
+// version is the sequence number of the last restored key.
+func (db *Database) Restore(pubkey bitcurve.Point, generation uint64, signed *SignedRequest) (restoredGeneration uint64, restored int, skipped int, version uint64, err error) {
+	prefix := bitcurve.MarshallCompressedPoint(pubkey)
+	unlock, err := db.lockWrite(prefix)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	defer unlock()
+
+	if generation == 0 {
+		iterator := db.db.NewIterator(util.BytesPrefix(trashPubkeyPrefix(prefix)), nil)
+		if iterator.Last() && len(iterator.Key()) >= 1+33+8 {
+			generation = binary.BigEndian.Uint64(iterator.Key()[1+33:])
+		}
+		iterator.Release()
+		if err = iterator.Error(); err != nil {
+			return 0, 0, 0, 0, err
+		}
+		if generation == 0 {
+			return 0, 0, 0, 0, &NothingToRestoreError{}
+		}
+	}
+
+	generationPrefix := trashGenerationPrefix(prefix, generation)
+	iterator := db.db.NewIterator(util.BytesPrefix(generationPrefix), nil)
+	defer iterator.Release()
+	batch := new(leveldb.Batch)
+	var events []ChangeEvent
+	for iterator.Next() {
+		key := append([]byte{}, iterator.Key()[len(generationPrefix):]...)
+		batch.Delete(iterator.Key())
+		dataKey := append(append([]byte{}, prefix...), key...)
+		exists, err := db.db.Has(dataKey, nil)
+		if err != nil {
+			return generation, 0, 0, 0, err
+		}
+		if exists {
+			skipped++
+			continue
+		}
+		value := append([]byte{}, iterator.Value()...)
+		batch.Put(dataKey, value)
+		events = append(events, ChangeEvent{Type: EventPut, Key: key, Value: value})
+	}
+	if err = iterator.Error(); err != nil {
+		return generation, 0, 0, 0, err
+	}
+	if batch.Len() == 0 {
+		return generation, 0, 0, 0, &NothingToRestoreError{}
+	}
+	first, err := db.commitLocked(batch, prefix, signed, events...)
+	if err != nil {
+		return generation, 0, 0, 0, err
+	}
+	return generation, len(events), skipped, first + uint64(len(events)) - 1, nil
+}
+
+// PurgeTrash removes the generations older than the retention
+func (db *Database) PurgeTrash(retention time.Duration) (removed int, err error) {
+	iterator := db.db.NewIterator(util.BytesPrefix([]byte{trashPrefix}), nil)
+	defer iterator.Release()
+
+	cutoff := uint64(time.Now().Add(-retention).UnixNano())
+	batch := new(leveldb.Batch)
+	for iterator.Next() {
+		key := iterator.Key()
+		if len(key) < 1+33+8 {
+			continue
+		}
+		if binary.BigEndian.Uint64(key[1+33:]) >= cutoff {
+			// the generations after this one are newer, go to the next pubkey
+			iterator.Seek(util.BytesPrefix(key[:1+33]).Limit)
+			iterator.Prev()
+			continue
+		}
+		batch.Delete(append([]byte{}, key...))
+		removed++
+		if batch.Len() >= 1000 {
+			if err := db.write(batch, nil, nil); err != nil {
+				return removed, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		return removed, err
+	}
+	return removed, db.write(batch, nil, nil)
+}
+
+// purgeTrashEvery runs PurgeTrash periodically until the database is closed
+func (db *Database) purgeTrashEvery(config TrashConfig) {
+	ticker := time.NewTicker(config.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.quit:
+			return
+		case <-ticker.C:
+		}
+		if !db.leading() {
+			continue // the leader of the cluster or of the replication does it for all the nodes
+		}
+		start := time.Now()
+		removed, err := db.PurgeTrash(config.Retention)
+		if err != nil {
+			slog.Error("Trash purge failed", "removed", removed, "error", err)
+			continue
+		}
+		slog.Info("Trash purged", "removed", removed, "duration", time.Since(start).String())
+	}
+}
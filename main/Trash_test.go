@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"testing"
+	"time"
+)
+
+// trashGenerations returns the generations in the trash of the pubkey, the oldest first
+func trashGenerations(t *testing.T, key *testKey) []uint64 {
+	t.Helper()
+	var generations []uint64
+	iterator := db.db.NewIterator(util.BytesPrefix(trashPubkeyPrefix(key.pubkey)), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		generation := binary.BigEndian.Uint64(iterator.Key()[1+33:])
+		if len(generations) == 0 || generations[len(generations)-1] != generation {
+			generations = append(generations, generation)
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return generations
+}
+
+// trashTestKeys writes and clears the keys of the pubkey through the database
+type trashTestKeys struct {
+	t   *testing.T
+	key *testKey
+}
+
+func (k trashTestKeys) put(name string, value string) {
+	k.t.Helper()
+	if _, err := db.Put(k.key.point(), []byte(name), []byte(value), nil); err != nil {
+		k.t.Fatal(err)
+	}
+}
+
+func (k trashTestKeys) clear() {
+	k.t.Helper()
+	if _, err := db.Clear(k.key.point(), nil); err != nil {
+		k.t.Fatal(err)
+	}
+}
+
+func (k trashTestKeys) expect(expected map[string]string) {
+	k.t.Helper()
+	view, err := db.View(k.key.pubkey)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	defer view.Release()
+	keys := make(map[string]string)
+	err = view.ForEach(func(key []byte, value []byte) error {
+		keys[string(key)] = string(value)
+		return nil
+	})
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	if len(keys) != len(expected) {
+		k.t.Errorf("keys %v, expected %v", keys, expected)
+		return
+	}
+	for name, value := range expected {
+		if keys[name] != value {
+			k.t.Errorf("%s=%q, expected %q", name, keys[name], value)
+		}
+	}
+}
+
+// TestRestore checks that a restore brings back the keys of the last clear or of the one of the generation,
+// except the keys written again since, and takes the generation out of the trash
+func TestRestore(t *testing.T) {
+	newTestServer(t, func(config *Config) { config.Trash.Retention = time.Hour })
+	key := newTestKey(t, 1)
+	keys := trashTestKeys{t, key}
+	var nothing *NothingToRestoreError
+	if _, _, _, _, err := db.Restore(key.point(), 0, nil); !errors.As(err, &nothing) {
+		t.Errorf("restore of an empty trash: %v, expected nothing to restore", err)
+	}
+
+	keys.put("a", "1")
+	keys.put("b", "1")
+	keys.put("c", "1")
+	keys.clear()
+	keys.put("b", "2")
+	first := trashGenerations(t, key)
+	generation, restored, skipped, version, err := db.Restore(key.point(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 || generation != first[0] || restored != 2 || skipped != 1 {
+		t.Errorf("restored %d and skipped %d of the generation %d, expected 2 and 1 of %v", restored, skipped,
+			generation, first)
+	}
+	if last, err := lastSeq(db.db, key.pubkey); err != nil || version != last {
+		t.Errorf("version %d, expected the last sequence number %d %v", version, last, err)
+	}
+	keys.expect(map[string]string{"a": "1", "b": "2", "c": "1"})
+	if generations := trashGenerations(t, key); len(generations) != 0 {
+		t.Errorf("generations %v left in the trash", generations)
+	}
+
+	// an older generation than the last one
+	keys.clear()
+	keys.put("x", "1")
+	keys.clear()
+	generations := trashGenerations(t, key)
+	if len(generations) != 2 {
+		t.Fatalf("generations %v, expected 2", generations)
+	}
+	if _, restored, skipped, _, err = db.Restore(key.point(), generations[0], nil); err != nil || restored != 3 || skipped != 0 {
+		t.Errorf("restored %d and skipped %d of the first generation %v, expected 3 and 0", restored, skipped, err)
+	}
+	keys.expect(map[string]string{"a": "1", "b": "2", "c": "1"})
+	if _, _, _, _, err = db.Restore(key.point(), generations[0], nil); !errors.As(err, &nothing) {
+		t.Errorf("second restore of the generation: %v, expected nothing to restore", err)
+	}
+
+	// a generation of only the keys written again is taken out of the trash without changes
+	keys.put("x", "2")
+	if _, restored, skipped, _, err = db.Restore(key.point(), 0, nil); err != nil || restored != 0 || skipped != 1 {
+		t.Errorf("restored %d and skipped %d of the last generation %v, expected 0 and 1", restored, skipped, err)
+	}
+	keys.expect(map[string]string{"a": "1", "b": "2", "c": "1", "x": "2"})
+	if generations := trashGenerations(t, key); len(generations) != 0 {
+		t.Errorf("generations %v left in the trash", generations)
+	}
+}
+
+// TestPurgeTrash checks that the purge removes the generations older than the retention of every pubkey
+func TestPurgeTrash(t *testing.T) {
+	newTestServer(t, func(config *Config) { config.Trash.Retention = time.Hour })
+	first, second := trashTestKeys{t, newTestKey(t, 1)}, trashTestKeys{t, newTestKey(t, 2)}
+	for _, keys := range []trashTestKeys{first, second} {
+		keys.put("a", "1")
+		keys.put("b", "1")
+		keys.clear()
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, keys := range []trashTestKeys{first, second} {
+		keys.put("c", "2")
+		keys.clear()
+	}
+
+	removed, err := db.PurgeTrash(time.Hour)
+	if err != nil || removed != 0 {
+		t.Errorf("removed %d %v within the retention, expected 0", removed, err)
+	}
+	generations := trashGenerations(t, second.key)
+	if len(generations) != 2 {
+		t.Fatalf("generations %v, expected 2", generations)
+	}
+	// the cutoff between the two clears
+	between := time.Unix(0, int64(generations[0]/2+generations[1]/2))
+	if removed, err = db.PurgeTrash(time.Since(between)); err != nil || removed != 4 {
+		t.Errorf("removed %d %v, expected the 4 keys of the first clears", removed, err)
+	}
+	for _, keys := range []trashTestKeys{first, second} {
+		if generations := trashGenerations(t, keys.key); len(generations) != 1 {
+			t.Errorf("generations %v, expected the second one", generations)
+		}
+	}
+	if removed, err = db.PurgeTrash(0); err != nil || removed != 2 {
+		t.Errorf("removed %d %v without a retention, expected 2", removed, err)
+	}
+	var nothing *NothingToRestoreError
+	if _, _, _, _, err = db.Restore(first.key.point(), 0, nil); !errors.As(err, &nothing) {
+		t.Errorf("restore after the purge: %v, expected nothing to restore", err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/ndv/kv/bitcurve"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the longest a /watch request waits for changes, the client may ask for less with ?timeout=
+var maxWatchTimeout = 55 * time.Second
+
+// closed when the server starts shutting down, so that the waiting watchers return at once
+var stopping = make(chan struct{})
+
+type watchEvent struct {
+	Seq           uint64 `json:"seq"`
+	Type          string `json:"type"`
+	Key           string `json:"key,omitempty"`
+	Value         string `json:"value,omitempty"`
+	KeyEncoding   string `json:"key_encoding,omitempty"`
+	ValueEncoding string `json:"value_encoding,omitempty"`
+}
+
+type watchResponse struct {
+	Events []watchEvent `json:"events"`
+	Next   uint64       `json:"next"` // the since value for the next request
+}
+
+// parseWatchQuery reads the query of /watch, since is last without ?since=
+func parseWatchQuery(req *http.Request, last uint64) (since uint64, prefix []byte, timeout time.Duration, encoding string, err *APIError) {
+	query := req.URL.Query()
+	since = last
+	if s := query.Get("since"); s != "" {
+		var parseErr error
+		if since, parseErr = strconv.ParseUint(s, 10, 64); parseErr != nil {
+			return 0, nil, 0, "", NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong since value").WithDetail("since", s)
+		}
+	}
+	var parseErr error
+	if prefix, parseErr = hex.DecodeString(query.Get("prefix")); parseErr != nil {
+		return 0, nil, 0, "", NewAPIError(http.StatusBadRequest, ErrBadRequest, "The prefix should be hex").WithDetail("prefix", query.Get("prefix"))
+	}
+	timeout = maxWatchTimeout
+	if s := query.Get("timeout"); s != "" {
+		seconds, parseErr := strconv.ParseFloat(s, 64)
+		if parseErr != nil || seconds < 0 {
+			return 0, nil, 0, "", NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong timeout value").WithDetail("timeout", s)
+		}
+		if t := time.Duration(seconds * float64(time.Second)); t < timeout {
+			timeout = t
+		}
+	}
+	encoding = query.Get("encoding")
+	if encoding == "" {
+		encoding = EncodingHex
+	}
+	if !validEncoding(encoding) {
+		return 0, nil, 0, "", NewAPIError(http.StatusBadRequest, ErrBadRequest, "Unknown encoding").WithDetail("encoding", encoding)
+	}
+	return since, prefix, timeout, encoding, nil
+}
+
+// handleWatch is a long poll: it returns the changes of the namespace after ?since= at once if there are any,
+// otherwise it waits for the next change or the timeout and returns what it got, possibly nothing.
+// Without since it waits for the changes after the current moment. The sequence numbers are the ones
+// of the change log of the pubkey, which has the changes no longer kept in memory.
+func handleWatch(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
+	body := bufio.NewReader(req.Body)
+
+	ctx, err := readRequestHeader(body)
+	if httpError(err, w, req, "reading the header") {
+		return
+	}
+
+	pubkey := bitcurve.MarshallCompressedPoint(ctx.pubkey)
+	last, err := db.LastSeq(pubkey)
+	if databaseError(err, w, req, "reading the change log") {
+		return
+	}
+	since, prefix, timeout, encoding, apiErr := parseWatchQuery(req, last)
+	if apiErr != nil {
+		writeError(w, req, apiErr)
+		return
+	}
+
+	if !ctx.checkSignature([]byte("watch"), w, req) || !ctx.checkPubkeyRateLimit(w, req) {
+		return
+	}
+
+	// the server write timeout is shorter than the long poll
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		events, next, changed, ok := db.Feed().Since(pubkey, since, last, prefix)
+		if !ok {
+			var more bool
+			events, next, more, err = db.Changes(ctx.pubkey, since, maxChangesLimit)
+			var compacted *ChangesCompactedError
+			if errors.As(err, &compacted) {
+				writeError(w, req, NewAPIError(http.StatusGone, ErrSequenceExpired, "The changes after this sequence number are not kept anymore").
+					WithDetail("since", since).WithDetail("oldest", compacted.Oldest))
+				return
+			}
+			if databaseError(err, w, req, "reading the change log") {
+				return
+			}
+			events = withPrefix(events, prefix)
+			if len(events) == 0 && more {
+				since = next
+				continue
+			}
+		}
+		if len(events) > 0 {
+			writeWatchResponse(w, events, next, encoding)
+			requestLogger(req).Info("Watch", pubkeyAttr(ctx.pubkey), "since", since, "count", len(events))
+			return
+		}
+		// nothing with the prefix, the client may continue from the last change anyway
+		since = next
+		select {
+		case <-changed:
+			if last, err = db.LastSeq(pubkey); databaseError(err, w, req, "reading the change log") {
+				return
+			}
+			continue
+		case <-timer.C:
+		case <-req.Context().Done():
+		case <-stopping:
+		}
+		writeWatchResponse(w, nil, since, encoding)
+		return
+	}
+}
+
+// withPrefix filters the events read from the change log by the key prefix, keeping the clears
+func withPrefix(events []ChangeEvent, prefix []byte) []ChangeEvent {
+	filtered := events[:0]
+	for _, event := range events {
+		if event.Type == EventClear || bytes.HasPrefix(event.Key, prefix) {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+func encodeEvents(events []ChangeEvent, encoding string) []watchEvent {
+	encoded := make([]watchEvent, len(events))
+	for i, event := range events {
+		encoded[i] = watchEvent{Seq: event.Seq, Type: event.Type}
+		if event.Type != EventClear {
+			encoded[i].Key, encoded[i].KeyEncoding = encodeBytes(event.Key, encoding)
+		}
+		if event.Type == EventPut {
+			encoded[i].Value, encoded[i].ValueEncoding = encodeBytes(event.Value, encoding)
+		}
+	}
+	return encoded
+}
+
+func writeWatchResponse(w http.ResponseWriter, events []ChangeEvent, last uint64, encoding string) {
+	writeJSON(w, http.StatusOK, watchResponse{Events: encodeEvents(events, encoding), Next: last})
+}
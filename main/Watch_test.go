@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// postSigned sends the signed message without a payload to the endpoint and decodes the JSON response
+// into result, or into the returned error for the error statuses
+func postSigned(t *testing.T, url string, key *testKey, message string, result any) (int, *APIError) {
+	t.Helper()
+	status, body := post(t, url, key.body(t, []byte(message), nil), nil)
+	if status != http.StatusOK {
+		var response struct {
+			Error *APIError `json:"error"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil || response.Error == nil {
+			t.Fatalf("status %d without an error: %s", status, body)
+		}
+		return status, response.Error
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	return status, nil
+}
+
+// checkEvents compares the events with the expected sequence numbers, types and keys
+func checkEvents(t *testing.T, events []watchEvent, expected ...watchEvent) {
+	t.Helper()
+	if len(events) != len(expected) {
+		t.Fatalf("events %+v, expected %+v", events, expected)
+	}
+	for i, event := range events {
+		key, _ := hex.DecodeString(event.Key)
+		if event.Seq != expected[i].Seq || event.Type != expected[i].Type || string(key) != expected[i].Key {
+			t.Errorf("event %d is %d %s %q, expected %d %s %q", i, event.Seq, event.Type, key,
+				expected[i].Seq, expected[i].Type, expected[i].Key)
+		}
+	}
+}
+
+func putTestKeys(t *testing.T, key *testKey, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := db.Put(key.point(), []byte(name), []byte("value of "+name), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestWatchTimeout checks that a watch without changes returns no events after the timeout
+func TestWatchTimeout(t *testing.T) {
+	server := newTestServer(t, nil)
+	key := newTestKey(t, 1)
+	putTestKeys(t, key, "a")
+	start := time.Now()
+	var response watchResponse
+	if status, apiErr := postSigned(t, server.URL+"/watch?timeout=0.2", key, "watch", &response); status != http.StatusOK {
+		t.Fatalf("watch: %d %v", status, apiErr)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("returned after %v, expected the timeout", elapsed)
+	}
+	if len(response.Events) != 0 || response.Next != 1 {
+		t.Errorf("events %+v next %d, expected none and the last sequence number 1", response.Events, response.Next)
+	}
+}
+
+// TestWatchWakeup checks that a waiting watch returns the first change with its prefix,
+// skipping the changes of the other keys
+func TestWatchWakeup(t *testing.T) {
+	server := newTestServer(t, nil)
+	key := newTestKey(t, 1)
+	putTestKeys(t, key, "k0")
+	responses := make(chan watchResponse, 1)
+	go func() {
+		var response watchResponse
+		url := server.URL + "/watch?timeout=10&prefix=" + hex.EncodeToString([]byte("k"))
+		if status, apiErr := postSigned(t, url, key, "watch", &response); status != http.StatusOK {
+			t.Errorf("watch: %d %v", status, apiErr)
+		}
+		responses <- response
+	}()
+	time.Sleep(100 * time.Millisecond)
+	putTestKeys(t, key, "other")
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	putTestKeys(t, key, "k1")
+	select {
+	case response := <-responses:
+		checkEvents(t, response.Events, watchEvent{Seq: 3, Type: EventPut, Key: "k1"})
+		if response.Next != 3 {
+			t.Errorf("next %d, expected 3", response.Next)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("woken up after %v", elapsed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the watch was not woken up")
+	}
+}
+
+// TestWatchChangeLog checks that the changes no longer in memory are read from the change log,
+// and the 410 once they are compacted
+func TestWatchChangeLog(t *testing.T) {
+	server := newTestServer(t, func(config *Config) { config.Database.ChangeFeedSize = 2 })
+	key := newTestKey(t, 1)
+	putTestKeys(t, key, "a", "b", "a", "c", "d")
+
+	// from the change log, with the keys changed twice once
+	var response watchResponse
+	if status, apiErr := postSigned(t, server.URL+"/watch?since=0&timeout=0", key, "watch", &response); status != http.StatusOK {
+		t.Fatalf("watch: %d %v", status, apiErr)
+	}
+	checkEvents(t, response.Events,
+		watchEvent{Seq: 2, Type: EventPut, Key: "b"},
+		watchEvent{Seq: 3, Type: EventPut, Key: "a"},
+		watchEvent{Seq: 4, Type: EventPut, Key: "c"},
+		watchEvent{Seq: 5, Type: EventPut, Key: "d"})
+	if response.Next != 5 {
+		t.Errorf("next %d, expected 5", response.Next)
+	}
+	// with a prefix
+	url := server.URL + "/watch?since=1&timeout=0&prefix=" + hex.EncodeToString([]byte("a"))
+	if status, apiErr := postSigned(t, url, key, "watch", &response); status != http.StatusOK {
+		t.Fatalf("watch: %d %v", status, apiErr)
+	}
+	checkEvents(t, response.Events, watchEvent{Seq: 3, Type: EventPut, Key: "a"})
+
+	if _, err := db.CompactChangeLog(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	status, apiErr := postSigned(t, server.URL+"/watch?since=0&timeout=0", key, "watch", &response)
+	if status != http.StatusGone || apiErr.Code != ErrSequenceExpired || apiErr.Details["oldest"] != float64(4) {
+		t.Errorf("watch after the compaction: %d %+v, expected 410 with the oldest sequence number 4", status, apiErr)
+	}
+	// the last changes are still in memory
+	if status, apiErr = postSigned(t, server.URL+"/watch?since=3&timeout=0", key, "watch", &response); status != http.StatusOK {
+		t.Fatalf("watch: %d %v", status, apiErr)
+	}
+	checkEvents(t, response.Events, watchEvent{Seq: 4, Type: EventPut, Key: "c"}, watchEvent{Seq: 5, Type: EventPut, Key: "d"})
+}
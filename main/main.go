@@ -2,49 +2,323 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"flag"
-	"fmt"
 	"github.com/ndv/kv/bitcurve"
+	"google.golang.org/grpc"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 var (
-	db *Database
+	db            *Database
+	ipLimiter     *RateLimiter
+	pubkeyLimiter *RateLimiter
 )
 
 func main() {
-	portNumber := flag.Int("port", 8546, "Port number")
-	flag.Parse()
+	config, printConfig, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fatal("Cannot load the config", "error", err)
+	}
 
-	defaultPath := os.Getenv("HOME")
-	if defaultPath == "" {
-		defaultPath = "."
+	if err := config.Validate(); err != nil {
+		fatal("Wrong settings", "error", err)
 	}
-	databasePath := flag.String("database", defaultPath+"/.kv/database", "Database path")
-	flag.Parse()
 
-	var err error
-	db, err = NewDatabase(*databasePath)
+	if printConfig {
+		config.Print(os.Stdout)
+		return
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if config.Logging.File != "" {
+		logFile, err := os.OpenFile(config.Logging.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatal("Cannot open the log file", "file", config.Logging.File, "error", err)
+		}
+		defer logFile.Close()
+		logOutput = logFile
+	}
+	if err := SetupLogging(config.Logging, logOutput); err != nil {
+		fatal("Wrong logging settings", "error", err)
+	}
+
+	ipLimiter = NewRateLimiter("ip", config.Limits.IPRate, config.Limits.IPBurst)
+	pubkeyLimiter = NewRateLimiter("pubkey", config.Limits.PubkeyRate, config.Limits.PubkeyBurst)
+
+	pow, err = NewProofOfWork(config.Limits.Pow, config.Limits.PowDifficulty)
 	if err != nil {
-		log.Fatal("Cannot open %s: %s", *databasePath, err.Error())
+		fatal("Wrong proof of work settings", "error", err)
+	}
+
+	maxBodySize = config.Limits.MaxBodyBytes
+	maxWatchTimeout = config.Watch.MaxTimeout
+	server := &http.Server{
+		Addr:              config.Listen,
+		ReadHeaderTimeout: config.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       config.HTTP.ReadTimeout,
+		WriteTimeout:      config.HTTP.WriteTimeout,
+		IdleTimeout:       config.HTTP.IdleTimeout,
+		MaxHeaderBytes:    config.HTTP.MaxHeaderBytes,
+	}
+
+	if config.TLS.Cert != "" || config.TLS.Key != "" {
+		reloader, err := NewCertificateReloader(config.TLS.Cert, config.TLS.Key)
+		if err != nil {
+			fatal("Cannot load the TLS certificate", "error", err)
+		}
+		reloader.ReloadOnSignal()
+		server.TLSConfig, err = NewTLSConfig(reloader, config.TLS.ClientCA)
+		if err != nil {
+			fatal("Cannot load the client CA certificates", "error", err)
+		}
+		adminClientCerts = config.TLS.ClientCA != ""
+	} else if config.TLS.ClientCA != "" {
+		fatal("tls.client_ca requires tls.cert and tls.key")
+	}
+
+	if config.Sharding.Router {
+		if config.GRPC.Listen != "" {
+			fatal("A router does not serve gRPC, the gRPC clients connect to the shards")
+		}
+		shards, err = NewShards(nil, config.Sharding)
+		if err != nil {
+			fatal("Wrong sharding settings", "error", err)
+		}
+		server.Handler = newRouterMux()
+	} else {
+		server.Handler = newServerMux(config, logOutput)
+	}
+
+	serveErr := make(chan error, 3)
+
+	var grpcServer *grpc.Server
+	if config.GRPC.Listen != "" {
+		listener, err := net.Listen("tcp", config.GRPC.Listen)
+		if err != nil {
+			fatal("Cannot listen for gRPC", "address", config.GRPC.Listen, "error", err)
+		}
+		grpcServer = NewGRPCServer(server.TLSConfig)
+		go func() {
+			slog.Info("Listening for gRPC", "address", config.GRPC.Listen)
+			serveErr <- grpcServer.Serve(listener)
+		}()
+	}
+
+	servers := []*http.Server{server}
+	if config.AdminListen != "" {
+		adminServer := &http.Server{
+			Addr:              config.AdminListen,
+			Handler:           adminListener(server.Handler),
+			TLSConfig:         server.TLSConfig,
+			ReadHeaderTimeout: server.ReadHeaderTimeout,
+			ReadTimeout:       server.ReadTimeout,
+			WriteTimeout:      server.WriteTimeout,
+			IdleTimeout:       server.IdleTimeout,
+			MaxHeaderBytes:    server.MaxHeaderBytes,
+		}
+		servers = append(servers, adminServer)
+	}
+	for _, server := range servers {
+		go func() {
+			if server.TLSConfig != nil {
+				slog.Info("Listening with TLS", "address", server.Addr)
+				serveErr <- server.ListenAndServeTLS("", "")
+			} else {
+				slog.Info("Listening", "address", server.Addr)
+				serveErr <- server.ListenAndServe()
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err = <-serveErr:
+		slog.Error("Server error", "error", err)
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+		err = shutdown(servers, config.ShutdownDelay, config.ShutdownTimeout)
+		if grpcServer != nil {
+			if grpcErr := stopGRPC(grpcServer, config.ShutdownTimeout); grpcErr != nil {
+				slog.Warn("gRPC calls still in progress after the shutdown timeout")
+				err = grpcErr
+			}
+		}
+	}
+
+	if db == nil {
+		if err != nil {
+			os.Exit(1)
+		}
 		return
 	}
-	defer db.Close()
+	if cluster != nil {
+		if clusterErr := cluster.Shutdown(); clusterErr != nil {
+			slog.Error("Cannot stop the cluster node", "error", clusterErr)
+		}
+	}
+	// the handlers are done by now (or have been given up on), so leveldb can be closed safely
+	if closeErr := db.Close(); closeErr != nil {
+		slog.Error("Cannot close the database", "error", closeErr)
+		os.Exit(1)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	slog.Info("Database closed")
+}
+
+// newServerMux opens the database and registers the endpoints serving it
+func newServerMux(config Config, logOutput io.Writer) *http.ServeMux {
+	var err error
+	identity, err = LoadIdentity(config.Identity.KeyFile)
+	if err != nil {
+		fatal("Cannot load the identity key", "path", config.Identity.KeyFile, "error", err)
+	}
+	slog.Info("Server identity", "pubkey", hex.EncodeToString(identity.Pubkey))
+
+	db, err = NewDatabase(config.Database)
+	if err != nil {
+		fatal("Cannot open the database", "path", config.Database.Path, "error", err)
+	}
+	if config.Replication.Follow != "" {
+		// the compaction and the purges of the leader come with its batches
+		config.ChangeLog.CompactInterval = 0
+		config.History.PurgeInterval = 0
+		config.Trash.PurgeInterval = 0
+		follower, err = NewFollower(db, config.Replication)
+		if err != nil {
+			fatal("Wrong replication settings", "error", err)
+		}
+	}
+	if config.Audit.Enabled {
+		if err = db.EnableAuditLog(); err != nil {
+			fatal("Cannot read the audit log", "error", err)
+		}
+	}
+
+	// before the background writers, which only write on the leader of a cluster
+	if config.Cluster.NodeURL != "" {
+		if follower != nil {
+			fatal("A cluster node cannot follow another server")
+		}
+		cluster, err = NewCluster(db, config.Cluster, logOutput, config.Logging.Level)
+		if err != nil {
+			fatal("Cannot start the cluster node", "error", err)
+		}
+	}
+	db.StartCompaction(config.ChangeLog)
+	db.EnableHistory(config.History)
+	db.EnableTrash(config.Trash)
+
+	if config.Sharding.Shards != "" {
+		shards, err = NewShards(db, config.Sharding)
+		if err != nil {
+			fatal("Wrong sharding settings", "error", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	handleSigned(mux, "/put", writes(handlePut))
+	handleSigned(mux, "/clear", writes(handleClear))
+	handleSigned(mux, "/restore", writes(handleRestore))
+	if cluster != nil {
+		handleAdmin(mux, "/cluster", handleCluster, http.MethodGet)
+		handleAdmin(mux, "/cluster/join", cluster.leaderOnly(handleClusterJoin), http.MethodPost)
+		handleAdmin(mux, "/cluster/remove", cluster.leaderOnly(handleClusterRemove), http.MethodPost)
+	}
+	if follower != nil {
+		go follower.Run(db.quit)
+	}
+	handleSigned(mux, "/getAll", handleGetAll)
+	handleSigned(mux, "/watch", handleWatch)
+	handleSigned(mux, "/changes", handleChanges)
+	handleSigned(mux, "/get", handleGet)
+	handleSigned(mux, "/history", handleHistory)
+	handleSigned(mux, "/proof", handleProof)
+	handlePublic(mux, "/params", handleParams)
+	if config.Audit.Public {
+		handlePublic(mux, "/audit", handleAudit)
+		handlePublic(mux, "/audit/head", handleAuditHead)
+		handlePublic(mux, "/audit/consistency", handleAuditConsistency)
+	} else {
+		handleAdmin(mux, "/audit", handleAudit, http.MethodGet)
+		handleAdmin(mux, "/audit/head", handleAuditHead, http.MethodGet)
+		handleAdmin(mux, "/audit/consistency", handleAuditConsistency, http.MethodGet)
+	}
+	handlePublic(mux, "/healthz", handleHealthz)
+	handlePublic(mux, "/readyz", handleReadyz)
+	handlePublic(mux, "/version", handleVersion)
+	handleAdmin(mux, "/metrics", metricsHandler(), http.MethodGet)
+	handleAdmin(mux, "/replication/stream", handleReplicationStream, http.MethodGet)
+	handleAdmin(mux, "/replication/snapshot", handleReplicationSnapshot, http.MethodGet)
+	if shards != nil {
+		handleAdmin(mux, "/shard", handleShard, http.MethodGet)
+		handleAdmin(mux, "/shard/import", writes(handleShardImport), http.MethodPost)
+		handleAdmin(mux, "/shard/rebalance", writes(handleShardRebalance), http.MethodPost)
+	}
+	return mux
+}
+
+// writes runs the handler of a write where the writes are made: on the cluster leader or the leader followed
+func writes(handler http.HandlerFunc) http.HandlerFunc {
+	if cluster != nil {
+		return cluster.leaderOnly(handler)
+	}
+	if follower != nil {
+		return forwardWrite
+	}
+	return handler
+}
+
+// newRouterMux registers the endpoints of a router, forwarding the signed requests to the shards
+func newRouterMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, pattern := range routedEndpoints {
+		handleSigned(mux, pattern, nil)
+	}
+	handlePublic(mux, "/params", handleRouterParams)
+	handlePublic(mux, "/healthz", handleHealthz)
+	handlePublic(mux, "/readyz", handleReadyz)
+	handlePublic(mux, "/version", handleVersion)
+	handleAdmin(mux, "/metrics", metricsHandler(), http.MethodGet)
+	handleAdmin(mux, "/shard", handleShard, http.MethodGet)
+	return mux
+}
 
-	http.HandleFunc("/put", handlePut)
-	http.HandleFunc("/getAll", handleGetAll)
-	http.HandleFunc("/clear", handleClear)
+// shutdown reports not ready for the delay, so that the load balancer notices, then stops accepting
+// new connections and waits for the in-flight requests to complete
+func shutdown(servers []*http.Server, delay time.Duration, timeout time.Duration) error {
+	shuttingDown.Store(true)
+	close(stopping)
+	time.Sleep(delay)
 
-	// Determine port for HTTP service.
-	// Start HTTP main.
-	log.Printf("Listening on port %d", *portNumber)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *portNumber), nil))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	for _, server := range servers {
+		if serverErr := server.Shutdown(ctx); serverErr != nil {
+			slog.Warn("Requests still in progress after the shutdown timeout", "address", server.Addr, "timeout", timeout.String(), "error", serverErr)
+			server.Close()
+			err = serverErr
+		}
+	}
+	return err
 }
 
 func readUint16(r *bufio.Reader) (uint16, error) {
@@ -65,6 +339,7 @@ func writeUint16(i uint16) []byte {
 type CryptoContext struct {
 	pubkey bitcurve.Point
 	sig    bitcurve.Sig
+	header []byte // r, s and the compressed pubkey as received, for the audit log
 }
 
 type WrongPubkeyError struct{}
@@ -73,6 +348,32 @@ func (e *WrongPubkeyError) Error() string {
 	return "Wrong compressed public key"
 }
 
+type WrongSignatureSizeError struct{}
+
+func (e *WrongSignatureSizeError) Error() string {
+	return "Signature r and s should be 32 bytes each"
+}
+
+// NewCryptoContext parses the signature and the compressed pubkey of a request
+func NewCryptoContext(rbytes []byte, sbytes []byte, pubkeyBytes []byte) (*CryptoContext, error) {
+	if len(rbytes) != 32 || len(sbytes) != 32 {
+		return nil, &WrongSignatureSizeError{}
+	}
+	if len(pubkeyBytes) != 33 {
+		return nil, &WrongPubkeyError{}
+	}
+	pubkey := bitcurve.UnmarshallCompressedPoint(pubkeyBytes)
+	if pubkey == nil {
+		return nil, &WrongPubkeyError{}
+	}
+	sig := bitcurve.NewSig()
+	r := bitcurve.Bin2Bn(rbytes)
+	s := bitcurve.Bin2Bn(sbytes)
+	bitcurve.SigSet(sig, r, s)
+	header := append(append(append([]byte{}, rbytes...), sbytes...), pubkeyBytes...)
+	return &CryptoContext{pubkey: *pubkey, sig: sig, header: header}, nil
+}
+
 func readRequestHeader(body *bufio.Reader) (*CryptoContext, error) {
 	rbytes := make([]byte, 32)
 	_, err := io.ReadFull(body, rbytes)
@@ -83,16 +384,7 @@ func readRequestHeader(body *bufio.Reader) (*CryptoContext, error) {
 			pubkeyBytes := make([]byte, 33)
 			_, err = io.ReadFull(body, pubkeyBytes)
 			if err == nil {
-				pubkey := bitcurve.UnmarshallCompressedPoint(pubkeyBytes)
-				if pubkey != nil {
-					sig := bitcurve.NewSig()
-					r := bitcurve.Bin2Bn(rbytes)
-					s := bitcurve.Bin2Bn(sbytes)
-					bitcurve.SigSet(sig, r, s)
-					return &CryptoContext{pubkey: *pubkey, sig: sig}, nil
-				} else {
-					err = &WrongPubkeyError{}
-				}
+				return NewCryptoContext(rbytes, sbytes, pubkeyBytes)
 			}
 		}
 	}
@@ -104,36 +396,81 @@ func (ctx *CryptoContext) free() {
 	bitcurve.FreeSig(ctx.sig)
 }
 
-func httpError(err error, w http.ResponseWriter, req *http.Request, msg string) bool {
-	if err == nil {
-		return false
-	} else {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(400)
-		fmt.Fprintln(w, err.Error())
+// ClientIPHeader carries the address of the client through the followers, shards and routers forwarding
+// its request. It is only taken from the peers allowed on the admin endpoints.
+const ClientIPHeader = "X-Kv-Client-Ip"
+
+// remoteIP returns the address of the peer of the connection
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
 
-		log.Printf("%s: error %s %s", req.URL, err.Error(), msg)
+// clientIP returns the address of the client, as given by the forwarding server if it is trusted
+func clientIP(req *http.Request) string {
+	if forwarded := net.ParseIP(req.Header.Get(ClientIPHeader)); forwarded != nil && isAdmin(req) {
+		return forwarded.String()
+	}
+	return remoteIP(req)
+}
 
+// forwardClientIP makes the proxy pass the address of the client in ClientIPHeader
+func forwardClientIP(proxy *httputil.ReverseProxy) {
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		ip := clientIP(req)
+		director(req)
+		req.Header.Set(ClientIPHeader, ip)
+	}
+}
+
+// checkRateLimit takes a token for the key from the limiter and responds with 429 if there is none left
+func checkRateLimit(limiter *RateLimiter, key string, w http.ResponseWriter, req *http.Request) bool {
+	ok, wait := limiter.Allow(key)
+	if ok {
 		return true
 	}
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, req, NewAPIError(http.StatusTooManyRequests, ErrRateLimited, "Too many requests").
+		WithDetail("limiter", limiter.name).WithDetail("retry_after", retryAfter))
+	return false
 }
 
-func (ctx *CryptoContext) checkSignature(message []byte, w http.ResponseWriter, req *http.Request) bool {
+// checkPubkeyRateLimit is called after the signature has been verified, so that nobody can
+// exhaust the tokens of somebody else's pubkey
+func (ctx *CryptoContext) checkPubkeyRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	return checkRateLimit(pubkeyLimiter, hex.EncodeToString(bitcurve.MarshallCompressedPoint(ctx.pubkey)), w, req)
+}
+
+// verify checks the signature of the message, the failures are counted per endpoint
+func (ctx *CryptoContext) verify(message []byte, endpoint string, logger *slog.Logger) bool {
 	hash := sha256.Sum256(message)
 	if bitcurve.VerifySig(hash[:], ctx.sig, ctx.pubkey) {
 		return true
 	} else {
+		signatureFailures.WithLabelValues(endpoint).Inc()
 
-		log.Printf("%s: wrong signature for message of length %d and pubkey %s", req.URL, len(message), hex.EncodeToString(bitcurve.MarshallCompressedPoint(ctx.pubkey)))
-
-		w.WriteHeader(403)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprintln(w, "Wrong signature")
+		logger.Warn("Wrong signature", "message_length", len(message), pubkeyAttr(ctx.pubkey))
 		return false
 	}
 }
 
+func (ctx *CryptoContext) checkSignature(message []byte, w http.ResponseWriter, req *http.Request) bool {
+	if ctx.verify(message, req.URL.Path, requestLogger(req)) {
+		return true
+	}
+	writeError(w, req, NewAPIError(http.StatusForbidden, ErrBadSignature, "Wrong signature"))
+	return false
+}
+
 func handlePut(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
 
 	body := bufio.NewReader(req.Body)
 
@@ -153,7 +490,7 @@ func handlePut(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	log.Printf("%s: %s put %s", req.URL, hex.EncodeToString(bitcurve.MarshallCompressedPoint(ctx.pubkey)), string(key))
+	requestLogger(req).Debug("Put", pubkeyAttr(ctx.pubkey), keyAttr(key))
 
 	vsize, err := readUint16(body)
 	if httpError(err, w, req, "reading value size") {
@@ -165,69 +502,338 @@ func handlePut(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	message := append(writeUint16(ksize), key...)
-	message = append(message, writeUint16(vsize)...)
-	message = append(message, value...)
+	message := putMessage(key, value)
 
-	if ctx.checkSignature(message, w, req) {
-		db.Put(ctx.pubkey, key, value)
-		w.WriteHeader(200)
+	if !ctx.checkProofOfWork(message, w, req) {
+		return
+	}
+
+	if ctx.checkSignature(message, w, req) && ctx.checkPubkeyRateLimit(w, req) {
+		version, err := db.Put(ctx.pubkey, key, value, ctx.signed(OpPut, message))
+		if databaseError(err, w, req, "writing to the database") {
+			return
+		}
+		putBytes.Observe(float64(len(key) + len(value)))
+		requestLogger(req).Info("Put", pubkeyAttr(ctx.pubkey), keyAttr(key), "value_size", len(value), "version", version)
+		receipt, err := newReceipt(ctx.pubkey, key, value, version)
+		if receiptError(err, w, req) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"receipt": receipt.toJSON()})
 	}
 }
 
 func handleGetAll(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
 	body := bufio.NewReader(req.Body)
 
 	ctx, err := readRequestHeader(body)
 	if httpError(err, w, req, "reading the header") {
-		log.Printf("%s: error %s", req.URL, err.Error())
 		return
 	}
 
-	log.Printf("%s: %s", req.URL, hex.EncodeToString(bitcurve.MarshallCompressedPoint(ctx.pubkey)))
+	encoding := req.URL.Query().Get("encoding")
+	if encoding == "" {
+		encoding = EncodingHex
+	}
+	if !validEncoding(encoding) {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Unknown encoding").
+			WithDetail("encoding", encoding))
+		return
+	}
 
-	list, err := db.GetAll(ctx.pubkey)
-	if httpError(err, w, req, "querying the database") {
-		log.Printf("%s: error %s requesting the database", req.URL, err.Error())
+	format := negotiateFormat(req)
+	if format == "" {
+		writeError(w, req, NewAPIError(http.StatusNotAcceptable, ErrNotAcceptable, "No supported response format accepted").
+			WithDetail("supported", []string{FormatJSON, FormatCBOR, FormatBinary}))
 		return
 	}
 
-	if ctx.checkSignature([]byte("getAll"), w, req) {
-		log.Printf("%s: %s read %d keys", req.URL, hex.EncodeToString(bitcurve.MarshallCompressedPoint(ctx.pubkey)), len(list))
+	if ctx.checkSignature([]byte("getAll"), w, req) && ctx.checkPubkeyRateLimit(w, req) {
+		// the entries and the root are read from the same snapshot
+		view, err := db.View(bitcurve.MarshallCompressedPoint(ctx.pubkey))
+		if databaseError(err, w, req, "querying the database") {
+			return
+		}
+		defer view.Release()
+		commitment, err := view.Commitment()
+		if databaseError(err, w, req, "computing the root") {
+			return
+		}
+		setCommitmentHeaders(w, commitment)
+		w.Header().Set("Content-Type", format)
+		w.Header().Set("Vary", "Accept")
 		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "application/json")
 
-		fmt.Fprintln(w, "[")
-		for i := 0; i < len(list); i++ {
-			pair := list[i]
-			if i != 0 {
-				fmt.Fprintln(w, ",\n")
-			}
-			fmt.Fprint(w, "{\"key\": \"")
-			hex.NewEncoder(w).Write(pair.key)
-			fmt.Fprint(w, "\", \"value\": \"")
-			hex.NewEncoder(w).Write(pair.value)
-			fmt.Fprint(w, "\"}")
+		// the status is sent already, so an error in the middle has to be reported by the format itself
+		out := newEntryWriter(w, format, encoding)
+		count := 0
+		err = out.begin()
+		if err == nil {
+			err = view.ForEach(func(key []byte, value []byte) error {
+				count++
+				return out.entry(key, value)
+			})
+		}
+		if err == nil {
+			err = out.end()
+		}
+		if err != nil {
+			requestLogger(req).Error("Get all failed", pubkeyAttr(ctx.pubkey), "count", count, "error", err.Error())
+			out.fail(NewAPIError(http.StatusInternalServerError, ErrStorage, "Storage error"))
+			return
 		}
-		fmt.Fprintln(w, "]")
+		requestLogger(req).Info("Get all", pubkeyAttr(ctx.pubkey), "count", count, "format", format)
 	}
 }
 
 func handleClear(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
 	body := bufio.NewReader(req.Body)
 
 	ctx, err := readRequestHeader(body)
 	if httpError(err, w, req, "reading the header") {
-		log.Printf("%s: error %s", req.URL, err.Error())
 		return
 	}
 
-	if ctx.checkSignature([]byte("clear"), w, req) {
-		log.Printf("%s: %s", req.URL, hex.EncodeToString(bitcurve.MarshallCompressedPoint(ctx.pubkey)))
-		err = db.Clear(ctx.pubkey)
-		if httpError(err, w, req, "error clearing the database") {
+	if ctx.checkSignature([]byte("clear"), w, req) && ctx.checkPubkeyRateLimit(w, req) {
+		requestLogger(req).Info("Clear", pubkeyAttr(ctx.pubkey))
+		version, err := db.Clear(ctx.pubkey, ctx.signed(OpClear, []byte("clear")))
+		if databaseError(err, w, req, "clearing the database") {
 			return
 		}
-		w.WriteHeader(200)
+		receipt, err := newRequestReceipt(OpClear, ctx.pubkey, []byte("clear"), version)
+		if receiptError(err, w, req) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"receipt": receipt.toJSON()})
+	}
+}
+
+// the longest a signed restore is accepted after, or before, its ?timestamp=
+const maxRestoreAge = 5 * time.Minute
+
+// handleRestore brings back the keys removed by a clear while they are in the trash,
+// from the last clear or the one given by ?generation=
+func handleRestore(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
+	body := bufio.NewReader(req.Body)
+
+	ctx, err := readRequestHeader(body)
+	if httpError(err, w, req, "reading the header") {
+		return
+	}
+
+	if !db.trash.enabled() {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Trash is not enabled on this server"))
+		return
 	}
+	query := req.URL.Query()
+	var generation uint64
+	if s := query.Get("generation"); s != "" {
+		if generation, err = strconv.ParseUint(s, 10, 64); err != nil || generation == 0 {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong generation").WithDetail("generation", s))
+			return
+		}
+	}
+	// the time makes the signature of a restore valid only for a while, so that it cannot be replayed later
+	timestamp, err := strconv.ParseUint(query.Get("timestamp"), 10, 64)
+	if err != nil || time.Since(time.Unix(0, int64(timestamp))).Abs() > maxRestoreAge {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "The timestamp is missing or too far from the server time").
+			WithDetail("timestamp", query.Get("timestamp")).WithDetail("max_age", maxRestoreAge.String()))
+		return
+	}
+	message := restoreMessage(generation, timestamp)
+
+	if ctx.checkSignature(message, w, req) && ctx.checkPubkeyRateLimit(w, req) {
+		generation, restored, skipped, version, err := db.Restore(ctx.pubkey, generation, ctx.signed(OpRestore, message))
+		var nothing *NothingToRestoreError
+		if errors.As(err, &nothing) {
+			writeError(w, req, NewAPIError(http.StatusNotFound, ErrNotFound, err.Error()).WithDetail("generation", generation))
+			return
+		}
+		if databaseError(err, w, req, "restoring from the trash") {
+			return
+		}
+		requestLogger(req).Info("Restore", pubkeyAttr(ctx.pubkey), "generation", generation, "restored", restored, "skipped", skipped)
+		receipt, err := newRequestReceipt(OpRestore, ctx.pubkey, message, version)
+		if receiptError(err, w, req) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"generation": generation, "restored": restored, "skipped": skipped,
+			"receipt": receipt.toJSON()})
+	}
+}
+
+type getResponse struct {
+	jsonEntry
+	Version uint64 `json:"version,omitempty"`
+}
+
+// handleGet returns the value of one key, or its value at the version ?at= from the history
+func handleGet(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
+	body := bufio.NewReader(req.Body)
+
+	ctx, err := readRequestHeader(body)
+	if httpError(err, w, req, "reading the header") {
+		return
+	}
+
+	ksize, err := readUint16(body)
+	if httpError(err, w, req, "reading key size") {
+		return
+	}
+	key := make([]byte, ksize)
+	_, err = io.ReadFull(body, key)
+	if httpError(err, w, req, "reading key") {
+		return
+	}
+
+	query := req.URL.Query()
+	var at uint64
+	if s := query.Get("at"); s != "" {
+		if !db.history.enabled() {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "History is not enabled on this server"))
+			return
+		}
+		if at, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Wrong version").WithDetail("at", s))
+			return
+		}
+	}
+	encoding := query.Get("encoding")
+	if encoding == "" {
+		encoding = EncodingHex
+	}
+	if !validEncoding(encoding) {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Unknown encoding").
+			WithDetail("encoding", encoding))
+		return
+	}
+
+	if !ctx.checkSignature(getMessage(key), w, req) || !ctx.checkPubkeyRateLimit(w, req) {
+		return
+	}
+
+	var response getResponse
+	var value []byte
+	var found bool
+	if at > 0 {
+		var version Version
+		version, found, err = db.GetAt(ctx.pubkey, key, at)
+		value, response.Version = version.Value, version.Version
+	} else {
+		// the value and the root are read from the same snapshot
+		var view *View
+		if view, err = db.View(bitcurve.MarshallCompressedPoint(ctx.pubkey)); err == nil {
+			defer view.Release()
+			var commitment *Commitment
+			if commitment, err = view.Commitment(); err == nil {
+				setCommitmentHeaders(w, commitment)
+				value, found, err = view.Get(key)
+			}
+		}
+	}
+	if databaseError(err, w, req, "querying the database") {
+		return
+	}
+	requestLogger(req).Info("Get", pubkeyAttr(ctx.pubkey), keyAttr(key), "at", at, "found", found)
+	if !found {
+		writeError(w, req, NewAPIError(http.StatusNotFound, ErrNotFound, "No such key"))
+		return
+	}
+	response.Size = len(value)
+	response.Key, response.KeyEncoding = encodeBytes(key, encoding)
+	response.Value, response.ValueEncoding = encodeBytes(value, encoding)
+	writeJSON(w, http.StatusOK, response)
+}
+
+type historyVersion struct {
+	Version       uint64    `json:"version"`
+	Time          time.Time `json:"time"`
+	Deleted       bool      `json:"deleted"`
+	Value         string    `json:"value,omitempty"`
+	ValueEncoding string    `json:"value_encoding,omitempty"`
+}
+
+// handleHistory lists the kept versions of one key, the oldest first
+func handleHistory(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
+	body := bufio.NewReader(req.Body)
+
+	ctx, err := readRequestHeader(body)
+	if httpError(err, w, req, "reading the header") {
+		return
+	}
+
+	ksize, err := readUint16(body)
+	if httpError(err, w, req, "reading key size") {
+		return
+	}
+	key := make([]byte, ksize)
+	_, err = io.ReadFull(body, key)
+	if httpError(err, w, req, "reading key") {
+		return
+	}
+
+	encoding := req.URL.Query().Get("encoding")
+	if encoding == "" {
+		encoding = EncodingHex
+	}
+	if !validEncoding(encoding) {
+		writeError(w, req, NewAPIError(http.StatusBadRequest, ErrBadRequest, "Unknown encoding").
+			WithDetail("encoding", encoding))
+		return
+	}
+
+	if !ctx.checkSignature(historyMessage(key), w, req) || !ctx.checkPubkeyRateLimit(w, req) {
+		return
+	}
+
+	versions, err := db.History(ctx.pubkey, key)
+	if databaseError(err, w, req, "querying the database") {
+		return
+	}
+	response := make([]historyVersion, len(versions))
+	for i, version := range versions {
+		response[i] = historyVersion{Version: version.Version, Time: version.Time.UTC(), Deleted: version.Deleted}
+		if !version.Deleted {
+			response[i].Value, response[i].ValueEncoding = encodeBytes(version.Value, encoding)
+		}
+	}
+	requestLogger(req).Info("History", pubkeyAttr(ctx.pubkey), keyAttr(key), "count", len(versions))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"versions": response})
+}
+
+// handleParams advertises the server parameters clients need to build valid requests
+func handleParams(w http.ResponseWriter, req *http.Request) {
+	if !checkRateLimit(ipLimiter, clientIP(req), w, req) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pow": map[string]interface{}{
+			"mode":       pow.Mode,
+			"difficulty": pow.Difficulty,
+			"header":     PowHeader,
+			"hash":       "sha256(pubkey || sha256(message) || nonce)",
+		},
+		"server_pubkey": hex.EncodeToString(identity.Pubkey),
+	})
 }